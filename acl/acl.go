@@ -0,0 +1,88 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+type Operation string
+
+const (
+	Read   Operation = "read"
+	Write  Operation = "write"
+	Delete Operation = "delete"
+	Admin  Operation = "admin" // manage ACLs
+)
+
+// AnyNamespace matches keys in every namespace
+const AnyNamespace = "*"
+
+// Rule grants a set of operations on all keys in a namespace that start with
+// Prefix, an empty prefix matches every key
+type Rule struct {
+	Namespace string
+	Prefix    string
+	Ops       []Operation
+}
+
+func (r *Rule) Matches(ns, key string, op Operation) bool {
+	if r.Namespace != AnyNamespace && r.Namespace != ns {
+		return false
+	}
+
+	if !strings.HasPrefix(key, r.Prefix) {
+		return false
+	}
+
+	for _, o := range r.Ops {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ACL is the list of rules for a single principal, principals authenticate
+// with an API token, only a hash of the token is ever stored
+type ACL struct {
+	Principal string
+	TokenHash string `json:",omitempty"`
+	Rules     []Rule
+}
+
+func (a *ACL) Allowed(ns, key string, op Operation) bool {
+	if a == nil {
+		return false
+	}
+
+	for i := range a.Rules {
+		if a.Rules[i].Matches(ns, key, op) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAdmin checks if the principal may manage ACLs
+func (a *ACL) IsAdmin() bool {
+	if a == nil {
+		return false
+	}
+
+	for _, r := range a.Rules {
+		for _, o := range r.Ops {
+			if o == Admin {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func HashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
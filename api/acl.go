@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type ACLReq struct {
+	Token string
+	Rules []acl.Rule
+}
+
+func requestToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+
+	return h
+}
+
+// authorize checks the token of a request against the ACLs, if the request
+// is not allowed the error is written to the client and false is returned
+func (a *WebAPI) authorize(w http.ResponseWriter, r *http.Request, ns, key string, op acl.Operation) bool {
+	if a.cfg == nil || !a.cfg.EnableACL {
+		return true
+	}
+
+	err := a.server.Authorize(requestToken(r), a.cfg.AdminToken, ns, key, op)
+	switch err.(type) {
+	case nil:
+		return true
+	case *server.DeniedError:
+		a.wErr(w, r, err.Error(), http.StatusForbidden)
+	default:
+		code := http.StatusInternalServerError
+		if err == server.ErrNoToken || err == server.ErrUnknownToken {
+			code = http.StatusUnauthorized
+		}
+		a.wErr(w, r, err.Error(), code)
+	}
+
+	return false
+}
+
+func (a *WebAPI) ListACLs(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	acls, err := a.server.ACLs()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.wOk(w, r, acls, http.StatusOK)
+}
+
+func (a *WebAPI) SetACL(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var obj ACLReq
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if obj.Token == "" {
+		a.wErr(w, r, "token required", http.StatusBadRequest)
+		return
+	}
+
+	principal := mux.Vars(r)["principal"]
+	err = a.server.SetACL(obj.Token, &acl.ACL{Principal: principal, Rules: obj.Rules})
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusBadRequest))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("ACL set for %s", principal), http.StatusOK)
+}
+
+func (a *WebAPI) DeleteACL(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	principal := mux.Vars(r)["principal"]
+	err := a.server.DeleteACL(principal)
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusNotFound))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("ACL deleted for %s", principal), http.StatusOK)
+}
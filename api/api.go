@@ -4,11 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
 	"github.com/lonelycode/yzma/logger"
 	"github.com/lonelycode/yzma/oplog"
+	"github.com/lonelycode/yzma/peering"
 	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/types/crdt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -16,10 +22,15 @@ var log = logger.GetLogger("api")
 
 type Payload struct {
 	Status string
-	Error  string `json:",omitempty"`
+	Error  string      `json:",omitempty"`
 	Data   interface{} `json:",omitempty"`
 }
 
+type ReplicationStatus struct {
+	Outbound []peering.PeerBacklog
+	Inbox    oplog.InboxStats
+}
+
 type JoinReq struct {
 	Peers []string
 }
@@ -33,6 +44,7 @@ type WebAPI struct {
 
 func (a *WebAPI) Start(srv *server.Server, cfg *APICfg) {
 	a.server = srv
+	a.cfg = cfg
 	a.mux = mux.NewRouter()
 	a.initEndpoints(a.mux, a)
 
@@ -44,6 +56,10 @@ func (a *WebAPI) Start(srv *server.Server, cfg *APICfg) {
 }
 
 func (a *WebAPI) ClusterJoin(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
 	b, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
@@ -68,6 +84,10 @@ func (a *WebAPI) ClusterJoin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *WebAPI) ClusterLeave(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
 	err := a.server.Leave()
 	if err != nil {
 		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
@@ -77,6 +97,76 @@ func (a *WebAPI) ClusterLeave(w http.ResponseWriter, r *http.Request) {
 	a.wOk(w, r, "leave ok", http.StatusOK)
 }
 
+func (a *WebAPI) GetFaults(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	f, err := a.server.Faults()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.wOk(w, r, f, http.StatusOK)
+}
+
+func (a *WebAPI) SetFaults(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	obj := &peering.FaultConfig{}
+	err = json.Unmarshal(b, obj)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = a.server.SetFaults(obj)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.wOk(w, r, obj, http.StatusOK)
+}
+
+func (a *WebAPI) ClearFaults(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	err := a.server.SetFaults(nil)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.wOk(w, r, "faults cleared", http.StatusOK)
+}
+
+func (a *WebAPI) ReplicationBacklog(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	b, err := a.server.ReplicationBacklog()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.wOk(w, r, ReplicationStatus{Outbound: b, Inbox: a.server.InboxStats()}, http.StatusOK)
+}
+
 func (a *WebAPI) AddObject(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
 	k, ok := v["key"]
@@ -85,6 +175,16 @@ func (a *WebAPI) AddObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ns, err := namespace(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !a.authorize(w, r, ns, k, acl.Write) {
+		return
+	}
+
 	b, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
@@ -97,7 +197,34 @@ func (a *WebAPI) AddObject(w http.ResponseWriter, r *http.Request) {
 		t = r.Header.Get("content-type")
 	}
 
-	a.server.Add(k, b, t)
+	var ctx crdt.VersionVector
+	if c := r.Header.Get(ContextHeader); c != "" {
+		ctx, err = crdt.ParseVersionVector(c)
+		if err != nil {
+			a.wErr(w, r, "invalid context: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	wc, err := a.writeConcern(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.server.AddWithConcern(ns, k, b, t, ctx, wc)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(SessionHeader, res.Token)
+
+	if !res.Met() {
+		a.wOk(w, r, res, http.StatusAccepted)
+		return
+	}
+
 	a.wOk(w, r, fmt.Sprintf("added %s", k), http.StatusOK)
 }
 
@@ -109,10 +236,134 @@ func (a *WebAPI) RemObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.server.Remove(k)
+	ns, err := namespace(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !a.authorize(w, r, ns, k, acl.Delete) {
+		return
+	}
+
+	wc, err := a.writeConcern(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.server.RemoveWithConcern(ns, k, wc)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(SessionHeader, res.Token)
+
+	if !res.Met() {
+		a.wOk(w, r, res, http.StatusAccepted)
+		return
+	}
+
 	a.wOk(w, r, fmt.Sprintf("deleted %s", k), http.StatusOK)
 }
 
+// RemPrefix removes every key starting with the prefix query parameter with
+// a single op, the prefix can't be empty, drop the namespace instead
+func (a *WebAPI) RemPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		a.wErr(w, r, "prefix required", http.StatusBadRequest)
+		return
+	}
+
+	ns, err := namespace(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !a.authorize(w, r, ns, prefix, acl.Delete) {
+		return
+	}
+
+	wc, err := a.writeConcern(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.server.RemovePrefix(ns, prefix, wc)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(SessionHeader, res.Token)
+	if !res.Met() {
+		a.wOk(w, r, res, http.StatusAccepted)
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("deleted %d keys starting with %s", res.Removed, prefix), http.StatusOK)
+}
+
+// ContextHeader carries the causal context of a read, see crdt.VersionVector
+const ContextHeader = "X-Context"
+
+// SessionHeader carries the session token of a write, reads that send it
+// back only answer once the node has applied that write
+const SessionHeader = "X-Session-Token"
+
+// WriteConcernHeader sets how many peers must apply a write before it is
+// acknowledged: local (the default), a number of peers, or all
+const WriteConcernHeader = "X-Write-Concern"
+
+func (a *WebAPI) writeConcern(r *http.Request) (server.WriteConcern, error) {
+	switch wc := r.Header.Get(WriteConcernHeader); wc {
+	case "", "local":
+		return server.ConcernLocal, nil
+	case "all":
+		return server.ConcernAll, nil
+	default:
+		n, err := strconv.Atoi(wc)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("write concern must be local, all or a number of peers, got %q", wc)
+		}
+		return server.WriteConcern(n), a.server.CheckConcern(server.WriteConcern(n))
+	}
+}
+
+// catchUp waits until the node has applied the writes covered by the
+// session token of a request, if it can't the client should retry, possibly
+// on another node
+func (a *WebAPI) catchUp(w http.ResponseWriter, r *http.Request) bool {
+	t := r.Header.Get(SessionHeader)
+	if t == "" {
+		return true
+	}
+
+	token, err := crdt.ParseVersionVector(t)
+	if err != nil {
+		a.wErr(w, r, "invalid session token: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	ok, err := a.server.WaitFor(token)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		a.wErr(w, r, "node has not caught up with the session yet", http.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
+
 type PublicData struct {
 	Data interface{}
 	Type string
@@ -126,15 +377,106 @@ func (a *WebAPI) LoadObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dat, ok := a.server.Load(k)
+	ns, err := namespace(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !a.authorize(w, r, ns, k, acl.Read) {
+		return
+	}
+
+	if !a.catchUp(w, r) {
+		return
+	}
+
+	dat, ok := a.server.LoadNS(ns, k)
 	if !ok {
 		a.wErr(w, r, "not found", http.StatusNotFound)
 		return
 	}
 
+	// writes that send the context back supersede what was read here
+	w.Header().Set(ContextHeader, dat.Context().String())
+
+	// only the strategies that keep concurrent values surface siblings, so
+	// clients of keys with a single value never get a list
+	strat := a.server.StrategyFor(k)
+	if len(dat) > 1 && (strat == crdt.MVRStrat || strat == crdt.AllStrat) {
+		values := make([]*crdt.TSValue, 0, len(dat))
+		for _, v := range dat {
+			values = append(values, v)
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i].TS < values[j].TS })
+
+		siblings := make([]*PublicData, len(values))
+		for i, v := range values {
+			siblings[i] = &PublicData{Data: v.Value, Type: v.MimeType}
+		}
+
+		a.wOk(w, r, siblings, http.StatusMultipleChoices)
+		return
+	}
+
 	d, t := dat.Extract()
 
-	a.wOk(w, r, &PublicData{Data:d, Type:t}, http.StatusOK)
+	a.wOk(w, r, &PublicData{Data: d, Type: t}, http.StatusOK)
+}
+
+func (a *WebAPI) ListNamespaces(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	names, err := a.server.Namespaces()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.wOk(w, r, names, http.StatusOK)
+}
+
+func (a *WebAPI) CreateNamespace(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	ns := mux.Vars(r)["ns"]
+	err := a.server.CreateNamespace(ns)
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusBadRequest))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("created %s", ns), http.StatusOK)
+}
+
+func (a *WebAPI) DropNamespace(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r, "", "", acl.Admin) {
+		return
+	}
+
+	ns := mux.Vars(r)["ns"]
+	err := a.server.DropNamespace(ns)
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusBadRequest))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("dropped %s", ns), http.StatusOK)
+}
+
+// namespace returns the namespace of a request, routes without one use the
+// default namespace
+func namespace(r *http.Request) (string, error) {
+	ns, ok := mux.Vars(r)["ns"]
+	if !ok {
+		return db.DefaultNS, nil
+	}
+
+	return ns, db.ValidateNamespace(ns)
 }
 
 func (a *WebAPI) wOk(w http.ResponseWriter, r *http.Request, msg interface{}, code int) {
@@ -146,6 +488,16 @@ func (a *WebAPI) wOk(w http.ResponseWriter, r *http.Request, msg interface{}, co
 	a.writeToClient(w, r, pl, code)
 }
 
+// failedWrite returns the status for a failed write, ops that could not be
+// committed are server errors, anything else failed validation with code
+func failedWrite(err error, code int) int {
+	if _, ok := err.(*oplog.CommitError); ok {
+		return http.StatusInternalServerError
+	}
+
+	return code
+}
+
 func (a *WebAPI) wErr(w http.ResponseWriter, r *http.Request, errMsg string, errCode int) {
 	pl := &Payload{
 		Status: "error",
@@ -3,7 +3,9 @@ package api
 import "github.com/spf13/viper"
 
 type APICfg struct {
-	Bind string
+	Bind       string
+	EnableACL  bool   // require a token that is allowed by the ACLs on every key request
+	AdminToken string // token that bypasses the ACLs, used to bootstrap them
 }
 
 type Config struct {
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"net/http"
+	"strconv"
+)
+
+type CounterData struct {
+	Key   string
+	Value int64
+}
+
+func counterDelta(r *http.Request) (int64, error) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.ParseInt(by, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("by must be a positive integer, got %q", by)
+	}
+
+	return n, nil
+}
+
+func (a *WebAPI) IncrCounter(w http.ResponseWriter, r *http.Request) {
+	a.changeCounter(w, r, a.server.Incr, "incremented")
+}
+
+func (a *WebAPI) DecrCounter(w http.ResponseWriter, r *http.Request) {
+	a.changeCounter(w, r, a.server.Decr, "decremented")
+}
+
+func (a *WebAPI) changeCounter(w http.ResponseWriter, r *http.Request, change func(string, int64) error, verb string) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Write) {
+		return
+	}
+
+	by, err := counterDelta(r)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := change(k, by); err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("%s %s by %d", verb, k, by), http.StatusOK)
+}
+
+func (a *WebAPI) LoadCounter(w http.ResponseWriter, r *http.Request) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Read) {
+		return
+	}
+
+	v, ok := a.server.Counter(k)
+	if !ok {
+		a.wErr(w, r, "not found", http.StatusNotFound)
+		return
+	}
+
+	a.wOk(w, r, &CounterData{Key: k, Value: v}, http.StatusOK)
+}
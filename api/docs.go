@@ -0,0 +1,47 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"io/ioutil"
+	"net/http"
+)
+
+func (a *WebAPI) PatchDoc(w http.ResponseWriter, r *http.Request) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Write) {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = a.server.PatchDoc(k, b)
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusBadRequest))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("patched %s", k), http.StatusOK)
+}
+
+func (a *WebAPI) LoadDoc(w http.ResponseWriter, r *http.Request) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Read) {
+		return
+	}
+
+	doc, ok := a.server.Doc(k)
+	if !ok {
+		a.wErr(w, r, "not found", http.StatusNotFound)
+		return
+	}
+
+	a.wOk(w, r, doc, http.StatusOK)
+}
@@ -8,4 +8,27 @@ func (a *WebAPI) initEndpoints(r *mux.Router, apiServer *WebAPI) {
 	r.HandleFunc("/keys/{key}", apiServer.AddObject).Methods("POST")
 	r.HandleFunc("/keys/{key}", apiServer.RemObject).Methods("DELETE")
 	r.HandleFunc("/keys/{key}", apiServer.LoadObject).Methods("GET")
+	r.HandleFunc("/keys", apiServer.RemPrefix).Methods("DELETE")
+	r.HandleFunc("/ns", apiServer.ListNamespaces).Methods("GET")
+	r.HandleFunc("/ns/{ns}", apiServer.CreateNamespace).Methods("POST")
+	r.HandleFunc("/ns/{ns}", apiServer.DropNamespace).Methods("DELETE")
+	r.HandleFunc("/ns/{ns}/keys/{key}", apiServer.AddObject).Methods("POST")
+	r.HandleFunc("/ns/{ns}/keys/{key}", apiServer.RemObject).Methods("DELETE")
+	r.HandleFunc("/ns/{ns}/keys/{key}", apiServer.LoadObject).Methods("GET")
+	r.HandleFunc("/ns/{ns}/keys", apiServer.RemPrefix).Methods("DELETE")
+	r.HandleFunc("/counters/{key}/incr", apiServer.IncrCounter).Methods("POST")
+	r.HandleFunc("/counters/{key}/decr", apiServer.DecrCounter).Methods("POST")
+	r.HandleFunc("/counters/{key}", apiServer.LoadCounter).Methods("GET")
+	r.HandleFunc("/sets/{key}/members", apiServer.AddSetMembers).Methods("POST")
+	r.HandleFunc("/sets/{key}/members/{member}", apiServer.RemSetMember).Methods("DELETE")
+	r.HandleFunc("/sets/{key}", apiServer.LoadSet).Methods("GET")
+	r.HandleFunc("/docs/{key}", apiServer.PatchDoc).Methods("PATCH")
+	r.HandleFunc("/docs/{key}", apiServer.LoadDoc).Methods("GET")
+	r.HandleFunc("/acl", apiServer.ListACLs).Methods("GET")
+	r.HandleFunc("/acl/{principal}", apiServer.SetACL).Methods("POST")
+	r.HandleFunc("/acl/{principal}", apiServer.DeleteACL).Methods("DELETE")
+	r.HandleFunc("/admin/faults", apiServer.GetFaults).Methods("GET")
+	r.HandleFunc("/admin/faults", apiServer.SetFaults).Methods("POST")
+	r.HandleFunc("/admin/faults", apiServer.ClearFaults).Methods("DELETE")
+	r.HandleFunc("/admin/replication", apiServer.ReplicationBacklog).Methods("GET")
 }
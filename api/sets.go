@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type SetReq struct {
+	Members []string
+}
+
+type SetData struct {
+	Key     string
+	Members []string
+}
+
+func (a *WebAPI) AddSetMembers(w http.ResponseWriter, r *http.Request) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Write) {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var obj SetReq
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = a.server.SetAdd(k, obj.Members...)
+	if err != nil {
+		a.wErr(w, r, err.Error(), failedWrite(err, http.StatusBadRequest))
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("added %s to %s", strings.Join(obj.Members, ","), k), http.StatusOK)
+}
+
+func (a *WebAPI) RemSetMember(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	k, m := v["key"], v["member"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Delete) {
+		return
+	}
+
+	err := a.server.SetRemove(k, m)
+	if err != nil {
+		a.wErr(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.wOk(w, r, fmt.Sprintf("removed %s from %s", m, k), http.StatusOK)
+}
+
+func (a *WebAPI) LoadSet(w http.ResponseWriter, r *http.Request) {
+	k := mux.Vars(r)["key"]
+	if !a.authorize(w, r, db.DefaultNS, k, acl.Read) {
+		return
+	}
+
+	members, ok := a.server.SetMembers(k)
+	if !ok {
+		a.wErr(w, r, "not found", http.StatusNotFound)
+		return
+	}
+
+	a.wOk(w, r, &SetData{Key: k, Members: members}, http.StatusOK)
+}
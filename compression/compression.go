@@ -0,0 +1,68 @@
+package compression
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+)
+
+const (
+	None   = "none"
+	Snappy = "snappy"
+)
+
+// Frame is the first byte of compressed data, 0xc1 is never used by msgpack
+// so compressed and plain data can be told apart and mixed freely
+const Frame byte = 0xc1
+
+const snappyID byte = 0x01
+
+// minSize is the size below which compression is not worth trying
+const minSize = 64
+
+func Supported(algo string) bool {
+	return algo == None || algo == Snappy
+}
+
+// Validate checks an algorithm name, an empty name is the same as none
+func Validate(algo string) error {
+	if algo != "" && !Supported(algo) {
+		return fmt.Errorf("unsupported compression %q, use %s or %s", algo, Snappy, None)
+	}
+
+	return nil
+}
+
+// Encode compresses b with algo, b is returned as it is if compression is
+// off or doesn't make it smaller
+func Encode(algo string, b []byte) []byte {
+	if algo != Snappy || len(b) < minSize {
+		return b
+	}
+
+	out := make([]byte, 2, 2+snappy.MaxEncodedLen(len(b)))
+	out[0], out[1] = Frame, snappyID
+	out = append(out, snappy.Encode(nil, b)...)
+	if len(out) >= len(b) {
+		return b
+	}
+
+	return out
+}
+
+func IsCompressed(b []byte) bool {
+	return len(b) > 1 && b[0] == Frame
+}
+
+// Decode decompresses data made by Encode, anything else is returned as it is
+func Decode(b []byte) ([]byte, error) {
+	if !IsCompressed(b) {
+		return b, nil
+	}
+
+	switch b[1] {
+	case snappyID:
+		return snappy.Decode(nil, b[2:])
+	default:
+		return nil, fmt.Errorf("unknown compression %d", b[1])
+	}
+}
@@ -0,0 +1,42 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("yzma "), 100)
+	small := []byte{0x82, 0xa1, 'k', 0x01}
+
+	tests := []struct {
+		name       string
+		algo       string
+		in         []byte
+		compressed bool
+	}{
+		{"snappy", Snappy, big, true},
+		{"none", None, big, false},
+		{"too small", Snappy, small, false},
+	}
+
+	for _, tc := range tests {
+		enc := Encode(tc.algo, tc.in)
+		if IsCompressed(enc) != tc.compressed {
+			t.Fatalf("%s: expected compressed to be %v", tc.name, tc.compressed)
+		}
+
+		if tc.compressed && len(enc) >= len(tc.in) {
+			t.Errorf("%s: expected %d bytes to shrink, got %d", tc.name, len(tc.in), len(enc))
+		}
+
+		dec, err := Decode(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(dec, tc.in) {
+			t.Errorf("%s: round trip changed the data", tc.name)
+		}
+	}
+}
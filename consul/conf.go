@@ -0,0 +1,30 @@
+package consul
+
+import (
+	"github.com/lonelycode/yzma/logger"
+	"github.com/spf13/viper"
+)
+
+type ConsulCfg struct {
+	Bind       string // e.g. :8500, the API only starts if set
+	Namespace  string // namespace used when a request has no ?ns, the default if empty
+	EnableACL  bool   // require a token that is allowed by the ACLs on every request
+	AdminToken string // token that bypasses the ACLs
+}
+
+type Config struct {
+	Consul *ConsulCfg
+}
+
+var sconf = &Config{}
+
+var log = logger.GetLogger("consul")
+
+func GetConf() *ConsulCfg {
+	err := viper.Unmarshal(sconf)
+	if err != nil {
+		log.Fatal("failed to read Consul config: ", err)
+	}
+
+	return sconf.Consul
+}
@@ -0,0 +1,195 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server/servertest"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testAddr = "http://127.0.0.1:40411/v1/kv/"
+
+func do(t *testing.T, method, path string, body string) (int, []byte, uint64) {
+	req, err := http.NewRequest(method, testAddr+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return resp.StatusCode, data, idx
+}
+
+func getPairs(t *testing.T, path string) ([]KVPair, uint64) {
+	code, data, idx := do(t, "GET", path, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET %s returned %d", path, code)
+	}
+
+	pairs := []KVPair{}
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	return pairs, idx
+}
+
+func TestKV(t *testing.T) {
+	srv := servertest.Start(t, "consul", nil).Server
+
+	c := &ConsulAPI{}
+	if err := c.Start(srv, &ConsulCfg{Bind: "127.0.0.1:40411"}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if code, data, _ := do(t, "PUT", "app/config/a?flags=7", "1"); code != http.StatusOK || string(data) != "true" {
+		t.Fatalf("unexpected put response %d %s", code, data)
+	}
+
+	pairs, idx := getPairs(t, "app/config/a")
+	if len(pairs) != 1 || string(pairs[0].Value) != "1" || pairs[0].Flags != 7 || idx == 0 || pairs[0].ModifyIndex != idx {
+		t.Fatalf("unexpected pairs %v at %d", pairs, idx)
+	}
+
+	if code, data, _ := do(t, "GET", "app/config/a?raw", ""); code != http.StatusOK || string(data) != "1" {
+		t.Fatalf("unexpected raw response %d %s", code, data)
+	}
+
+	if code, _, _ := do(t, "GET", "missing", ""); code != http.StatusNotFound {
+		t.Fatalf("expected a missing key to return 404, got %d", code)
+	}
+
+	// check-and-set only succeeds against the current index
+	stale := pairs[0].ModifyIndex
+	if _, data, _ := do(t, "PUT", fmt.Sprintf("app/config/a?cas=%d", stale), "2"); string(data) != "true" {
+		t.Fatalf("expected the cas to succeed, got %s", data)
+	}
+
+	if _, data, _ := do(t, "PUT", fmt.Sprintf("app/config/a?cas=%d", stale), "3"); string(data) != "false" {
+		t.Fatalf("expected the stale cas to fail, got %s", data)
+	}
+
+	// an index of 0 only creates keys
+	if _, data, _ := do(t, "PUT", "app/config/a?cas=0", "4"); string(data) != "false" {
+		t.Fatalf("expected the cas to fail for an existing key, got %s", data)
+	}
+
+	for _, k := range []string{"app/config/b", "app/db/host", "other"} {
+		if code, _, _ := do(t, "PUT", k, k); code != http.StatusOK {
+			t.Fatalf("put of %s returned %d", k, code)
+		}
+	}
+
+	pairs, _ = getPairs(t, "app/?recurse")
+	if len(pairs) != 3 || pairs[0].Key != "app/config/a" || string(pairs[0].Value) != "2" {
+		t.Fatalf("unexpected recurse result %v", pairs)
+	}
+
+	_, data, _ := do(t, "GET", "app/?keys&separator=/", "")
+	if string(bytes.TrimSpace(data)) != `["app/config/","app/db/"]` {
+		t.Fatalf("unexpected keys %s", data)
+	}
+
+	// a blocking query returns once the key changes, not for other keys
+	_, idx = getPairs(t, "app/db/host")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		do(t, "PUT", "other", "unrelated")
+		time.Sleep(200 * time.Millisecond)
+		do(t, "PUT", "app/db/host", "db2")
+	}()
+
+	start := time.Now()
+	pairs, idx2 := getPairs(t, fmt.Sprintf("app/db/host?index=%d&wait=5s", idx))
+	if string(pairs[0].Value) != "db2" || idx2 <= idx {
+		t.Fatalf("expected the new value with a higher index, got %s at %d", pairs[0].Value, idx2)
+	}
+
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("expected the query to block until the key changed")
+	}
+
+	// and times out when nothing changes
+	start = time.Now()
+	_, idx3 := getPairs(t, fmt.Sprintf("app/db/host?index=%d&wait=300ms", idx2))
+	if idx3 != idx2 || time.Since(start) < 300*time.Millisecond {
+		t.Fatalf("expected the query to time out, got index %d", idx3)
+	}
+
+	if code, _, _ := do(t, "DELETE", "app/config/?recurse", ""); code != http.StatusOK {
+		t.Fatalf("recursive delete returned %d", code)
+	}
+
+	if pairs, _ := getPairs(t, "app/?recurse"); len(pairs) != 1 || pairs[0].Key != "app/db/host" {
+		t.Fatalf("expected only app/db/host to be left, got %v", pairs)
+	}
+
+	if code, _, _ := do(t, "DELETE", "other", ""); code != http.StatusOK {
+		t.Fatalf("delete returned %d", code)
+	}
+
+	if code, _, _ := do(t, "GET", "other", ""); code != http.StatusNotFound {
+		t.Fatalf("expected other to be deleted, got %d", code)
+	}
+	// an empty prefix removes every key
+	if code, _, _ := do(t, "DELETE", "?recurse", ""); code != http.StatusOK {
+		t.Fatalf("recursive delete of every key returned %d", code)
+	}
+
+	if code, _, _ := do(t, "GET", "?recurse", ""); code != http.StatusNotFound {
+		t.Fatalf("expected every key to be deleted, got %d", code)
+	}
+}
+
+func TestDeleteAllNeedsAdmin(t *testing.T) {
+	srv := servertest.Start(t, "consul", nil).Server
+
+	c := &ConsulAPI{}
+	if err := c.Start(srv, &ConsulCfg{Bind: "127.0.0.1:40412", EnableACL: true, AdminToken: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	err := srv.SetACL("writer", &acl.ACL{
+		Principal: "writer",
+		Rules:     []acl.Rule{{Prefix: "", Ops: []acl.Operation{acl.Read, acl.Write, acl.Delete}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, expected := range map[string]int{"writer": http.StatusForbidden, "admin": http.StatusOK} {
+		req, err := http.NewRequest("DELETE", "http://127.0.0.1:40412/v1/kv/?recurse", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Consul-Token", token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			t.Fatalf("expected %s to get %d, got %d", token, expected, resp.StatusCode)
+		}
+	}
+}
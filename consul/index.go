@@ -0,0 +1,160 @@
+package consul
+
+import (
+	"context"
+	"github.com/lonelycode/yzma/oplog"
+	"github.com/lonelycode/yzma/server"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writes queued for a tracker before its watch is dropped and restarted
+const trackerBuffer = 4096
+
+// tracker maps the keys of a namespace to the commit index of their last
+// change on this node, which is what Consul calls the modify index. Changes
+// are only tracked while the process runs, keys that have not changed since
+// the tracker started report the index it started at, so indexes never go
+// backwards and a key never keeps its index across a change.
+type tracker struct {
+	server  *server.Server
+	ns      string
+	mtx     sync.Mutex
+	start   uint64
+	keys    map[string]uint64
+	changed chan struct{}
+	w       *oplog.Watch
+}
+
+func newTracker(srv *server.Server, ns string) (*tracker, error) {
+	t := &tracker{server: srv, ns: ns, changed: make(chan struct{})}
+	t.reset()
+
+	go t.run()
+	return t, nil
+}
+
+// reset watches the namespace from the current position, t.mtx must be held
+// or the tracker not started yet
+func (t *tracker) reset() {
+	// watch first so no change between reading the index and watching is
+	// missed
+	t.w = t.server.Watch(t.ns, "", trackerBuffer)
+	t.start = t.position()
+	t.keys = map[string]uint64{}
+}
+
+// position returns the commit index, it grows with every op applied, even
+// one applied before the ops it follows. Consul clients treat an index of
+// zero as no index.
+func (t *tracker) position() uint64 {
+	return t.server.CommitIndex() + 1
+}
+
+func (t *tracker) run() {
+	for {
+		op, ok := <-t.w.C()
+		t.mtx.Lock()
+		if !ok {
+			// the watch fell behind, every index moves past what was handed out
+			log.Warning("index tracker of namespace '", t.ns, "' fell behind, restarting it")
+			t.reset()
+			t.notify()
+			t.mtx.Unlock()
+			continue
+		}
+
+		keys := []string{op.Key}
+		if op.Op == oplog.REMPREFIX {
+			keys = keys[:0]
+			for k := range op.Observed {
+				keys = append(keys, k)
+			}
+		}
+
+		pos := op.CommitIndex() + 1
+		for _, k := range keys {
+			t.bump(k, pos)
+		}
+		t.notify()
+		t.mtx.Unlock()
+	}
+}
+
+// bump records a change of key at pos, changes from before the tracker
+// started are covered by its start index, t.mtx must be held
+func (t *tracker) bump(key string, pos uint64) {
+	if pos > t.start && pos > t.keys[key] {
+		t.keys[key] = pos
+	}
+}
+
+// notify wakes up blocked queries, t.mtx must be held
+func (t *tracker) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// record notes a write made through this API right away, the watch may not
+// have delivered it yet when the next check-and-set comes in
+func (t *tracker) record(key string) {
+	pos := t.position()
+	t.mtx.Lock()
+	t.bump(key, pos)
+	t.notify()
+	t.mtx.Unlock()
+}
+
+// Index returns the modify index of key
+func (t *tracker) Index(key string) uint64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.index(key, false)
+}
+
+// index returns the modify index of key, or the highest index of the keys
+// starting with it, t.mtx must be held
+func (t *tracker) index(key string, prefix bool) uint64 {
+	idx := t.start
+	if !prefix {
+		if i, ok := t.keys[key]; ok {
+			idx = i
+		}
+		return idx
+	}
+
+	for k, i := range t.keys {
+		if i > idx && strings.HasPrefix(k, key) {
+			idx = i
+		}
+	}
+
+	return idx
+}
+
+// Wait blocks until the index of key, or of the keys starting with it,
+// differs from index or the timeout passes, it returns the current index
+func (t *tracker) Wait(ctx context.Context, key string, prefix bool, index uint64, timeout time.Duration) uint64 {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		t.mtx.Lock()
+		idx, changed := t.index(key, prefix), t.changed
+		t.mtx.Unlock()
+
+		if index == 0 || idx != index {
+			return idx
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return idx
+		case <-ctx.Done():
+			return idx
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/types/crdt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Consul refuses values larger than this
+	maxValueSize = 512 * 1024
+
+	defaultWait = 5 * time.Minute
+	maxWait     = 10 * time.Minute
+
+	// flagsType is the mime type values are stored with when the client sets
+	// flags, the flags are kept as a parameter
+	flagsType = "application/octet-stream"
+)
+
+// KVPair is a key as Consul returns it
+type KVPair struct {
+	LockIndex   uint64
+	Key         string
+	Flags       uint64
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// ConsulAPI serves the Consul KV HTTP API on top of a server
+type ConsulAPI struct {
+	server   *server.Server
+	cfg      *ConsulCfg
+	http     *http.Server
+	trackers map[string]*tracker
+	mtx      sync.Mutex
+
+	// check-and-set writes check and write under this lock, so they are
+	// atomic for the clients of this node
+	writeMtx sync.Mutex
+}
+
+// Start listens on cfg.Bind, it returns once the listener is ready
+func (c *ConsulAPI) Start(srv *server.Server, cfg *ConsulCfg) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	ln, err := net.Listen("tcp", cfg.Bind)
+	if err != nil {
+		return err
+	}
+
+	c.server = srv
+	c.cfg = cfg
+	c.trackers = map[string]*tracker{}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/kv/{key:.*}", c.Get).Methods("GET")
+	r.HandleFunc("/v1/kv/{key:.*}", c.Put).Methods("PUT")
+	r.HandleFunc("/v1/kv/{key:.*}", c.Delete).Methods("DELETE")
+	c.http = &http.Server{Handler: r}
+
+	go func() {
+		if err := c.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+
+	log.Info("Consul KV API listening on ", cfg.Bind)
+	return nil
+}
+
+func (c *ConsulAPI) Stop() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.http == nil {
+		return nil
+	}
+
+	return c.http.Close()
+}
+
+// tracker returns the index tracker of a namespace, starting it on first use
+func (c *ConsulAPI) tracker(ns string) (*tracker, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if t, ok := c.trackers[ns]; ok {
+		return t, nil
+	}
+
+	t, err := newTracker(c.server, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	c.trackers[ns] = t
+	return t, nil
+}
+
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get("X-Consul-Token"); t != "" {
+		return t
+	}
+
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// prepare reads the key and namespace of a request and authorizes it, if
+// the request can't go ahead the error is written to the client
+func (c *ConsulAPI) prepare(w http.ResponseWriter, r *http.Request, op acl.Operation) (string, string, bool) {
+	key := mux.Vars(r)["key"]
+	ns := r.URL.Query().Get("ns")
+	if ns == "" {
+		ns = c.cfg.Namespace
+	}
+
+	if ns != db.DefaultNS {
+		if err := db.ValidateNamespace(ns); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return "", "", false
+		}
+	}
+
+	if !c.cfg.EnableACL {
+		return ns, key, true
+	}
+
+	err := c.server.Authorize(requestToken(r), c.cfg.AdminToken, ns, key, op)
+	switch err.(type) {
+	case nil:
+		return ns, key, true
+	case *server.DeniedError:
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	default:
+		if err == server.ErrNoToken || err == server.ErrUnknownToken {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return "", "", false
+}
+
+func flagsMimeType(flags uint64) string {
+	if flags == 0 {
+		return ""
+	}
+
+	return mime.FormatMediaType(flagsType, map[string]string{"flags": strconv.FormatUint(flags, 10)})
+}
+
+// flagsOf reads the flags back from the mime type of a value, values written
+// through the other APIs have none
+func flagsOf(mType string) uint64 {
+	_, params, err := mime.ParseMediaType(mType)
+	if err != nil {
+		return 0
+	}
+
+	flags, _ := strconv.ParseUint(params["flags"], 10, 64)
+	return flags
+}
+
+// wait reads the blocking query parameters
+func wait(r *http.Request) (uint64, time.Duration, error) {
+	q := r.URL.Query()
+	if q.Get("index") == "" {
+		return 0, 0, nil
+	}
+
+	index, err := strconv.ParseUint(q.Get("index"), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid index: %v", err)
+	}
+
+	timeout := defaultWait
+	if v := q.Get("wait"); v != "" {
+		// a plain number is seconds
+		if _, err := strconv.Atoi(v); err == nil {
+			v += "s"
+		}
+
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid wait: %v", err)
+		}
+	}
+
+	if timeout > maxWait {
+		timeout = maxWait
+	}
+
+	return index, timeout, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func setIndex(w http.ResponseWriter, index uint64) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+}
+
+// load returns the newest value of a key, Consul has no siblings
+func (c *ConsulAPI) load(ns, key string) (*crdt.TSValue, crdt.Payload, bool) {
+	dat, ok := c.server.LoadNS(ns, key)
+	if !ok || len(dat) == 0 {
+		return nil, nil, false
+	}
+
+	return dat.Newest(), dat, true
+}
+
+// Get reads a key, with ?recurse every key starting with it, and with ?keys
+// only the key names
+func (c *ConsulAPI) Get(w http.ResponseWriter, r *http.Request) {
+	ns, key, ok := c.prepare(w, r, acl.Read)
+	if !ok {
+		return
+	}
+
+	index, timeout, err := wait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := c.tracker(ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	_, recurse := q["recurse"]
+	_, keysOnly := q["keys"]
+	prefix := recurse || keysOnly
+
+	setIndex(w, t.Wait(r.Context(), key, prefix, index, timeout))
+
+	if !prefix {
+		v, _, ok := c.load(ns, key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if _, raw := q["raw"]; raw {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(v.Value)
+			return
+		}
+
+		mi := t.Index(key)
+		writeJSON(w, []*KVPair{{Key: key, Flags: flagsOf(v.MimeType), Value: v.Value, CreateIndex: mi, ModifyIndex: mi}})
+		return
+	}
+
+	keys, err := c.server.Keys(ns, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if keysOnly {
+		keys = group(keys, key, q.Get("separator"))
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, keys)
+		return
+	}
+
+	pairs := make([]*KVPair, 0, len(keys))
+	for _, k := range keys {
+		// the key may have been removed since it was listed
+		v, _, ok := c.load(ns, k)
+		if !ok {
+			continue
+		}
+
+		mi := t.Index(k)
+		pairs = append(pairs, &KVPair{Key: k, Flags: flagsOf(v.MimeType), Value: v.Value, CreateIndex: mi, ModifyIndex: mi})
+	}
+
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, pairs)
+}
+
+// group cuts the keys off after the first separator that follows the
+// prefix, like directories, keys must be sorted
+func group(keys []string, prefix, sep string) []string {
+	if sep == "" {
+		return keys
+	}
+
+	ret := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if i := strings.Index(k[len(prefix):], sep); i >= 0 {
+			k = k[:len(prefix)+i+len(sep)]
+		}
+
+		if len(ret) == 0 || ret[len(ret)-1] != k {
+			ret = append(ret, k)
+		}
+	}
+
+	return ret
+}
+
+// cas reads the ?cas parameter, 0 means the key must not exist
+func cas(r *http.Request) (uint64, bool, error) {
+	v := r.URL.Query().Get("cas")
+	if v == "" {
+		return 0, false, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid cas index: %v", err)
+	}
+
+	return n, true, nil
+}
+
+// Put writes a key, sessions (?acquire and ?release) are not supported
+func (c *ConsulAPI) Put(w http.ResponseWriter, r *http.Request) {
+	ns, key, ok := c.prepare(w, r, acl.Write)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("acquire") != "" || q.Get("release") != "" {
+		http.Error(w, "sessions are not supported", http.StatusBadRequest)
+		return
+	}
+
+	var flags uint64
+	if v := q.Get("flags"); v != "" {
+		var err error
+		if flags, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid flags: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	casIndex, withCas, err := cas(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueSize+1))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(value) > maxValueSize {
+		http.Error(w, fmt.Sprintf("value exceeds %d byte limit", maxValueSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	t, err := c.tracker(ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	_, cur, exists := c.load(ns, key)
+	if withCas && !matches(t, key, exists, casIndex) {
+		writeJSON(w, false)
+		return
+	}
+
+	// the write supersedes exactly what was checked, values that arrive from
+	// other nodes in the meantime are kept as siblings
+	var ctx crdt.VersionVector
+	if exists {
+		ctx = cur.Context()
+	}
+
+	if err := c.server.AddWithContext(ns, key, value, flagsMimeType(flags), ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t.record(key)
+	writeJSON(w, true)
+}
+
+// matches checks a check-and-set index against the key
+func matches(t *tracker, key string, exists bool, index uint64) bool {
+	if index == 0 {
+		return !exists
+	}
+
+	return exists && t.Index(key) == index
+}
+
+// Delete removes a key, with ?recurse every key starting with it, removing
+// every key of the namespace needs admin rights
+func (c *ConsulAPI) Delete(w http.ResponseWriter, r *http.Request) {
+	_, recurse := r.URL.Query()["recurse"]
+	op := acl.Delete
+	if recurse && mux.Vars(r)["key"] == "" {
+		op = acl.Admin
+	}
+
+	ns, key, ok := c.prepare(w, r, op)
+	if !ok {
+		return
+	}
+
+	t, err := c.tracker(ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if recurse {
+		if _, err := c.server.RemovePrefix(ns, key, server.ConcernLocal); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, true)
+		return
+	}
+
+	casIndex, withCas, err := cas(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	_, _, exists := c.load(ns, key)
+	if withCas && !matches(t, key, exists, casIndex) {
+		writeJSON(w, false)
+		return
+	}
+
+	if exists {
+		if err := c.server.RemoveNS(ns, key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.record(key)
+	}
+
+	writeJSON(w, true)
+}
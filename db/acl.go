@@ -0,0 +1,85 @@
+package db
+
+import (
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/types/crdt"
+)
+
+// ACLS holds one LWW register per principal, keyed by token hash
+const ACLS = "acls"
+
+// PutACL stores an ACL if it is newer than the one we have, an empty value
+// is a tombstone for a deleted principal
+func (d *DB) PutACL(id string, value *crdt.TSValue) error {
+	enc, err := Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return d.Store.Batch(func(b Batch) error {
+		ex, err := b.Get(ACLS, []byte(id))
+		if err != nil {
+			return err
+		}
+
+		if ex != nil {
+			current := &crdt.TSValue{}
+			if err := Decode(ex, current); err != nil {
+				return err
+			}
+
+			if current.TS >= value.TS {
+				return nil
+			}
+		}
+
+		return b.Put(ACLS, []byte(id), enc)
+	})
+}
+
+func decodeACL(v []byte) (*acl.ACL, error) {
+	tsv := &crdt.TSValue{}
+	if err := Decode(v, tsv); err != nil {
+		return nil, err
+	}
+
+	if len(tsv.Value) == 0 {
+		return nil, nil
+	}
+
+	a := &acl.ACL{}
+	if err := Decode(tsv.Value, a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ACL returns the ACL for a token hash, or nil if there is none
+func (d *DB) ACL(id string) (*acl.ACL, error) {
+	v, err := d.Store.Get(ACLS, []byte(id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	return decodeACL(v)
+}
+
+// ACLs lists all live ACLs
+func (d *DB) ACLs() ([]*acl.ACL, error) {
+	acls := make([]*acl.ACL, 0)
+	err := d.Store.Iterate(ACLS, []byte{}, func(k, v []byte) error {
+		a, err := decodeACL(v)
+		if err != nil {
+			return err
+		}
+
+		if a != nil {
+			acls = append(acls, a)
+		}
+
+		return nil
+	})
+
+	return acls, err
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"time"
+)
+
+// APPLIED holds the IDs of the ops that have been applied, so ops that arrive
+// more than once (gossip retransmits, queue retries, oplog replays on join)
+// are only applied once
+const APPLIED = "applied"
+
+func (d *DB) Applied(id string) (bool, error) {
+	v, err := d.Store.Get(APPLIED, []byte(id))
+	return v != nil, err
+}
+
+func (d *DB) MarkApplied(id string) error {
+	enc, err := Encode(time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return d.Store.Put(APPLIED, []byte(id), enc)
+}
+
+// PruneApplied forgets ops applied before a point in time, it returns the
+// number of IDs removed
+func (d *DB) PruneApplied(before time.Time) (int, error) {
+	cutoff := before.UnixNano()
+	pruned := 0
+	err := d.Store.Batch(func(b Batch) error {
+		old := make([][]byte, 0)
+		err := b.Iterate(APPLIED, nil, func(k, v []byte) error {
+			var at int64
+			if err := Decode(v, &at); err != nil {
+				return err
+			}
+
+			if at < cutoff {
+				old = append(old, append([]byte{}, k...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			if err := b.Delete(APPLIED, k); err != nil {
+				return err
+			}
+		}
+
+		pruned = len(old)
+		return nil
+	})
+
+	return pruned, err
+}
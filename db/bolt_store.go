@@ -0,0 +1,161 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// BoltStore is a Store backed by a bbolt file
+type BoltStore struct {
+	Db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{Db: db}, nil
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) bucket(name string) (*bolt.Bucket, error) {
+	b := t.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, fmt.Errorf("bucket %s does not exist", name)
+	}
+
+	return b, nil
+}
+
+func (t *boltTx) Get(bucket string, key []byte) ([]byte, error) {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+
+	// bolt values are only valid for the life of the transaction
+	cp := make([]byte, len(v))
+	copy(cp, v)
+	return cp, nil
+}
+
+func (t *boltTx) Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *boltTx) Put(bucket string, key, value []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, value)
+}
+
+func (t *boltTx) Delete(bucket string, key []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	return b.Delete(key)
+}
+
+func (t *boltTx) CreateBucket(bucket string) error {
+	_, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("create %s bucket: %s", bucket, err)
+	}
+
+	return nil
+}
+
+func (t *boltTx) DeleteBucket(bucket string) error {
+	err := t.tx.DeleteBucket([]byte(bucket))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("delete %s bucket: %s", bucket, err)
+	}
+
+	return nil
+}
+
+func (s *BoltStore) Get(bucket string, key []byte) ([]byte, error) {
+	var v []byte
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = (&boltTx{tx}).Get(bucket, key)
+		return err
+	})
+
+	return v, err
+}
+
+func (s *BoltStore) Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	return s.Db.View(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).Iterate(bucket, prefix, fn)
+	})
+}
+
+func (s *BoltStore) Put(bucket string, key, value []byte) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).Put(bucket, key, value)
+	})
+}
+
+func (s *BoltStore) Delete(bucket string, key []byte) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).Delete(bucket, key)
+	})
+}
+
+func (s *BoltStore) Batch(fn func(b Batch) error) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (s *BoltStore) Snapshot(fn func(r Reader) error) error {
+	return s.Db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (s *BoltStore) CreateBucket(bucket string) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).CreateBucket(bucket)
+	})
+}
+
+func (s *BoltStore) DeleteBucket(bucket string) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).DeleteBucket(bucket)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.Db.Close()
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+	"sort"
+)
+
+var (
+	clockKey      = []byte("clock")
+	contiguousKey = []byte("contiguous")
+)
+
+// ops applied past a gap that are tracked per origin, once there are more the
+// gap is given up on
+const maxAhead = 100000
+
+// contiguous tracks, for every origin, the sequence number up to which every
+// op has been applied, and the ops that were applied past the first gap
+type contiguous struct {
+	Upto  crdt.VersionVector
+	Ahead map[string][]uint64
+}
+
+// Clock returns the highest sequence number applied from every origin, ops
+// that arrived out of order may leave gaps below it
+func (d *DB) Clock() (crdt.VersionVector, error) {
+	var vv crdt.VersionVector
+	err := d.Store.Snapshot(func(r Reader) error {
+		var err error
+		vv, err = readClock(r)
+		return err
+	})
+
+	return vv, err
+}
+
+func readClock(r Reader) (crdt.VersionVector, error) {
+	vv := crdt.VersionVector{}
+	v, err := r.Get(META, clockKey)
+	if err != nil || v == nil {
+		return vv, err
+	}
+
+	err = Decode(v, &vv)
+	return vv, err
+}
+
+func putClock(b Batch, vv crdt.VersionVector) error {
+	enc, err := Encode(vv)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(META, clockKey, enc)
+}
+
+// Contiguous returns the sequence number up to which every op from every
+// origin has been applied, unlike the clock it never moves past a missing op
+func (d *DB) Contiguous() (crdt.VersionVector, error) {
+	var vv crdt.VersionVector
+	err := d.Store.Snapshot(func(r Reader) error {
+		c, err := readContiguous(r)
+		if err != nil {
+			return err
+		}
+
+		vv = c.Upto
+		return nil
+	})
+
+	return vv, err
+}
+
+func readContiguous(r Reader) (*contiguous, error) {
+	c := &contiguous{}
+	v, err := r.Get(META, contiguousKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		// DBs from before it was tracked had no gaps we know of
+		c.Upto, err = readClock(r)
+	} else {
+		err = Decode(v, c)
+	}
+
+	if c.Upto == nil {
+		c.Upto = crdt.VersionVector{}
+	}
+
+	if c.Ahead == nil {
+		c.Ahead = map[string][]uint64{}
+	}
+
+	return c, err
+}
+
+func putContiguous(b Batch, c *contiguous) error {
+	enc, err := Encode(c)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(META, contiguousKey, enc)
+}
+
+// add records that the op with seq from origin has been applied
+func (c *contiguous) add(origin string, seq uint64) {
+	if seq <= c.Upto[origin] {
+		return
+	}
+
+	ahead := c.Ahead[origin]
+	i := sort.Search(len(ahead), func(i int) bool { return ahead[i] >= seq })
+	if i < len(ahead) && ahead[i] == seq {
+		return
+	}
+
+	ahead = append(ahead, 0)
+	copy(ahead[i+1:], ahead[i:])
+	ahead[i] = seq
+
+	if len(ahead) > maxAhead {
+		log.Warn("giving up on ops ", c.Upto[origin]+1, " to ", ahead[0]-1, " from ", origin)
+		c.Upto[origin] = ahead[0] - 1
+	}
+
+	// move up to the next gap
+	n := 0
+	for n < len(ahead) && ahead[n] == c.Upto[origin]+1 {
+		c.Upto[origin]++
+		n++
+	}
+
+	c.Ahead[origin] = ahead[n:]
+	if len(c.Ahead[origin]) == 0 {
+		delete(c.Ahead, origin)
+	}
+}
+
+// advance records an applied op in both clocks
+func advance(b Batch, origin string, seq uint64) error {
+	vv, err := readClock(b)
+	if err != nil {
+		return err
+	}
+
+	c, err := readContiguous(b)
+	if err != nil {
+		return err
+	}
+
+	c.add(origin, seq)
+	if err := putContiguous(b, c); err != nil {
+		return err
+	}
+
+	if vv[origin] >= seq {
+		return nil
+	}
+
+	vv[origin] = seq
+	return putClock(b, vv)
+}
+
+// Advance records that the op with seq from origin has been applied
+func (d *DB) Advance(origin string, seq uint64) error {
+	return d.Store.Batch(func(b Batch) error {
+		return advance(b, origin, seq)
+	})
+}
+
+// NextSeq takes the next sequence number of this node, it also returns what
+// has been applied from every node so far, which a new op depends on
+func (d *DB) NextSeq() (string, uint64, crdt.VersionVector, error) {
+	node, err := d.NodeID()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	var seq uint64
+	var deps crdt.VersionVector
+	err = d.Store.Batch(func(b Batch) error {
+		vv, err := readClock(b)
+		if err != nil {
+			return err
+		}
+
+		deps = vv.Copy()
+		seq = vv[node] + 1
+		return advance(b, node, seq)
+	})
+
+	return node, seq, deps, err
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+)
+
+// COUNTERS holds one entry per node for every PN-counter
+const COUNTERS = "counters"
+
+func counterKey(key, node string) []byte {
+	return []byte(key + "\x00" + node)
+}
+
+func counterPrefix(key string) []byte {
+	return []byte(key + "\x00")
+}
+
+func getCounterState(r Reader, key, node string) (*crdt.CounterState, error) {
+	state := &crdt.CounterState{Node: node}
+	v, err := r.Get(COUNTERS, counterKey(key, node))
+	if err != nil || v == nil {
+		return state, err
+	}
+
+	err = Decode(v, state)
+	return state, err
+}
+
+func putCounterState(b Batch, key string, state *crdt.CounterState) error {
+	enc, err := Encode(state)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(COUNTERS, counterKey(key, state.Node), enc)
+}
+
+// IncrCounter changes a counter on behalf of this node and returns the new
+// state of this node, which is what gets replicated
+func (d *DB) IncrCounter(key string, by int64) (*crdt.CounterState, error) {
+	node, err := d.NodeID()
+	if err != nil {
+		return nil, err
+	}
+
+	var state *crdt.CounterState
+	err = d.Store.Batch(func(b Batch) error {
+		current, err := getCounterState(b, key, node)
+		if err != nil {
+			return err
+		}
+
+		c := crdt.NewPNCounter()
+		c.Merge(current)
+		state = c.Incr(node, by)
+
+		return putCounterState(b, key, state)
+	})
+
+	return state, err
+}
+
+// MergeCounter applies the replicated state of a remote node
+func (d *DB) MergeCounter(key string, state *crdt.CounterState) error {
+	return d.Store.Batch(func(b Batch) error {
+		current, err := getCounterState(b, key, state.Node)
+		if err != nil {
+			return err
+		}
+
+		c := crdt.NewPNCounter()
+		c.Merge(current)
+		c.Merge(state)
+
+		return putCounterState(b, key, c.State(state.Node))
+	})
+}
+
+// Counter returns the value of a counter, the bool is false if it has never
+// been changed
+func (d *DB) Counter(key string) (int64, bool) {
+	c := crdt.NewPNCounter()
+	found := false
+	err := d.Store.Iterate(COUNTERS, counterPrefix(key), func(k, v []byte) error {
+		state := &crdt.CounterState{}
+		if err := Decode(v, state); err != nil {
+			return err
+		}
+
+		c.Merge(state)
+		found = true
+		return nil
+	})
+
+	if err != nil {
+		log.Error("failed to load counter: ", err)
+		return 0, false
+	}
+
+	return c.Value(), found
+}
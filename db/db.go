@@ -1,32 +1,38 @@
 package db
 
 import (
-	"bytes"
-	"fmt"
+	"github.com/lonelycode/yzma/compression"
 	"github.com/lonelycode/yzma/types/crdt"
-	bolt "go.etcd.io/bbolt"
 	"gopkg.in/vmihailenco/msgpack.v2"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DB struct {
-	Db       *bolt.DB
+	Store    Store
 	IDSource crdt.ObserveGUIDer
 	Options  struct {
 		CollisionStrategy string
+		Overrides         []StrategyOverride
+		Compression       string // compresses values at rest, see the compression package
 	}
+	namespaces *sync.Map
+	nodeID     *atomic.Value
+	inTx       bool // bound to a Batch, caches are only filled once committed
 }
 
 const (
-	KEYS = "keys"
-	OPS  = "ops"
+	KEYS       = "keys"
+	OPS        = "ops"
+	NAMESPACES = "namespaces"
 )
 
 var ReadyDBs = sync.Map{}
 
+// New opens (or returns the already open) bolt backed DB for file
 func New(file string) (*DB, error) {
 	ex, ok := ReadyDBs.Load(file)
 	if ok {
@@ -39,61 +45,80 @@ func New(file string) (*DB, error) {
 		return nil, err
 	}
 
-	db.IDSource = &crdt.UniqueIDGUIDer{}
-
 	ReadyDBs.Store(file, db)
 	return db, nil
 }
 
+// NewWithStore creates a DB on top of an already open storage engine
+func NewWithStore(store Store) (*DB, error) {
+	db := &DB{}
+	err := db.InitStore(store)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
 func (d *DB) Init(path string) error {
-	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	store, err := NewBoltStore(path)
 	if err != nil {
 		return err
 	}
 
-	d.Db = db
+	return d.InitStore(store)
+}
 
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(KEYS))
-		if err != nil {
-			return fmt.Errorf("create addMap bucket: %s", err)
-		}
+func (d *DB) InitStore(store Store) error {
+	d.Store = store
+	d.IDSource = &crdt.UniqueIDGUIDer{}
+	d.namespaces = &sync.Map{}
+	d.nodeID = &atomic.Value{}
 
-		_, err = tx.CreateBucketIfNotExists([]byte(OPS))
-		if err != nil {
-			return fmt.Errorf("create oplog bucket: %s", err)
+	for _, b := range []string{KEYS, OPS, NAMESPACES, ACLS, META, COUNTERS, SETS, DOCS, OUTBOX, APPLIED} {
+		if err := store.CreateBucket(b); err != nil {
+			return err
 		}
+	}
 
-		return nil
-	})
+	return d.migrateKeys()
+}
 
-	return nil
+// Batch runs fn against a DB bound to a single store transaction, so a group
+// of writes is applied atomically and with a single commit
+func (d *DB) Batch(fn func(tx *DB) error) error {
+	return d.Store.Batch(func(b Batch) error {
+		return fn(&DB{
+			Store:      &txStore{b},
+			IDSource:   d.IDSource,
+			Options:    d.Options,
+			namespaces: d.namespaces,
+			nodeID:     d.nodeID,
+			inTx:       true,
+		})
+	})
 }
 
 func (d *DB) Close() {
-	d.Db.Close()
+	d.Store.Close()
 }
 
 func (d *DB) AddOp(keyID string, value *crdt.TSValue) error {
-	enc, err := Encode(value)
+	return d.AddOpNS(DefaultNS, keyID, value)
+}
+
+func (d *DB) AddOpNS(ns string, keyID string, value *crdt.TSValue) error {
+	enc, err := d.encodeValue(value)
 	if err != nil {
 		return err
 	}
 
-	err = d.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(KEYS))
-		if err := b.Put([]byte(keyID), enc); err != nil {
-			return err
-		}
-
-		return nil
-	})
-
-	if err != nil {
+	// replicas may see writes before the namespace was created
+	if err := d.ensureNamespace(ns); err != nil {
 		return err
 	}
 
-	return nil
+	return d.Store.Put(bucketFor(ns), []byte(upgradeKID(keyID)), enc)
 }
 
 func (d *DB) StoreOpLog(id string, value interface{}) error {
@@ -102,184 +127,404 @@ func (d *DB) StoreOpLog(id string, value interface{}) error {
 		return err
 	}
 
-	err = d.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(OPS))
-		if err := b.Put([]byte(id), enc); err != nil {
-			return err
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return d.Store.Put(OPS, []byte(id), enc)
 }
 
 func (d *DB) Add(key string, value []byte, mType string) error {
+	return d.AddNS(DefaultNS, key, value, mType)
+}
+
+func (d *DB) AddNS(ns string, key string, value []byte, mType string) error {
 	vId := d.IDSource.ValueID(value)
 
 	tsv := &crdt.TSValue{TS: time.Now().UnixNano(), Value: value, MimeType: mType}
-	addKey := fmt.Sprintf("add.%s.%s", key, vId)
+	addKey := entryKey(addEntry, key, vId)
 
-	enc, err := Encode(tsv)
+	enc, err := d.encodeValue(tsv)
 	if err != nil {
 		return err
 	}
 
-	err = d.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(KEYS))
-		b.Put([]byte(addKey), enc)
-		return nil
-	})
-
-	if err != nil {
+	if err := d.ensureNamespace(ns); err != nil {
 		return err
 	}
 
-	return nil
+	return d.Store.Put(bucketFor(ns), addKey, enc)
 }
 
 func (d *DB) Remove(key string) error {
+	return d.RemoveNS(DefaultNS, key)
+}
+
+func (d *DB) RemoveNS(ns string, key string) error {
+	// replicas may see removes before the namespace was created
+	if err := d.ensureNamespace(ns); err != nil {
+		return err
+	}
+
+	bucket := bucketFor(ns)
 	// we must copy IDs over for anything already added
-	rmMap := map[string]*crdt.TSValue{}
-	d.Db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(KEYS)).Cursor()
-		addPrefix := []byte(fmt.Sprintf("add.%s", key))
-		for k, _ := c.Seek(addPrefix); k != nil && bytes.HasPrefix(k, addPrefix); k, _ = c.Next() {
-			rmMap[string(k)] = &crdt.TSValue{}
+	return d.Store.Batch(func(b Batch) error {
+		rmKeys := make([][]byte, 0)
+		addPrefix := entryPrefix(addEntry, key)
+		err := b.Iterate(bucket, addPrefix, func(k, _ []byte) error {
+			rmKeys = append(rmKeys, entryKey(remEntry, key, string(k[len(addPrefix):])))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range rmKeys {
+			if err := b.Put(bucket, k, []byte{}); err != nil {
+				return err
+			}
 		}
 
 		return nil
 	})
+}
 
-	err := d.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(KEYS))
-
-		for k := range rmMap {
-			remKey := strings.Replace(k, "add.", "rem.", 1)
-			b.Put([]byte(remKey), []byte{})
+// Observed returns the IDs of the values of a key that have not been removed,
+// expired values included so a remove tombstones them too
+func (d *DB) Observed(ns string, key string) ([]string, error) {
+	ids := make([]string, 0)
+	err := d.Store.Snapshot(func(r Reader) error {
+		added, err := d.unremoved(r, ns, key)
+		for id := range added {
+			ids = append(ids, id)
 		}
-		return nil
+		return err
 	})
 
-	if err != nil {
+	sort.Strings(ids)
+	return ids, err
+}
+
+// RemoveObservedNS removes the values of a key with the given IDs, values
+// added concurrently elsewhere are kept, and replaying the remove is harmless
+func (d *DB) RemoveObservedNS(ns string, key string, ids []string) error {
+	if err := d.ensureNamespace(ns); err != nil {
 		return err
 	}
 
-	return nil
+	bucket := bucketFor(ns)
+	return d.Store.Batch(func(b Batch) error {
+		for _, id := range ids {
+			if err := b.Put(bucket, entryKey(remEntry, key, id), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
-func (d *DB) Load(key string) (crdt.Payload, bool) {
-	addPrefix := []byte(fmt.Sprintf("add.%s", key))
-	var retPL crdt.Payload
-	var found bool
-	d.Db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(KEYS)).Cursor()
-
-		addMap := map[string]*crdt.TSValue{}
-		for k, v := c.Seek(addPrefix); k != nil && bytes.HasPrefix(k, addPrefix); k, v = c.Next() {
-			tsv := &crdt.TSValue{}
-			if err := Decode(v, tsv); err != nil {
+// ObservedPrefix returns the IDs of the values of every key starting with
+// prefix that have not been removed, expired ones included
+func (d *DB) ObservedPrefix(ns string, prefix string) (map[string][]string, error) {
+	bucket := bucketFor(ns)
+	observed := map[string][]string{}
+	err := d.Store.Snapshot(func(r Reader) error {
+		removed := map[string]bool{}
+		err := r.Iterate(bucket, rangePrefix(remEntry, prefix), func(k, _ []byte) error {
+			removed[string(k[1:])] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return r.Iterate(bucket, rangePrefix(addEntry, prefix), func(k, _ []byte) error {
+			if removed[string(k[1:])] {
+				return nil
+			}
+
+			_, key, uid, err := parseEntry(k)
+			if err != nil {
 				return err
 			}
 
-			addMap[d.GetUIDFromKey(string(k))] = tsv
+			observed[key] = append(observed[key], uid)
+			return nil
+		})
+	})
+
+	return observed, err
+}
+
+// Keys returns the keys starting with prefix that have a live value, in order
+func (d *DB) Keys(ns string, prefix string) ([]string, error) {
+	bucket := bucketFor(ns)
+	live := map[string]bool{}
+	err := d.Store.Snapshot(func(r Reader) error {
+		removed := map[string]bool{}
+		err := r.Iterate(bucket, rangePrefix(remEntry, prefix), func(k, _ []byte) error {
+			removed[string(k[1:])] = true
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		// Never added, so not found
-		if len(addMap) == 0 {
-			found = false
+		now := time.Now().UnixNano()
+		return r.Iterate(bucket, rangePrefix(addEntry, prefix), func(k, v []byte) error {
+			if removed[string(k[1:])] {
+				return nil
+			}
+
+			_, key, _, err := parseEntry(k)
+			if err != nil || live[key] {
+				return err
+			}
+
+			tsv := &crdt.TSValue{}
+			if err := decodeValue(v, tsv); err != nil {
+				return err
+			}
+
+			if !tsv.Expired(now) {
+				live[key] = true
+			}
 			return nil
+		})
+	})
+
+	keys := make([]string, 0, len(live))
+	for k := range live {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys, err
+}
+
+// RemoveObservedKeys removes the values of every key with the given IDs, as
+// returned by ObservedPrefix
+func (d *DB) RemoveObservedKeys(ns string, observed map[string][]string) error {
+	for key, ids := range observed {
+		if err := d.RemoveObservedNS(ns, key, ids); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+func (d *DB) Load(key string) (crdt.Payload, bool) {
+	return d.LoadNS(DefaultNS, key)
+}
+
+func (d *DB) LoadNS(ns string, key string) (crdt.Payload, bool) {
+	var live crdt.Payload
+	d.Store.Snapshot(func(r Reader) error {
+		var err error
+		_, live, err = d.values(r, ns, key)
+		return err
+	})
 
-		remPrefix := []byte(fmt.Sprintf("rem.%s", key))
-		rmMap := map[string]*crdt.TSValue{}
-		for k, _ := c.Seek(remPrefix); k != nil && bytes.HasPrefix(k, remPrefix); k, _ = c.Next() {
-			rmMap[d.GetUIDFromKey(string(k))] = &crdt.TSValue{}
+	if len(live) == 0 {
+		return nil, false
+	}
+
+	return d.HandleCollisionFor(key, live), true
+}
+
+// unremoved returns the values of a key that have not been removed, whether
+// they have expired or not
+func (d *DB) unremoved(r Reader, ns string, key string) (crdt.Payload, error) {
+	added, _, err := d.values(r, ns, key)
+	if err != nil || len(added) == 0 {
+		return added, err
+	}
+
+	remPrefix := entryPrefix(remEntry, key)
+	err = r.Iterate(bucketFor(ns), remPrefix, func(k, _ []byte) error {
+		delete(added, string(k[len(remPrefix):]))
+		return nil
+	})
+
+	return added, err
+}
+
+// values reads every value ever added to a key, and the ones that have not
+// been removed or expired since
+func (d *DB) values(r Reader, ns string, key string) (crdt.Payload, crdt.Payload, error) {
+	bucket := bucketFor(ns)
+	addPrefix := entryPrefix(addEntry, key)
+	addMap := crdt.Payload{}
+	err := r.Iterate(bucket, addPrefix, func(k, v []byte) error {
+		tsv := &crdt.TSValue{}
+		if err := decodeValue(v, tsv); err != nil {
+			return err
 		}
 
-		// never removed, so found
-		if len(rmMap) == 0 {
-			found = true
-			retPL = addMap
-			return nil
+		addMap[string(k[len(addPrefix):])] = tsv
+		return nil
+	})
+
+	// Never added, so not found
+	if err != nil || len(addMap) == 0 {
+		return addMap, nil, err
+	}
+
+	remPrefix := entryPrefix(remEntry, key)
+	rmMap := map[string]*crdt.TSValue{}
+	err = r.Iterate(bucket, remPrefix, func(k, _ []byte) error {
+		rmMap[string(k[len(remPrefix):])] = &crdt.TSValue{}
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// It has been added, and it may have been removed or expired since
+	now := time.Now().UnixNano()
+	live := crdt.Payload{}
+	for uid, v := range addMap {
+		if _, ok := rmMap[uid]; !ok && !v.Expired(now) {
+			live[uid] = v
 		}
+	}
 
-		// It has been added, and it has been removed at some point
-		retPL = crdt.Payload{}
-		for id, v := range addMap {
-			uid := d.GetUIDFromKey(id)
-			if _, ok := rmMap[uid]; !ok {
-				retPL[uid] = v
-			}
+	return addMap, live, nil
+}
+
+// NextVersion returns the version vector of a new write to key by node. A
+// write carrying the client's read context supersedes what the client saw,
+// without one it supersedes everything this node has seen.
+func (d *DB) NextVersion(ns string, key string, node string, ctx crdt.VersionVector) (crdt.VersionVector, error) {
+	var vv crdt.VersionVector
+	err := d.Store.Snapshot(func(r Reader) error {
+		added, live, err := d.values(r, ns, key)
+		if err != nil {
+			// nothing written yet, e.g. the namespace doesn't exist
+			added, live = crdt.Payload{}, crdt.Payload{}
 		}
 
-		if len(retPL) == 0 {
-			found = false
-			return nil
+		if ctx != nil {
+			vv = ctx.Copy()
+		} else {
+			vv = live.Context()
+		}
+
+		// our counter must move past everything we have written before
+		vv[node] = added.Context()[node] + 1
+		if ctx[node] >= vv[node] {
+			vv[node] = ctx[node] + 1
 		}
 
-		found = true
 		return nil
 	})
 
-	if len(retPL) == 0 {
-		return nil, false
+	return vv, err
+}
+
+// GetUIDFromKey returns the unique ID of a value from its storage key
+func (d *DB) GetUIDFromKey(k string) string {
+	if _, _, uid, err := parseEntry([]byte(k)); err == nil {
+		return uid
 	}
 
-	return d.HandleCollision(retPL), found
+	if _, _, uid, ok := legacyEntry(k); ok {
+		return uid
+	}
+
+	return k
 }
 
-func (d *DB) GetUIDFromKey(k string) string {
-	pts := strings.Split(k, ".")
-	if len(pts) != 3 {
-		return k
+// StrategyOverride sets the collision strategy of every key with a prefix
+type StrategyOverride struct {
+	Prefix   string
+	Strategy string
+}
+
+// StrategyFor returns the collision strategy of a key, the longest matching
+// prefix override wins over the default strategy
+func (d *DB) StrategyFor(key string) string {
+	strat := d.Options.CollisionStrategy
+	matched := -1
+	for _, o := range d.Options.Overrides {
+		if strings.HasPrefix(key, o.Prefix) && len(o.Prefix) > matched {
+			strat, matched = o.Strategy, len(o.Prefix)
+		}
 	}
-	uid := pts[2]
 
-	return uid
+	return strat
 }
 
 func (d *DB) HandleCollision(values crdt.Payload) crdt.Payload {
-	if d.Options.CollisionStrategy == crdt.LWWStrat {
-		times := make([]int, len(values))
-		i := 0
-		for _, v := range values {
-			tsv := v
-			times[i] = int(tsv.TS)
-			i++
-		}
+	return d.resolve(d.Options.CollisionStrategy, values)
+}
 
-		sort.Ints(times)
-		last := times[len(times)-1]
-		for id, v := range values {
-			tsv := v
-			if int(tsv.TS) == last {
-				ret := map[string]*crdt.TSValue{id: v}
-				return ret
-			}
-		}
+func (d *DB) HandleCollisionFor(key string, values crdt.Payload) crdt.Payload {
+	return d.resolve(d.StrategyFor(key), values)
+}
+
+func (d *DB) resolve(strat string, values crdt.Payload) crdt.Payload {
+	r, ok := crdt.GetResolver(strat)
+	if !ok {
+		log.Error("unknown collision strategy ", strat, ", returning all values")
+		return values
 	}
 
-	return values
+	return r(values)
 }
 
 func (d *DB) OpLog(from string) [][]byte {
 	ops := make([][]byte, 0)
-	d.Db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(OPS)).Cursor()
-		pfx := []byte(from)
-		for k, v := c.Seek(pfx); k != nil && bytes.HasPrefix(k, pfx); k, v = c.Next() {
-			ops = append(ops, v)
+	d.Store.Iterate(OPS, []byte(from), func(k, v []byte) error {
+		cp := make([]byte, len(v))
+		copy(cp, v)
+		ops = append(ops, cp)
+		return nil
+	})
+
+	return ops
+}
+
+// Ops returns the stored ops with the given IDs, unknown IDs are skipped
+func (d *DB) Ops(ids []string) ([][]byte, error) {
+	ops := make([][]byte, 0)
+	err := d.Store.Snapshot(func(r Reader) error {
+		for _, id := range ids {
+			v, err := r.Get(OPS, []byte(id))
+			if err != nil {
+				return err
+			}
+
+			if v != nil {
+				ops = append(ops, v)
+			}
 		}
 
 		return nil
 	})
 
-	return ops
+	return ops, err
+}
+
+// encodeValue encodes a value for the keys buckets, compressed if enabled
+func (d *DB) encodeValue(value *crdt.TSValue) ([]byte, error) {
+	enc, err := Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return compression.Encode(d.Options.Compression, enc), nil
+}
+
+// decodeValue reads values whether they were compressed or not, so the
+// setting can be changed on an existing DB
+func decodeValue(v []byte, into *crdt.TSValue) error {
+	dec, err := compression.Decode(v)
+	if err != nil {
+		return err
+	}
+
+	return Decode(dec, into)
 }
 
 func Decode(value []byte, into interface{}) error {
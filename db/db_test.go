@@ -1,10 +1,17 @@
 package db
 
 import (
+	"bytes"
+	"errors"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/compression"
 	"github.com/lonelycode/yzma/types/crdt"
 	"github.com/satori/go.uuid"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func NewORSet() (*DB, string) {
@@ -96,3 +103,473 @@ func TestORSetAddAddRemoveContains(t *testing.T) {
 		t.Errorf("Expected set to not contain: %v, but found", testValue)
 	}
 }
+
+func TestORSetMemStore(t *testing.T) {
+	orSet, err := NewWithStore(NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orSet.Options.CollisionStrategy = crdt.LWWStrat
+
+	var testValue = "object"
+
+	orSet.Add(testValue, []byte("foo"), "")
+	orSet.Remove(testValue)
+	orSet.Add(testValue, []byte("bar"), "")
+
+	v, ok := orSet.Load(testValue)
+	if !ok {
+		t.Fatalf("Expected set to contain: %v, but not found", testValue)
+	}
+
+	d, _ := v.Extract()
+	if string(d.([]byte)) != "bar" {
+		t.Errorf("Expected bar, got %s", d)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	d, n := NewORSet()
+	defer teardown(d, n)
+
+	d.Add("object", []byte("default"), "")
+	d.AddNS("tenant-a", "object", []byte("a"), "")
+
+	v, ok := d.LoadNS("tenant-a", "object")
+	if !ok {
+		t.Fatal("Expected tenant-a to contain object")
+	}
+	if dat, _ := v.Extract(); string(dat.([]byte)) != "a" {
+		t.Errorf("Expected a, got %s", dat)
+	}
+
+	if _, ok := d.LoadNS("tenant-b", "object"); ok {
+		t.Error("Expected tenant-b to not contain object")
+	}
+
+	d.RemoveNS("tenant-a", "object")
+	if _, ok := d.Load("object"); !ok {
+		t.Error("Expected remove in tenant-a to leave the default namespace alone")
+	}
+
+	names, _ := d.Namespaces()
+	if len(names) != 1 || names[0] != "tenant-a" {
+		t.Errorf("Expected [tenant-a], got %v", names)
+	}
+
+	if err := d.DropNamespace("tenant-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ = d.Namespaces()
+	if len(names) != 0 {
+		t.Errorf("Expected no namespaces after drop, got %v", names)
+	}
+
+	// writes after a drop recreate the namespace
+	if err := d.AddNS("tenant-a", "object", []byte("b"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.LoadNS("tenant-a", "object"); !ok {
+		t.Error("Expected a write after the drop to be stored")
+	}
+
+	// removes may arrive before the namespace was created
+	if err := d.RemoveNS("tenant-b", "object"); err != nil {
+		t.Fatalf("Expected a remove in a new namespace to succeed, got %v", err)
+	}
+}
+
+func TestACLLastWriteWins(t *testing.T) {
+	d, n := NewORSet()
+	defer teardown(d, n)
+
+	newer, _ := Encode(&acl.ACL{Principal: "svc", TokenHash: "h", Rules: []acl.Rule{
+		{Namespace: acl.AnyNamespace, Prefix: "cache/", Ops: []acl.Operation{acl.Read}},
+	}})
+	older, _ := Encode(&acl.ACL{Principal: "svc", TokenHash: "h"})
+
+	d.PutACL("h", &crdt.TSValue{TS: 2, Value: newer})
+	d.PutACL("h", &crdt.TSValue{TS: 1, Value: older})
+
+	a, err := d.ACL("h")
+	if err != nil || a == nil {
+		t.Fatalf("Expected ACL for h, got %v (%v)", a, err)
+	}
+
+	if !a.Allowed("", "cache/foo", acl.Read) {
+		t.Error("Expected read on cache/foo to be allowed")
+	}
+
+	if a.Allowed("", "cache/foo", acl.Write) || a.Allowed("", "orders/1", acl.Read) {
+		t.Error("Expected ACL to only allow reads under cache/")
+	}
+
+	// deletes are tombstones and win if they are newer
+	d.PutACL("h", &crdt.TSValue{TS: 3})
+	if a, _ := d.ACL("h"); a != nil {
+		t.Error("Expected ACL to be deleted")
+	}
+}
+
+func TestSetConcurrentAddWins(t *testing.T) {
+	d, n := NewORSet()
+	defer teardown(d, n)
+
+	d.SetAdd("tags", "red", "t1")
+	d.SetAdd("tags", "blue", "t2")
+
+	// node A observes red and removes it while node B adds red again
+	observed, _ := d.SetTags("tags", "red")
+	d.SetAdd("tags", "red", "t3")
+	d.SetRemove("tags", "red", observed)
+
+	members, ok := d.SetMembers("tags")
+	if !ok || len(members) != 2 || members[0] != "blue" || members[1] != "red" {
+		t.Errorf("Expected concurrent add of red to survive, got %v", members)
+	}
+
+	observed, _ = d.SetTags("tags", "red")
+	d.SetRemove("tags", "red", observed)
+
+	members, _ = d.SetMembers("tags")
+	if len(members) != 1 || members[0] != "blue" {
+		t.Errorf("Expected only blue, got %v", members)
+	}
+}
+
+func TestDocConcurrentFieldPatches(t *testing.T) {
+	a, _ := crdt.FromMergePatch([]byte(`{"name": "kronk", "address": {"city": "yzma"}}`), 1, "a")
+	b, _ := crdt.FromMergePatch([]byte(`{"address": {"zip": "1234"}, "name": "pacha"}`), 2, "b")
+	c, _ := crdt.FromMergePatch([]byte(`{"address": {"city": null}}`), 3, "a")
+
+	d1, _ := NewWithStore(NewMemStore())
+	d2, _ := NewWithStore(NewMemStore())
+
+	for _, p := range []crdt.ORMap{a, b, c} {
+		d1.PatchDoc("doc", p)
+	}
+	for _, p := range []crdt.ORMap{c, b, a} {
+		d2.PatchDoc("doc", p)
+	}
+
+	doc1, ok := d1.Doc("doc")
+	if !ok {
+		t.Fatal("Expected document to exist")
+	}
+
+	doc2, _ := d2.Doc("doc")
+	if !reflect.DeepEqual(doc1, doc2) {
+		t.Errorf("Expected documents to converge, got %v and %v", doc1, doc2)
+	}
+
+	expected := map[string]interface{}{
+		"name":    "pacha",
+		"address": map[string]interface{}{"zip": "1234"},
+	}
+	if !reflect.DeepEqual(doc1, expected) {
+		t.Errorf("Expected %v, got %v", expected, doc1)
+	}
+}
+
+func TestCollisionStrategyOverrides(t *testing.T) {
+	d, _ := NewWithStore(NewMemStore())
+	d.Options.CollisionStrategy = crdt.LWWStrat
+	d.Options.Overrides = []StrategyOverride{
+		{Prefix: "orders/", Strategy: crdt.AllStrat},
+		{Prefix: "max/", Strategy: crdt.LargestStrat},
+		{Prefix: "tags/", Strategy: crdt.JSONArrayStrat},
+	}
+
+	for _, k := range []string{"cache/a", "orders/1", "max/n", "tags/t"} {
+		d.Add(k, []byte(`10`), "")
+		d.Add(k, []byte(`9`), "")
+	}
+	d.Add("tags/t", []byte(`["a", "b"]`), "")
+	d.Add("tags/t", []byte(`["c", "a"]`), "")
+
+	extract := func(key string) string {
+		v, _ := d.Load(key)
+		dat, _ := v.Extract()
+		b, _ := dat.([]byte)
+		return string(b)
+	}
+
+	if v := extract("cache/a"); v != "9" {
+		t.Errorf("Expected lww to surface the last write 9, got %s", v)
+	}
+
+	if v, _ := d.Load("orders/1"); len(v) != 2 {
+		t.Errorf("Expected both orders to be kept, got %d", len(v))
+	}
+
+	if v := extract("max/n"); v != "10" {
+		t.Errorf("Expected largest value 10, got %s", v)
+	}
+
+	if v := extract("tags/t"); v != `["a","b","c"]` {
+		t.Errorf("Expected merged array, got %s", v)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	for name, d := range map[string]*DB{"bolt": nil, "memory": nil} {
+		var err error
+		if name == "bolt" {
+			var n string
+			d, n = NewORSet()
+			defer teardown(d, n)
+		} else if d, err = NewWithStore(NewMemStore()); err != nil {
+			t.Fatal(err)
+		}
+
+		err = d.Batch(func(tx *DB) error {
+			if err := tx.AddNS("tenant", "k", []byte("v"), ""); err != nil {
+				return err
+			}
+			return errors.New("abort")
+		})
+
+		if err == nil {
+			t.Fatalf("%s: expected the batch to fail", name)
+		}
+
+		names, _ := d.Namespaces()
+		if len(names) != 0 {
+			t.Fatalf("%s: expected the namespace to be rolled back, got %v", name, names)
+		}
+
+		// the rolled back namespace must not be remembered as created
+		if err := d.AddNS("tenant", "k", []byte("v"), ""); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if _, ok := d.LoadNS("tenant", "k"); !ok {
+			t.Fatalf("%s: expected to find k", name)
+		}
+	}
+}
+
+func TestValueCompression(t *testing.T) {
+	d, err := NewWithStore(NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Options.CollisionStrategy = crdt.AllStrat
+
+	big := bytes.Repeat([]byte("compressible "), 100)
+	d.Options.Compression = compression.Snappy
+	if err := d.Add("k", big, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// values written before compression was turned off stay readable
+	d.Options.Compression = compression.None
+	if err := d.Add("k", []byte("plain"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := 0
+	d.Store.Iterate(KEYS, nil, func(k, v []byte) error {
+		if compression.IsCompressed(v) {
+			compressed++
+		}
+		return nil
+	})
+
+	if compressed != 1 {
+		t.Errorf("expected one compressed value, got %d", compressed)
+	}
+
+	v, _ := d.Load("k")
+	found := map[string]bool{}
+	for _, tsv := range v {
+		found[string(tsv.Value)] = true
+	}
+
+	if !found[string(big)] || !found["plain"] {
+		t.Errorf("expected both values back, got %d", len(v))
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	d, n := NewORSet()
+	defer teardown(d, n)
+	d.Options.CollisionStrategy = crdt.AllStrat
+
+	keys := []string{"foo", "foobar", "foo.bar", "foo.", "a.b.c", "bin\x00ary", "bin", "bin\x00", "\xff\x00\x01"}
+	for _, k := range keys {
+		if err := d.Add(k, []byte(k), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, k := range keys {
+		v, ok := d.Load(k)
+		if !ok || len(v) != 1 {
+			t.Fatalf("expected one value for %q, got %v", k, v)
+		}
+
+		for uid, tsv := range v {
+			if string(tsv.Value) != k {
+				t.Errorf("expected %q to hold its own value, got %q", k, tsv.Value)
+			}
+
+			if strings.Contains(k, ".") && strings.Contains(uid, k) {
+				t.Errorf("expected the uid of %q to be split off, got %q", k, uid)
+			}
+		}
+	}
+
+	// removing a key leaves keys it is a prefix of alone
+	d.Remove("foo")
+	d.Remove("bin")
+	for _, k := range keys {
+		_, ok := d.Load(k)
+		if removed := k == "foo" || k == "bin"; ok == removed {
+			t.Errorf("unexpected presence of %q after removing foo and bin: %v", k, ok)
+		}
+	}
+}
+
+func TestKeyMigration(t *testing.T) {
+	s := NewMemStore()
+	for _, b := range []string{KEYS, NAMESPACES, "ns.other"} {
+		if err := s.CreateBucket(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put := func(bucket, k, v string) {
+		enc, err := Encode(&crdt.TSValue{TS: 1, Value: []byte(v)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(bucket, []byte(k), enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a database written with the original add.{key}.{uid} format
+	put(KEYS, "add.a.b.uid1", "dotted")
+	put(KEYS, "add.foo.uid2", "foo")
+	put(KEYS, "add.foobar.uid3", "foobar")
+	s.Put(KEYS, []byte("rem.foobar.uid3"), []byte{})
+	s.Put(NAMESPACES, []byte("other"), []byte{})
+	put("ns.other", "add.x.uid4", "x")
+
+	d, err := NewWithStore(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Options.CollisionStrategy = crdt.AllStrat
+
+	for k, want := range map[string]string{"a.b": "dotted", "foo": "foo"} {
+		v, ok := d.Load(k)
+		if !ok || len(v) != 1 {
+			t.Fatalf("expected one value for %q after migrating, got %v", k, v)
+		}
+
+		for uid, tsv := range v {
+			if string(tsv.Value) != want || uid[:3] != "uid" {
+				t.Errorf("expected %q for %q, got %s: %q", want, k, uid, tsv.Value)
+			}
+		}
+	}
+
+	if _, ok := d.Load("foobar"); ok {
+		t.Error("expected foobar to stay removed")
+	}
+
+	if _, ok := d.LoadNS("other", "x"); !ok {
+		t.Error("expected namespaced keys to be migrated")
+	}
+
+	// ops from nodes still on the original format are stored in the new one
+	if err := d.AddOp("add.old.node.uid5", &crdt.TSValue{TS: 2, Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Load("old.node"); !ok {
+		t.Error("expected a legacy KID to be converted")
+	}
+
+	legacy := 0
+	s.Iterate(KEYS, nil, func(k, _ []byte) error {
+		if _, _, _, ok := legacyEntry(string(k)); ok {
+			legacy++
+		}
+		return nil
+	})
+
+	if legacy != 0 {
+		t.Errorf("expected no entries left in the original format, found %d", legacy)
+	}
+}
+
+func TestContiguousClock(t *testing.T) {
+	d, err := NewWithStore(NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// op 2 is missing
+	for _, seq := range []uint64{1, 3, 4} {
+		if err := d.Advance("a", seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock, _ := d.Clock()
+	upto, _ := d.Contiguous()
+	if clock["a"] != 4 || upto["a"] != 1 {
+		t.Fatalf("expected the clock at 4 and the contiguous clock at 1, got %d and %d", clock["a"], upto["a"])
+	}
+
+	if err := d.Advance("a", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if upto, _ = d.Contiguous(); upto["a"] != 4 {
+		t.Errorf("expected the gap to be filled, got %d", upto["a"])
+	}
+
+	_, seq, _, err := d.NextSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self, _ := d.NodeID()
+	if upto, _ = d.Contiguous(); upto[self] != seq {
+		t.Errorf("expected local ops to be contiguous, got %d", upto[self])
+	}
+}
+
+func TestRemoveTombstonesExpired(t *testing.T) {
+	d, err := NewWithStore(NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Options.CollisionStrategy = crdt.LWWStrat
+
+	now := time.Now().UnixNano()
+	d.AddOp(AddKey("k", "old"), &crdt.TSValue{TS: now - 2, Value: []byte("old"), Expires: now - 1})
+	d.AddOp(AddKey("k", "new"), &crdt.TSValue{TS: now, Value: []byte("new")})
+
+	ids, err := d.Observed(DefaultNS, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ids, []string{"new", "old"}) {
+		t.Fatalf("expected the expired value to be observed, got %v", ids)
+	}
+
+	if err := d.RemoveObservedNS(DefaultNS, "k", ids); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, _ = d.Observed(DefaultNS, "k"); len(ids) != 0 {
+		t.Errorf("expected every value to be removed, %v left", ids)
+	}
+}
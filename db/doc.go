@@ -0,0 +1,72 @@
+package db
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+)
+
+// DOCS holds JSON documents as an OR-Map, one LWW register per field
+const DOCS = "docs"
+
+func docField(key, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+// PatchDoc merges field registers into a document, fields only change if
+// the new register is newer than the stored one
+func (d *DB) PatchDoc(key string, fields crdt.ORMap) error {
+	return d.Store.Batch(func(b Batch) error {
+		for field, r := range fields {
+			fk := docField(key, field)
+			v, err := b.Get(DOCS, fk)
+			if err != nil {
+				return err
+			}
+
+			current := crdt.ORMap{}
+			if v != nil {
+				ex := &crdt.Register{}
+				if err := Decode(v, ex); err != nil {
+					return err
+				}
+				current[field] = ex
+			}
+
+			if !current.Merge(field, r) {
+				continue
+			}
+
+			enc, err := Encode(r)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(DOCS, fk, enc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Doc assembles a document from its field registers
+func (d *DB) Doc(key string) (map[string]interface{}, bool) {
+	fields := crdt.ORMap{}
+	pfx := docField(key, "")
+	err := d.Store.Iterate(DOCS, pfx, func(k, v []byte) error {
+		r := &crdt.Register{}
+		if err := Decode(v, r); err != nil {
+			return err
+		}
+
+		fields[string(k[len(pfx):])] = r
+		return nil
+	})
+
+	if err != nil {
+		log.Error("failed to load document: ", err)
+		return nil, false
+	}
+
+	return fields.Document()
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// The values and tombstones of a key are stored as
+//
+//	kind | escaped key | 0x00 0x01 | uid
+//
+// with every 0x00 in the key escaped as 0x00 0xff. The terminator sorts
+// before anything that can follow it in a longer key, so the entries of a
+// key never share a prefix with those of another key, whatever bytes the
+// keys contain, and the escaped key without the terminator finds every key
+// starting with it.
+const (
+	addEntry byte = 0x01
+	remEntry byte = 0x02
+)
+
+var (
+	keyTerminator = []byte{0x00, 0x01}
+	keyFormatKey  = []byte("key_format")
+	keyFormat     = []byte("2")
+)
+
+var errBadEntry = errors.New("malformed key entry")
+
+func escapeKey(buf []byte, key string) []byte {
+	for i := 0; i < len(key); i++ {
+		buf = append(buf, key[i])
+		if key[i] == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+
+	return buf
+}
+
+// entryPrefix returns the prefix every entry of kind for key starts with
+func entryPrefix(kind byte, key string) []byte {
+	buf := make([]byte, 0, len(key)+3)
+	buf = append(buf, kind)
+	buf = escapeKey(buf, key)
+	return append(buf, keyTerminator...)
+}
+
+// rangePrefix returns the prefix every entry of kind for a key starting with
+// prefix starts with
+func rangePrefix(kind byte, prefix string) []byte {
+	return escapeKey([]byte{kind}, prefix)
+}
+
+func entryKey(kind byte, key string, uid string) []byte {
+	return append(entryPrefix(kind, key), uid...)
+}
+
+// AddKey returns the storage key of the value of key with the given unique
+// ID, this is what OpLog.KID carries
+func AddKey(key string, uid string) string {
+	return string(entryKey(addEntry, key, uid))
+}
+
+// parseEntry decodes the kind, key and uid of an entry
+func parseEntry(k []byte) (byte, string, string, error) {
+	if len(k) == 0 || (k[0] != addEntry && k[0] != remEntry) {
+		return 0, "", "", errBadEntry
+	}
+
+	key := make([]byte, 0, len(k))
+	for i := 1; i < len(k); i++ {
+		if k[i] != 0x00 {
+			key = append(key, k[i])
+			continue
+		}
+
+		if i+1 >= len(k) {
+			return 0, "", "", errBadEntry
+		}
+
+		switch k[i+1] {
+		case 0xff:
+			key = append(key, 0x00)
+			i++
+		case 0x01:
+			return k[0], string(key), string(k[i+2:]), nil
+		default:
+			return 0, "", "", errBadEntry
+		}
+	}
+
+	return 0, "", "", errBadEntry
+}
+
+// legacyEntry decodes an entry of the original add.{key}.{uid} format, uids
+// never contain a dot so the last one ends the key
+func legacyEntry(k string) (byte, string, string, bool) {
+	var kind byte
+	switch {
+	case strings.HasPrefix(k, "add."):
+		kind = addEntry
+	case strings.HasPrefix(k, "rem."):
+		kind = remEntry
+	default:
+		return 0, "", "", false
+	}
+
+	dot := strings.LastIndex(k, ".")
+	if dot < 4 {
+		return 0, "", "", false
+	}
+
+	return kind, k[4:dot], k[dot+1:], true
+}
+
+// upgradeKID converts the KID of an op from a node still on the original
+// format
+func upgradeKID(kid string) string {
+	if kind, key, uid, ok := legacyEntry(kid); ok && kind == addEntry {
+		return AddKey(key, uid)
+	}
+
+	return kid
+}
+
+// migrateKeys rewrites the entries of the keys and namespace buckets from
+// the original format, it only runs once per DB
+func (d *DB) migrateKeys() error {
+	return d.Store.Batch(func(b Batch) error {
+		done, err := b.Get(META, keyFormatKey)
+		if err != nil || bytes.Equal(done, keyFormat) {
+			return err
+		}
+
+		buckets := []string{KEYS}
+		err = b.Iterate(NAMESPACES, nil, func(k, _ []byte) error {
+			buckets = append(buckets, bucketFor(string(k)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, bucket := range buckets {
+			if err := migrateBucket(b, bucket); err != nil {
+				return err
+			}
+		}
+
+		return b.Put(META, keyFormatKey, keyFormat)
+	})
+}
+
+func migrateBucket(b Batch, bucket string) error {
+	type entry struct{ old, new, v []byte }
+
+	entries := make([]entry, 0)
+	err := b.Iterate(bucket, nil, func(k, v []byte) error {
+		kind, key, uid, ok := legacyEntry(string(k))
+		if !ok {
+			return nil
+		}
+
+		entries = append(entries, entry{
+			old: append([]byte{}, k...),
+			new: entryKey(kind, key, uid),
+			v:   append([]byte{}, v...),
+		})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		log.Info("migrating ", len(entries), " entries of ", bucket, " to the new key format")
+	}
+
+	for _, e := range entries {
+		if err := b.Put(bucket, e.new, e.v); err != nil {
+			return err
+		}
+
+		if err := b.Delete(bucket, e.old); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
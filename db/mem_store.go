@@ -0,0 +1,210 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemStore is a Store that only lives in memory, it is used in tests and by
+// cache-only nodes that re-sync their state from the cluster on start
+type MemStore struct {
+	mtx     sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{buckets: map[string]map[string][]byte{}}
+}
+
+type memTx struct {
+	s    *MemStore
+	undo []func()
+}
+
+func (t *memTx) bucket(name string) (map[string][]byte, error) {
+	b, ok := t.s.buckets[name]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist", name)
+	}
+
+	return b, nil
+}
+
+func (t *memTx) Get(bucket string, key []byte) ([]byte, error) {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := b[string(key)]
+	if !ok {
+		return nil, nil
+	}
+
+	cp := make([]byte, len(v))
+	copy(cp, v)
+	return cp, nil
+}
+
+func (t *memTx) Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	pfx := string(prefix)
+	keys := make([]string, 0)
+	for k := range b {
+		if strings.HasPrefix(k, pfx) {
+			keys = append(keys, k)
+		}
+	}
+
+	// match bolt, which iterates in byte order
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := b[k]
+		if !ok {
+			continue
+		}
+
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memTx) Put(bucket string, key, value []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	k := string(key)
+	old, existed := b[k]
+	t.undo = append(t.undo, func() {
+		if existed {
+			b[k] = old
+			return
+		}
+		delete(b, k)
+	})
+
+	cp := make([]byte, len(value))
+	copy(cp, value)
+	b[k] = cp
+	return nil
+}
+
+func (t *memTx) Delete(bucket string, key []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	k := string(key)
+	old, existed := b[k]
+	if !existed {
+		return nil
+	}
+
+	t.undo = append(t.undo, func() { b[k] = old })
+	delete(b, k)
+	return nil
+}
+
+func (t *memTx) CreateBucket(bucket string) error {
+	if _, ok := t.s.buckets[bucket]; ok {
+		return nil
+	}
+
+	t.undo = append(t.undo, func() { delete(t.s.buckets, bucket) })
+	t.s.buckets[bucket] = map[string][]byte{}
+	return nil
+}
+
+func (t *memTx) DeleteBucket(bucket string) error {
+	old, ok := t.s.buckets[bucket]
+	if !ok {
+		return nil
+	}
+
+	t.undo = append(t.undo, func() { t.s.buckets[bucket] = old })
+	delete(t.s.buckets, bucket)
+	return nil
+}
+
+func (t *memTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (s *MemStore) Get(bucket string, key []byte) ([]byte, error) {
+	var v []byte
+	err := s.Snapshot(func(r Reader) error {
+		var err error
+		v, err = r.Get(bucket, key)
+		return err
+	})
+
+	return v, err
+}
+
+func (s *MemStore) Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	return s.Snapshot(func(r Reader) error {
+		return r.Iterate(bucket, prefix, fn)
+	})
+}
+
+func (s *MemStore) Put(bucket string, key, value []byte) error {
+	return s.Batch(func(b Batch) error {
+		return b.Put(bucket, key, value)
+	})
+}
+
+func (s *MemStore) Delete(bucket string, key []byte) error {
+	return s.Batch(func(b Batch) error {
+		return b.Delete(bucket, key)
+	})
+}
+
+func (s *MemStore) Batch(fn func(b Batch) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	tx := &memTx{s: s}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (s *MemStore) Snapshot(fn func(r Reader) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return fn(&memTx{s: s})
+}
+
+func (s *MemStore) CreateBucket(bucket string) error {
+	return s.Batch(func(b Batch) error {
+		return b.(*memTx).CreateBucket(bucket)
+	})
+}
+
+func (s *MemStore) DeleteBucket(bucket string) error {
+	return s.Batch(func(b Batch) error {
+		return b.(*memTx).DeleteBucket(bucket)
+	})
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
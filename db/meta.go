@@ -0,0 +1,43 @@
+package db
+
+import (
+	"github.com/satori/go.uuid"
+)
+
+// META holds data about the DB itself
+const META = "meta"
+
+var nodeIDKey = []byte("node_id")
+
+// NodeID returns the stable ID of this DB, it is generated the first time it
+// is needed and survives restarts, unlike the peering name
+func (d *DB) NodeID() (string, error) {
+	if id, ok := d.nodeID.Load().(string); ok {
+		return id, nil
+	}
+
+	var id string
+	err := d.Store.Batch(func(b Batch) error {
+		v, err := b.Get(META, nodeIDKey)
+		if err != nil {
+			return err
+		}
+
+		if v != nil {
+			id = string(v)
+			return nil
+		}
+
+		id = uuid.NewV4().String()
+		return b.Put(META, nodeIDKey, []byte(id))
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if !d.inTx {
+		d.nodeID.Store(id)
+	}
+	return id, nil
+}
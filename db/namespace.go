@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// DefaultNS is the namespace used when none is given, it maps to the original
+// keys bucket so existing databases keep working
+const DefaultNS = ""
+
+var validNS = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func bucketFor(ns string) string {
+	if ns == DefaultNS {
+		return KEYS
+	}
+
+	return fmt.Sprintf("ns.%s", ns)
+}
+
+func ValidateNamespace(ns string) error {
+	if !validNS.MatchString(ns) {
+		return fmt.Errorf("invalid namespace %q, only letters, digits, - and _ are allowed", ns)
+	}
+
+	return nil
+}
+
+func (d *DB) ensureNamespace(ns string) error {
+	if ns == DefaultNS {
+		return nil
+	}
+
+	if _, ok := d.namespaces.Load(ns); ok {
+		return nil
+	}
+
+	return d.CreateNamespace(ns)
+}
+
+// CreateNamespace creates the bucket for a namespace, creating an existing
+// namespace is a no-op
+func (d *DB) CreateNamespace(ns string) error {
+	if err := ValidateNamespace(ns); err != nil {
+		return err
+	}
+
+	if err := d.Store.CreateBucket(bucketFor(ns)); err != nil {
+		return err
+	}
+
+	existing, err := d.Store.Get(NAMESPACES, []byte(ns))
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		enc, err := Encode(time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+
+		if err := d.Store.Put(NAMESPACES, []byte(ns), enc); err != nil {
+			return err
+		}
+	}
+
+	if !d.inTx {
+		d.namespaces.Store(ns, true)
+	}
+	return nil
+}
+
+// DropNamespace deletes a namespace and all of the data in it
+func (d *DB) DropNamespace(ns string) error {
+	if ns == DefaultNS {
+		return errors.New("the default namespace can't be dropped")
+	}
+
+	if err := ValidateNamespace(ns); err != nil {
+		return err
+	}
+
+	err := d.Store.Batch(func(b Batch) error {
+		if err := b.(bucketer).DeleteBucket(bucketFor(ns)); err != nil {
+			return err
+		}
+
+		return b.Delete(NAMESPACES, []byte(ns))
+	})
+	if err != nil {
+		return err
+	}
+
+	// only once the bucket is gone, so a write made while it was dropped
+	// can't leave the namespace cached without its bucket
+	d.namespaces.Delete(ns)
+	return nil
+}
+
+// Namespaces lists all namespaces that have been created
+func (d *DB) Namespaces() ([]string, error) {
+	names := make([]string, 0)
+	err := d.Store.Iterate(NAMESPACES, []byte{}, func(k, _ []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+
+	return names, err
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bytes"
+)
+
+// OUTBOX holds the ops that have not been acknowledged by a peer yet, keys
+// are peer\x00opID so every peer's queue iterates in op order
+const OUTBOX = "outbox"
+
+func outboxPrefix(peer string) []byte {
+	return []byte(peer + "\x00")
+}
+
+// QueueOutbound queues an encoded op for every peer in a single transaction
+func (d *DB) QueueOutbound(peers []string, id string, msg []byte) error {
+	return d.Store.Batch(func(b Batch) error {
+		for _, p := range peers {
+			if err := b.Put(OUTBOX, append(outboxPrefix(p), id...), msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Outbound returns up to limit of the oldest ops queued for a peer
+func (d *DB) Outbound(peer string, limit int) ([]string, [][]byte, error) {
+	ids := make([]string, 0)
+	msgs := make([][]byte, 0)
+	pfx := outboxPrefix(peer)
+	err := d.Store.Iterate(OUTBOX, pfx, func(k, v []byte) error {
+		if len(ids) >= limit {
+			return errStopIteration
+		}
+
+		cp := make([]byte, len(v))
+		copy(cp, v)
+		ids = append(ids, string(k[len(pfx):]))
+		msgs = append(msgs, cp)
+		return nil
+	})
+
+	if err == errStopIteration {
+		err = nil
+	}
+
+	return ids, msgs, err
+}
+
+// AckOutbound removes ops a peer has acknowledged from its queue
+func (d *DB) AckOutbound(peer string, ids []string) error {
+	return d.Store.Batch(func(b Batch) error {
+		for _, id := range ids {
+			if err := b.Delete(OUTBOX, append(outboxPrefix(peer), id...)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DropOutbound removes the whole queue of a peer
+func (d *DB) DropOutbound(peer string) error {
+	return d.Store.Batch(func(b Batch) error {
+		keys := make([][]byte, 0)
+		err := b.Iterate(OUTBOX, outboxPrefix(peer), func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(OUTBOX, k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// OutboundBacklog returns the number of queued ops per peer
+func (d *DB) OutboundBacklog() (map[string]int, error) {
+	backlog := map[string]int{}
+	err := d.Store.Iterate(OUTBOX, nil, func(k, _ []byte) error {
+		i := bytes.IndexByte(k, 0)
+		if i < 0 {
+			return nil
+		}
+
+		backlog[string(k[:i])]++
+		return nil
+	})
+
+	return backlog, err
+}
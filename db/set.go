@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// SETS holds user facing OR-Sets, every add of a member gets a unique tag and
+// a remove tombstones only the tags it observed, so concurrent adds win
+const SETS = "sets"
+
+const (
+	setAdd = "add"
+	setRem = "rem"
+)
+
+func setEntry(key, member, kind, tag string) []byte {
+	return []byte(strings.Join([]string{key, member, kind, tag}, "\x00"))
+}
+
+func ValidateMember(member string) error {
+	if member == "" || strings.Contains(member, "\x00") {
+		return errors.New("set members must be non-empty and can't contain NUL bytes")
+	}
+
+	return nil
+}
+
+func (d *DB) SetAdd(key, member, tag string) error {
+	return d.Store.Put(SETS, setEntry(key, member, setAdd, tag), []byte{})
+}
+
+// SetRemove tombstones the observed add tags of a member
+func (d *DB) SetRemove(key, member string, tags []string) error {
+	return d.Store.Batch(func(b Batch) error {
+		for _, tag := range tags {
+			if err := b.Put(SETS, setEntry(key, member, setRem, tag), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// setState returns the live add tags of every member of a set
+func (d *DB) setState(r Reader, key string) (map[string][]string, error) {
+	adds := map[string][]string{}
+	rems := map[string]bool{}
+	err := r.Iterate(SETS, []byte(key+"\x00"), func(k, _ []byte) error {
+		pts := bytes.Split(k, []byte("\x00"))
+		if len(pts) != 4 {
+			return nil
+		}
+
+		member, kind, tag := string(pts[1]), string(pts[2]), string(pts[3])
+		switch kind {
+		case setAdd:
+			adds[member] = append(adds[member], tag)
+		case setRem:
+			rems[member+"\x00"+tag] = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[string][]string{}
+	for member, tags := range adds {
+		for _, tag := range tags {
+			if !rems[member+"\x00"+tag] {
+				live[member] = append(live[member], tag)
+			}
+		}
+	}
+
+	return live, nil
+}
+
+// SetTags returns the add tags of a member that have not been removed
+func (d *DB) SetTags(key, member string) ([]string, error) {
+	var tags []string
+	err := d.Store.Snapshot(func(r Reader) error {
+		live, err := d.setState(r, key)
+		tags = live[member]
+		return err
+	})
+
+	return tags, err
+}
+
+// SetMembers returns the sorted members of a set, the bool is false if the
+// set has no members
+func (d *DB) SetMembers(key string) ([]string, bool) {
+	members := make([]string, 0)
+	err := d.Store.Snapshot(func(r Reader) error {
+		live, err := d.setState(r, key)
+		for m := range live {
+			members = append(members, m)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		log.Error("failed to load set: ", err)
+		return nil, false
+	}
+
+	sort.Strings(members)
+	return members, len(members) > 0
+}
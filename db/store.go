@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+)
+
+// errStopIteration ends an Iterate early without failing it
+var errStopIteration = errors.New("stop iteration")
+
+// Reader is the read side of a storage engine, keys and values passed to an
+// Iterate callback are only valid until the callback returns
+type Reader interface {
+	Get(bucket string, key []byte) ([]byte, error)
+	Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error
+}
+
+// Writer is the write side of a storage engine
+type Writer interface {
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+}
+
+// Batch is a set of reads and writes that are applied atomically, if the
+// batch function returns an error none of the writes are applied
+type Batch interface {
+	Reader
+	Writer
+}
+
+// Store is the storage engine DB is written against, a missing key is not an
+// error, Get returns a nil value instead
+type Store interface {
+	Reader
+	Writer
+	// Batch runs fn in a single atomic write transaction, fn must not call
+	// back into the store directly
+	Batch(fn func(b Batch) error) error
+	// Snapshot runs fn against a consistent view of the store
+	Snapshot(fn func(r Reader) error) error
+	CreateBucket(bucket string) error
+	// DeleteBucket removes a bucket and everything in it, deleting a missing
+	// bucket is not an error
+	DeleteBucket(bucket string) error
+	Close() error
+}
+
+// bucketer is implemented by transactions that can create and delete buckets
+type bucketer interface {
+	CreateBucket(bucket string) error
+	DeleteBucket(bucket string) error
+}
+
+// txStore exposes a Batch as a Store, so DB methods can run inside an outer
+// transaction, nested batches and snapshots join it
+type txStore struct {
+	b Batch
+}
+
+func (t *txStore) Get(bucket string, key []byte) ([]byte, error) {
+	return t.b.Get(bucket, key)
+}
+
+func (t *txStore) Iterate(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	return t.b.Iterate(bucket, prefix, fn)
+}
+
+func (t *txStore) Put(bucket string, key, value []byte) error {
+	return t.b.Put(bucket, key, value)
+}
+
+func (t *txStore) Delete(bucket string, key []byte) error {
+	return t.b.Delete(bucket, key)
+}
+
+func (t *txStore) Batch(fn func(b Batch) error) error {
+	return fn(t.b)
+}
+
+func (t *txStore) Snapshot(fn func(r Reader) error) error {
+	return fn(t.b)
+}
+
+func (t *txStore) CreateBucket(bucket string) error {
+	return t.b.(bucketer).CreateBucket(bucket)
+}
+
+func (t *txStore) DeleteBucket(bucket string) error {
+	return t.b.(bucketer).DeleteBucket(bucket)
+}
+
+func (t *txStore) Close() error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"errors"
+	"github.com/satori/go.uuid"
+	"os"
+	"testing"
+)
+
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	fName := uuid.NewV4().String()
+	bs, err := NewBoltStore(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fName)
+	defer bs.Close()
+
+	stores := map[string]Store{
+		"bolt":   bs,
+		"memory": NewMemStore(),
+	}
+
+	for name, s := range stores {
+		if err := s.CreateBucket(KEYS); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(name, func(t *testing.T) { fn(t, s) })
+	}
+}
+
+func TestStorePutGetDelete(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		if err := s.Put(KEYS, []byte("a"), []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.Get(KEYS, []byte("a"))
+		if err != nil || string(v) != "foo" {
+			t.Errorf("expected foo, got %s (%v)", v, err)
+		}
+
+		if err := s.Delete(KEYS, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err = s.Get(KEYS, []byte("a"))
+		if err != nil || v != nil {
+			t.Errorf("expected missing key, got %s (%v)", v, err)
+		}
+	})
+}
+
+func TestStoreIteratePrefix(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		for _, k := range []string{"add.b", "add.a", "rem.a", "add.c"} {
+			s.Put(KEYS, []byte(k), []byte(k))
+		}
+
+		found := make([]string, 0)
+		s.Iterate(KEYS, []byte("add."), func(k, v []byte) error {
+			found = append(found, string(k))
+			return nil
+		})
+
+		if len(found) != 3 || found[0] != "add.a" || found[2] != "add.c" {
+			t.Errorf("expected sorted add keys, got %v", found)
+		}
+	})
+}
+
+func TestStoreBatchRollback(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		s.Put(KEYS, []byte("keep"), []byte("1"))
+
+		err := s.Batch(func(b Batch) error {
+			b.Put(KEYS, []byte("keep"), []byte("2"))
+			b.Put(KEYS, []byte("new"), []byte("3"))
+			b.Delete(KEYS, []byte("keep"))
+			return errors.New("abort")
+		})
+
+		if err == nil {
+			t.Fatal("expected batch error")
+		}
+
+		v, _ := s.Get(KEYS, []byte("keep"))
+		if string(v) != "1" {
+			t.Errorf("expected rolled back value 1, got %s", v)
+		}
+
+		v, _ = s.Get(KEYS, []byte("new"))
+		if v != nil {
+			t.Errorf("expected new key to be rolled back, got %s", v)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package grpcapi
+
+import (
+	"github.com/lonelycode/yzma/logger"
+	"github.com/spf13/viper"
+)
+
+type GRPCCfg struct {
+	Bind       string // e.g. :9090, the service only starts if set
+	EnableACL  bool   // require a token that is allowed by the ACLs on every call
+	AdminToken string // token that bypasses the ACLs
+	CertFile   string // serve TLS with this certificate and key if both are set
+	KeyFile    string
+}
+
+type Config struct {
+	GRPC *GRPCCfg
+}
+
+var sconf = &Config{}
+
+var log = logger.GetLogger("grpc")
+
+func GetConf() *GRPCCfg {
+	err := viper.Unmarshal(sconf)
+	if err != nil {
+		log.Fatal("failed to read gRPC config: ", err)
+	}
+
+	return sconf.GRPC
+}
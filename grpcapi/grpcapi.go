@@ -0,0 +1,466 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/grpcapi/pb"
+	"github.com/lonelycode/yzma/oplog"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/types/crdt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+
+	// writes queued for a watcher before it is dropped
+	watchBuffer = 1024
+)
+
+// GRPCAPI serves the KV and Cluster gRPC services on top of a server
+type GRPCAPI struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedClusterServer
+
+	server *server.Server
+	cfg    *GRPCCfg
+	gs     *grpc.Server
+	mtx    sync.Mutex
+}
+
+// Start listens on cfg.Bind, it returns once the listener is ready
+func (g *GRPCAPI) Start(srv *server.Server, cfg *GRPCCfg) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	opts := make([]grpc.ServerOption, 0)
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	ln, err := net.Listen("tcp", cfg.Bind)
+	if err != nil {
+		return err
+	}
+
+	g.server = srv
+	g.cfg = cfg
+	g.gs = grpc.NewServer(opts...)
+	pb.RegisterKVServer(g.gs, g)
+	pb.RegisterClusterServer(g.gs, g)
+
+	go func() {
+		if err := g.gs.Serve(ln); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	log.Info("gRPC listening on ", cfg.Bind)
+	return nil
+}
+
+// Stop ends open calls, including watches, and closes the listener
+func (g *GRPCAPI) Stop() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.gs != nil {
+		g.gs.Stop()
+	}
+}
+
+// token returns the API token of a call from the authorization metadata
+func token(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	vals := md.Get("authorization")
+	if len(vals) == 0 {
+		return ""
+	}
+
+	return strings.TrimPrefix(vals[0], "Bearer ")
+}
+
+// authorize checks the token of a call against the ACLs
+func (g *GRPCAPI) authorize(ctx context.Context, ns, key string, op acl.Operation) error {
+	if !g.cfg.EnableACL {
+		return nil
+	}
+
+	err := g.server.Authorize(token(ctx), g.cfg.AdminToken, ns, key, op)
+	switch err.(type) {
+	case nil:
+		return nil
+	case *server.DeniedError:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err == server.ErrNoToken || err == server.ErrUnknownToken {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func namespace(ns string) error {
+	if ns == db.DefaultNS {
+		return nil
+	}
+
+	if err := db.ValidateNamespace(ns); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return nil
+}
+
+// check validates the namespace of a call and authorizes it
+func (g *GRPCAPI) check(ctx context.Context, ns, key string, op acl.Operation) error {
+	if err := namespace(ns); err != nil {
+		return err
+	}
+
+	return g.authorize(ctx, ns, key, op)
+}
+
+func (g *GRPCAPI) writeConcern(wc int32) (server.WriteConcern, error) {
+	if wc < int32(server.ConcernAll) {
+		return 0, status.Errorf(codes.InvalidArgument, "write concern must be -1 (all), 0 (local) or a number of peers, got %d", wc)
+	}
+
+	if err := g.server.CheckConcern(server.WriteConcern(wc)); err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return server.WriteConcern(wc), nil
+}
+
+func writeResponse(res *server.WriteResult) *pb.WriteResponse {
+	return &pb.WriteResponse{
+		OpId:         res.OpID,
+		SessionToken: res.Token,
+		Acks:         int32(res.Acks),
+		Required:     int32(res.Required),
+		ConcernMet:   res.Met(),
+		Removed:      int32(res.Removed),
+	}
+}
+
+// values returns the values of a payload oldest first
+func values(dat crdt.Payload) []*pb.Value {
+	ret := make([]*pb.Value, 0, len(dat))
+	for _, v := range dat {
+		ret = append(ret, &pb.Value{Data: v.Value, MimeType: v.MimeType, Timestamp: v.TS})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp < ret[j].Timestamp })
+
+	return ret
+}
+
+func (g *GRPCAPI) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if err := g.check(ctx, req.Namespace, req.Key, acl.Read); err != nil {
+		return nil, err
+	}
+
+	if req.SessionToken != "" {
+		t, err := crdt.ParseVersionVector(req.SessionToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid session token: "+err.Error())
+		}
+
+		ok, err := g.server.WaitFor(t)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if !ok {
+			return nil, status.Error(codes.Unavailable, "node has not caught up with the session yet")
+		}
+	}
+
+	dat, ok := g.server.LoadNS(req.Namespace, req.Key)
+	if !ok || len(dat) == 0 {
+		return &pb.GetResponse{}, nil
+	}
+
+	return &pb.GetResponse{Found: true, Values: values(dat), Context: dat.Context().String()}, nil
+}
+
+func (g *GRPCAPI) Put(ctx context.Context, req *pb.PutRequest) (*pb.WriteResponse, error) {
+	if err := g.check(ctx, req.Namespace, req.Key, acl.Write); err != nil {
+		return nil, err
+	}
+
+	return g.put(req)
+}
+
+func (g *GRPCAPI) put(req *pb.PutRequest) (*pb.WriteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key required")
+	}
+
+	var rctx crdt.VersionVector
+	if req.Context != "" {
+		var err error
+		rctx, err = crdt.ParseVersionVector(req.Context)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid context: "+err.Error())
+		}
+	}
+
+	wc, err := g.writeConcern(req.WriteConcern)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := g.server.AddWithConcern(req.Namespace, req.Key, req.Value, req.MimeType, rctx, wc)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return writeResponse(res), nil
+}
+
+func (g *GRPCAPI) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.WriteResponse, error) {
+	if err := g.check(ctx, req.Namespace, req.Key, acl.Delete); err != nil {
+		return nil, err
+	}
+
+	return g.delete(req)
+}
+
+func (g *GRPCAPI) delete(req *pb.DeleteRequest) (*pb.WriteResponse, error) {
+	// an empty prefix would remove the whole namespace, drop it instead
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key required")
+	}
+
+	wc, err := g.writeConcern(req.WriteConcern)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *server.WriteResult
+	if req.Prefix {
+		res, err = g.server.RemovePrefix(req.Namespace, req.Key, wc)
+	} else {
+		res, err = g.server.RemoveWithConcern(req.Namespace, req.Key, wc)
+	}
+
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return writeResponse(res), nil
+}
+
+// Scan needs read access to the whole prefix
+func (g *GRPCAPI) Scan(ctx context.Context, req *pb.ScanRequest) (*pb.ScanResponse, error) {
+	if err := g.check(ctx, req.Namespace, req.Prefix, acl.Read); err != nil {
+		return nil, err
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	keys, err := g.server.Keys(req.Namespace, req.Prefix)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	start := 0
+	if req.StartAfter != "" {
+		start = sort.SearchStrings(keys, req.StartAfter)
+		if start < len(keys) && keys[start] == req.StartAfter {
+			start++
+		}
+	}
+
+	res := &pb.ScanResponse{Items: make([]*pb.KeyValues, 0, limit)}
+	i := start
+	for ; i < len(keys) && len(res.Items) < limit; i++ {
+		item := &pb.KeyValues{Key: keys[i]}
+		if !req.KeysOnly {
+			// the key may have been removed since it was listed
+			dat, ok := g.server.LoadNS(req.Namespace, keys[i])
+			if !ok || len(dat) == 0 {
+				continue
+			}
+			item.Values = values(dat)
+		}
+
+		res.Items = append(res.Items, item)
+	}
+
+	if i < len(keys) && len(res.Items) > 0 {
+		res.NextKey = res.Items[len(res.Items)-1].Key
+	}
+
+	return res, nil
+}
+
+// Batch authorizes every op before applying any of them
+func (g *GRPCAPI) Batch(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
+	for i, op := range req.Ops {
+		var err error
+		switch {
+		case op.GetPut() != nil:
+			p := op.GetPut()
+			err = g.check(ctx, p.Namespace, p.Key, acl.Write)
+		case op.GetDelete() != nil:
+			d := op.GetDelete()
+			err = g.check(ctx, d.Namespace, d.Key, acl.Delete)
+		default:
+			err = status.Errorf(codes.InvalidArgument, "op %d is empty", i)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &pb.BatchResponse{Results: make([]*pb.WriteResponse, 0, len(req.Ops))}
+	for i, op := range req.Ops {
+		var r *pb.WriteResponse
+		var err error
+		if p := op.GetPut(); p != nil {
+			r, err = g.put(p)
+		} else {
+			r, err = g.delete(op.GetDelete())
+		}
+
+		if err != nil {
+			st := status.Convert(err)
+			return nil, status.Errorf(st.Code(), "op %d: %s, the ops before it were applied", i, st.Message())
+		}
+
+		res.Results = append(res.Results, r)
+	}
+
+	return res, nil
+}
+
+// events turns a committed op into the events of the keys starting with
+// prefix
+func events(op *oplog.OpLog, prefix string) []*pb.WatchEvent {
+	switch op.Op {
+	case oplog.ADD:
+		return []*pb.WatchEvent{{
+			Type:   pb.WatchEvent_PUT,
+			Key:    op.Key,
+			Value:  &pb.Value{Data: op.Value.Value, MimeType: op.Value.MimeType, Timestamp: op.Value.TS},
+			OpId:   op.ID,
+			Origin: op.Origin,
+		}}
+	case oplog.REM:
+		return []*pb.WatchEvent{{Type: pb.WatchEvent_DELETE, Key: op.Key, OpId: op.ID, Origin: op.Origin}}
+	}
+
+	keys := make([]string, 0, len(op.Observed))
+	for k := range op.Observed {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	evs := make([]*pb.WatchEvent, len(keys))
+	for i, k := range keys {
+		evs[i] = &pb.WatchEvent{Type: pb.WatchEvent_DELETE, Key: k, OpId: op.ID, Origin: op.Origin}
+	}
+
+	return evs
+}
+
+// Watch needs read access to the whole prefix, a watcher that falls too far
+// behind is ended with ResourceExhausted, it can catch up with a Scan
+func (g *GRPCAPI) Watch(req *pb.WatchRequest, stream pb.KV_WatchServer) error {
+	if err := g.check(stream.Context(), req.Namespace, req.Prefix, acl.Read); err != nil {
+		return err
+	}
+
+	w := g.server.Watch(req.Namespace, req.Prefix, watchBuffer)
+	defer g.server.Unwatch(w)
+
+	for {
+		select {
+		case op, ok := <-w.C():
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watch fell behind")
+			}
+
+			for _, ev := range events(op, req.Prefix) {
+				if err := stream.Send(ev); err != nil {
+					return err
+				}
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (g *GRPCAPI) Members(ctx context.Context, req *pb.MembersRequest) (*pb.MembersResponse, error) {
+	if err := g.authorize(ctx, "", "", acl.Admin); err != nil {
+		return nil, err
+	}
+
+	members := g.server.Members()
+	res := &pb.MembersResponse{Members: make([]*pb.Member, len(members))}
+	for i, m := range members {
+		res.Members[i] = &pb.Member{Name: m.Name, Address: m.Address, ApiIngress: m.APIIngress, Self: m.Self}
+	}
+
+	return res, nil
+}
+
+func (g *GRPCAPI) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResponse, error) {
+	if err := g.authorize(ctx, "", "", acl.Admin); err != nil {
+		return nil, err
+	}
+
+	if len(req.Peers) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "peers required")
+	}
+
+	if err := g.server.Join(req.Peers); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("join failed: %v", err))
+	}
+
+	return &pb.JoinResponse{}, nil
+}
+
+func (g *GRPCAPI) Leave(ctx context.Context, req *pb.LeaveRequest) (*pb.LeaveResponse, error) {
+	if err := g.authorize(ctx, "", "", acl.Admin); err != nil {
+		return nil, err
+	}
+
+	if err := g.server.Leave(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.LeaveResponse{}, nil
+}
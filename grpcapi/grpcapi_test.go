@@ -0,0 +1,222 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/grpcapi/pb"
+	"github.com/lonelycode/yzma/server/servertest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func dial(t *testing.T, addr string) *grpc.ClientConn {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestKV(t *testing.T) {
+	srv := servertest.Start(t, "grpc", nil).Server
+
+	g := &GRPCAPI{}
+	if err := g.Start(srv, &GRPCCfg{Bind: "127.0.0.1:40211"}); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	conn := dial(t, "127.0.0.1:40211")
+	defer conn.Close()
+	kv := pb.NewKVClient(conn)
+	ctx := context.Background()
+
+	// watch before writing, only keys under w/ are streamed
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch, err := kv.Watch(wctx, &pb.WatchRequest{Prefix: "w/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put, err := kv.Put(ctx, &pb.PutRequest{Key: "foo", Value: []byte("bar"), MimeType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if put.SessionToken == "" || !put.ConcernMet {
+		t.Fatalf("unexpected write response %v", put)
+	}
+
+	got, err := kv.Get(ctx, &pb.GetRequest{Key: "foo", SessionToken: put.SessionToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Found || len(got.Values) != 1 || string(got.Values[0].Data) != "bar" || got.Values[0].MimeType != "text/plain" {
+		t.Fatalf("unexpected get response %v", got)
+	}
+
+	if got, _ := kv.Get(ctx, &pb.GetRequest{Key: "missing"}); got.Found {
+		t.Fatal("expected missing key not to be found")
+	}
+
+	if _, err := kv.Get(ctx, &pb.GetRequest{Namespace: "bad ns", Key: "foo"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an invalid namespace to be refused, got %v", err)
+	}
+
+	batch, err := kv.Batch(ctx, &pb.BatchRequest{Ops: []*pb.BatchOp{
+		{Op: &pb.BatchOp_Put{Put: &pb.PutRequest{Key: "a/1", Value: []byte("1")}}},
+		{Op: &pb.BatchOp_Put{Put: &pb.PutRequest{Key: "a/2", Value: []byte("2")}}},
+		{Op: &pb.BatchOp_Put{Put: &pb.PutRequest{Key: "a/3", Value: []byte("3")}}},
+		{Op: &pb.BatchOp_Put{Put: &pb.PutRequest{Key: "b", Value: []byte("b")}}},
+		{Op: &pb.BatchOp_Delete{Delete: &pb.DeleteRequest{Key: "foo"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(batch.Results))
+	}
+
+	if got, _ := kv.Get(ctx, &pb.GetRequest{Key: "foo"}); got.Found {
+		t.Fatal("expected foo to be deleted by the batch")
+	}
+
+	// page through the prefix two keys at a time
+	keys := []string{}
+	next := ""
+	for {
+		page, err := kv.Scan(ctx, &pb.ScanRequest{Prefix: "a/", StartAfter: next, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, it := range page.Items {
+			if len(it.Values) != 1 {
+				t.Fatalf("expected the values of %s", it.Key)
+			}
+			keys = append(keys, it.Key)
+		}
+
+		next = page.NextKey
+		if next == "" {
+			break
+		}
+	}
+
+	if fmt.Sprint(keys) != "[a/1 a/2 a/3]" {
+		t.Fatalf("unexpected scan result %v", keys)
+	}
+
+	del, err := kv.Delete(ctx, &pb.DeleteRequest{Key: "a/", Prefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if del.Removed != 3 {
+		t.Fatalf("expected 3 keys to be removed, got %d", del.Removed)
+	}
+
+	if _, err := kv.Put(ctx, &pb.PutRequest{Key: "w/1", Value: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.Delete(ctx, &pb.DeleteRequest{Key: "w/1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ev.Type != pb.WatchEvent_PUT || ev.Key != "w/1" || string(ev.Value.Data) != "x" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+
+	ev, err = watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ev.Type != pb.WatchEvent_DELETE || ev.Key != "w/1" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+}
+
+func TestACL(t *testing.T) {
+	node := servertest.Start(t, "grpc", nil)
+	srv := node.Server
+
+	g := &GRPCAPI{}
+	if err := g.Start(srv, &GRPCCfg{Bind: "127.0.0.1:40311", EnableACL: true, AdminToken: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	conn := dial(t, "127.0.0.1:40311")
+	defer conn.Close()
+	kv := pb.NewKVClient(conn)
+	cluster := pb.NewClusterClient(conn)
+
+	ctx := context.Background()
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin")
+	reader := metadata.AppendToOutgoingContext(ctx, "authorization", "reader")
+
+	if _, err := kv.Get(ctx, &pb.GetRequest{Key: "pub/x"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected a call without a token to be refused, got %v", err)
+	}
+
+	if _, err := kv.Put(admin, &pb.PutRequest{Key: "pub/x", Value: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := srv.SetACL("reader", &acl.ACL{
+		Principal: "reader",
+		Rules:     []acl.Rule{{Prefix: "pub/", Ops: []acl.Operation{acl.Read}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := kv.Get(reader, &pb.GetRequest{Key: "pub/x"}); err != nil || !got.Found {
+		t.Fatalf("expected the reader to read pub/x, got %v", err)
+	}
+
+	if _, err := kv.Put(reader, &pb.PutRequest{Key: "pub/x", Value: []byte("y")}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the reader not to write, got %v", err)
+	}
+
+	if _, err := kv.Scan(reader, &pb.ScanRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the reader not to scan every key, got %v", err)
+	}
+
+	// nothing is applied when an op of a batch is not allowed
+	_, err = kv.Batch(reader, &pb.BatchRequest{Ops: []*pb.BatchOp{
+		{Op: &pb.BatchOp_Delete{Delete: &pb.DeleteRequest{Key: "pub/x"}}},
+	}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the batch to be refused, got %v", err)
+	}
+
+	if _, err := cluster.Members(reader, &pb.MembersRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the reader not to list members, got %v", err)
+	}
+
+	members, err := cluster.Members(admin, &pb.MembersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members.Members) != 1 || !members.Members[0].Self || members.Members[0].ApiIngress != node.APIIngress {
+		t.Fatalf("unexpected members %v", members.Members)
+	}
+}
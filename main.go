@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"github.com/lonelycode/yzma/api"
+	"github.com/lonelycode/yzma/consul"
+	"github.com/lonelycode/yzma/grpcapi"
 	"github.com/lonelycode/yzma/logger"
-	"github.com/lonelycode/yzma/oplog"
+	"github.com/lonelycode/yzma/memcache"
 	"github.com/lonelycode/yzma/peering"
+	"github.com/lonelycode/yzma/resp"
+	"github.com/lonelycode/yzma/s3"
 	"github.com/lonelycode/yzma/server"
 	"os"
 	"os/signal"
@@ -41,10 +45,64 @@ func doJoin(svr *server.Server) {
 	}
 }
 
+func startRESP(svr *server.Server, cfg *resp.RESPCfg) {
+	for !svr.Ready() {
+		time.Sleep(1 * time.Second)
+	}
+
+	l := &resp.Listener{}
+	if err := l.Start(svr, cfg); err != nil {
+		log.Fatal("failed to start the RESP listener: ", err)
+	}
+}
+
+func startMemcache(svr *server.Server, cfg *memcache.MemcacheCfg) {
+	for !svr.Ready() {
+		time.Sleep(1 * time.Second)
+	}
+
+	l := &memcache.Listener{}
+	if err := l.Start(svr, cfg); err != nil {
+		log.Fatal("failed to start the memcache listener: ", err)
+	}
+}
+
+func startS3(svr *server.Server, cfg *s3.S3Cfg) {
+	for !svr.Ready() {
+		time.Sleep(1 * time.Second)
+	}
+
+	a := &s3.S3API{}
+	if err := a.Start(svr, cfg); err != nil {
+		log.Fatal("failed to start the S3 API: ", err)
+	}
+}
+
+func startGRPC(svr *server.Server, cfg *grpcapi.GRPCCfg) {
+	for !svr.Ready() {
+		time.Sleep(1 * time.Second)
+	}
+
+	g := &grpcapi.GRPCAPI{}
+	if err := g.Start(svr, cfg); err != nil {
+		log.Fatal("failed to start the gRPC API: ", err)
+	}
+}
+
+func startConsul(svr *server.Server, cfg *consul.ConsulCfg) {
+	for !svr.Ready() {
+		time.Sleep(1 * time.Second)
+	}
+
+	c := &consul.ConsulAPI{}
+	if err := c.Start(svr, cfg); err != nil {
+		log.Fatal("failed to start the Consul KV API: ", err)
+	}
+}
+
 func main() {
 	info()
 	peeringConf := peering.GetConf()
-	peeringConf.ReplicaChan = make(chan *oplog.OpLog)
 	svrConf := server.GetConf()
 
 	stopChan := make(chan struct{})
@@ -56,6 +114,41 @@ func main() {
 	web := api.WebAPI{}
 	go web.Start(svr, webCfg)
 
+	consulCfg := consul.GetConf()
+	if consulCfg != nil && consulCfg.Bind != "" {
+		go startConsul(svr, consulCfg)
+	}
+
+	grpcCfg := grpcapi.GetConf()
+	if grpcCfg != nil && grpcCfg.Bind != "" {
+		go startGRPC(svr, grpcCfg)
+	}
+
+	respCfg := resp.GetConf()
+	if respCfg != nil && respCfg.Bind != "" {
+		go startRESP(svr, respCfg)
+	}
+
+	s3Cfg := s3.GetConf()
+	if s3Cfg != nil && s3Cfg.Bind != "" {
+		go startS3(svr, s3Cfg)
+	}
+
+	mcCfg := memcache.GetConf()
+	if mcCfg != nil && mcCfg.Bind != "" {
+		// memcached clients can't authenticate, they would get around the ACLs
+		acls := (webCfg != nil && webCfg.EnableACL) ||
+			(consulCfg != nil && consulCfg.EnableACL) ||
+			(grpcCfg != nil && grpcCfg.EnableACL) ||
+			(respCfg != nil && respCfg.EnableACL) ||
+			(s3Cfg != nil && s3Cfg.EnableACL)
+		if acls {
+			log.Fatal("the memcache listener has no authentication, it can't run with ACLs enabled")
+		}
+
+		go startMemcache(svr, mcCfg)
+	}
+
 	if *joinPtr != "" {
 		go doJoin(svr)
 	}
@@ -0,0 +1,29 @@
+package memcache
+
+import (
+	"github.com/lonelycode/yzma/logger"
+	"github.com/spf13/viper"
+)
+
+type MemcacheCfg struct {
+	Bind        string // e.g. :11211, the listener only starts if set
+	Namespace   string // namespace the commands work on, the default if empty
+	MaxItemSize int    // largest value accepted in bytes, 1MB if not set
+}
+
+type Config struct {
+	Memcache *MemcacheCfg
+}
+
+var sconf = &Config{}
+
+var log = logger.GetLogger("memcache")
+
+func GetConf() *MemcacheCfg {
+	err := viper.Unmarshal(sconf)
+	if err != nil {
+		log.Fatal("failed to read memcache config: ", err)
+	}
+
+	return sconf.Memcache
+}
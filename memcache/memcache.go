@@ -0,0 +1,447 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/types/crdt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is reported to clients by the version command
+const version = "0.1"
+
+const (
+	defaultMaxItemSize = 1024 * 1024
+	maxKeyLength       = 250
+	maxLineLength      = 64 * 1024
+
+	// expiry times up to 30 days are relative, anything larger is a unix time
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// flagsType is the mime type values are stored with when the client sets
+// flags, the flags are kept as a parameter
+const flagsType = "application/octet-stream"
+
+var errBadLine = errors.New("bad command line format")
+
+// Listener serves the memcached text protocol on top of a server
+type Listener struct {
+	server *server.Server
+	cfg    *MemcacheCfg
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	mtx    sync.Mutex
+
+	// conditional writes check and write under this lock, so they are atomic
+	// for the clients of this node
+	writeMtx sync.Mutex
+}
+
+// Start listens on cfg.Bind, it returns once the listener is ready
+func (l *Listener) Start(srv *server.Server, cfg *MemcacheCfg) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	ln, err := net.Listen("tcp", cfg.Bind)
+	if err != nil {
+		return err
+	}
+
+	l.server = srv
+	l.cfg = cfg
+	l.ln = ln
+	l.conns = map[net.Conn]struct{}{}
+	go l.serve(ln)
+
+	log.Info("memcache listening on ", cfg.Bind)
+	return nil
+}
+
+// Stop closes the listener and every open connection
+func (l *Listener) Stop() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.ln == nil {
+		return nil
+	}
+
+	for c := range l.conns {
+		c.Close()
+	}
+
+	return l.ln.Close()
+}
+
+func (l *Listener) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mtx.Lock()
+		l.conns[c] = struct{}{}
+		l.mtx.Unlock()
+
+		go l.handle(c)
+	}
+}
+
+func (l *Listener) handle(c net.Conn) {
+	defer func() {
+		l.mtx.Lock()
+		delete(l.conns, c)
+		l.mtx.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReaderSize(c, maxLineLength)
+	w := bufio.NewWriter(c)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		switch args[0] {
+		case "get", "gets":
+			l.get(w, args[1:], args[0] == "gets")
+		case "set", "add", "replace", "cas":
+			// a bad data block leaves the stream in an unknown state
+			if !l.store(r, w, args[0], args[1:]) {
+				w.Flush()
+				return
+			}
+		case "delete":
+			l.delete(w, args[1:])
+		case "version":
+			w.WriteString("VERSION " + version + "\r\n")
+		case "quit":
+			return
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// noreply strips a trailing noreply from the arguments of a command
+func noreply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+
+	return args, false
+}
+
+// casUnique identifies the values of a key, any write to it, on any node,
+// changes it
+func casUnique(p crdt.Payload) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p.Context().String()))
+	return h.Sum64()
+}
+
+func flagsMimeType(flags uint32) string {
+	if flags == 0 {
+		return ""
+	}
+
+	return mime.FormatMediaType(flagsType, map[string]string{"flags": strconv.FormatUint(uint64(flags), 10)})
+}
+
+// flagsOf reads the flags back from the mime type of a value, values written
+// through the other APIs have none
+func flagsOf(mType string) uint32 {
+	_, params, err := mime.ParseMediaType(mType)
+	if err != nil {
+		return 0
+	}
+
+	flags, err := strconv.ParseUint(params["flags"], 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return uint32(flags)
+}
+
+// ttl converts a memcached expiry time, zero is no expiry and a negative
+// duration expires the value right away
+func ttl(exptime int64, now time.Time) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= maxRelativeExptime:
+		return time.Duration(exptime) * time.Second
+	}
+
+	if d := time.Unix(exptime, 0).Sub(now); d > 0 {
+		return d
+	}
+
+	return -1
+}
+
+// load returns the live values of a key
+func (l *Listener) load(key string) (crdt.Payload, bool) {
+	dat, ok := l.server.LoadNS(l.cfg.Namespace, key)
+	if !ok || len(dat) == 0 {
+		return nil, false
+	}
+
+	return dat, true
+}
+
+// get writes the newest value of every key that exists, memcached clients
+// have no way to handle siblings
+func (l *Listener) get(w *bufio.Writer, keys []string, withCas bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			w.WriteString("CLIENT_ERROR " + errBadLine.Error() + "\r\n")
+			return
+		}
+	}
+
+	for _, key := range keys {
+		dat, ok := l.load(key)
+		if !ok {
+			continue
+		}
+
+		v := dat.Newest()
+		fmt.Fprintf(w, "VALUE %s %d %d", key, flagsOf(v.MimeType), len(v.Value))
+		if withCas {
+			fmt.Fprintf(w, " %d", casUnique(dat))
+		}
+		w.WriteString("\r\n")
+		w.Write(v.Value)
+		w.WriteString("\r\n")
+	}
+
+	w.WriteString("END\r\n")
+}
+
+// storage is a parsed set, add, replace or cas command line
+type storage struct {
+	key     string
+	flags   uint32
+	exptime int64
+	size    int // -1 until parsed
+	cas     uint64
+	noreply bool
+}
+
+func parseStorage(cmd string, args []string) (*storage, error) {
+	s := &storage{size: -1}
+	args, s.noreply = noreply(args)
+
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+
+	if len(args) != n {
+		return s, errBadLine
+	}
+
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		return s, errBadLine
+	}
+	s.size = size
+
+	if !validKey(args[0]) {
+		return s, errBadLine
+	}
+	s.key = args[0]
+
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return s, errBadLine
+	}
+	s.flags = uint32(flags)
+
+	s.exptime, err = strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return s, errBadLine
+	}
+
+	if cmd == "cas" {
+		s.cas, err = strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			return s, errBadLine
+		}
+	}
+
+	return s, nil
+}
+
+// store handles the storage commands, it returns false if the connection
+// can't be used any more
+func (l *Listener) store(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) bool {
+	s, err := parseStorage(cmd, args)
+	if err != nil && s.size < 0 {
+		// without a size there is no way to skip the data block
+		w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+		return false
+	}
+
+	maxSize := defaultMaxItemSize
+	if l.cfg.MaxItemSize > 0 {
+		maxSize = l.cfg.MaxItemSize
+	}
+
+	if s.size > maxSize {
+		if _, err := r.Discard(s.size + 2); err != nil {
+			return false
+		}
+
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+
+	data := make([]byte, s.size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false
+	}
+
+	if data[s.size] != '\r' || data[s.size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	if err != nil {
+		w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+		return true
+	}
+
+	reply := l.write(cmd, s, data[:s.size])
+	if !s.noreply {
+		w.WriteString(reply + "\r\n")
+	}
+
+	return true
+}
+
+// write checks the condition of a storage command and writes the value, the
+// condition only covers the writes this node has seen
+func (l *Listener) write(cmd string, s *storage, value []byte) string {
+	l.writeMtx.Lock()
+	defer l.writeMtx.Unlock()
+
+	cur, exists := l.load(s.key)
+	switch {
+	case cmd == "add" && exists:
+		return "NOT_STORED"
+	case cmd == "replace" && !exists:
+		return "NOT_STORED"
+	case cmd == "cas" && !exists:
+		return "NOT_FOUND"
+	case cmd == "cas" && casUnique(cur) != s.cas:
+		return "EXISTS"
+	}
+
+	// the write supersedes exactly what was checked, values that arrive from
+	// other nodes in the meantime are kept as siblings
+	var ctx crdt.VersionVector
+	if exists {
+		ctx = cur.Context()
+	}
+
+	var err error
+	mType := flagsMimeType(s.flags)
+	if d := ttl(s.exptime, time.Now()); d != 0 {
+		err = l.server.AddWithTTL(l.cfg.Namespace, s.key, value, mType, ctx, d)
+	} else {
+		err = l.server.AddWithContext(l.cfg.Namespace, s.key, value, mType, ctx)
+	}
+
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+
+	return "STORED"
+}
+
+func (l *Listener) delete(w *bufio.Writer, args []string) {
+	args, quiet := noreply(args)
+
+	// old clients send a hold time, only zero was ever allowed
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+
+	if len(args) != 1 || !validKey(args[0]) {
+		w.WriteString("CLIENT_ERROR " + errBadLine.Error() + "\r\n")
+		return
+	}
+
+	reply := l.remove(args[0])
+	if !quiet {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+func (l *Listener) remove(key string) string {
+	l.writeMtx.Lock()
+	defer l.writeMtx.Unlock()
+
+	if _, ok := l.load(key); !ok {
+		return "NOT_FOUND"
+	}
+
+	if err := l.server.RemoveNS(l.cfg.Namespace, key); err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+
+	return "DELETED"
+}
@@ -0,0 +1,136 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	mc "github.com/bradfitz/gomemcache/memcache"
+	"github.com/lonelycode/yzma/server/servertest"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemcacheClient(t *testing.T) {
+	srv := servertest.Start(t, "memcache", nil).Server
+
+	l := &Listener{}
+	if err := l.Start(srv, &MemcacheCfg{Bind: "127.0.0.1:40011", MaxItemSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	c := mc.New("127.0.0.1:40011")
+
+	if err := c.Set(&mc.Item{Key: "foo", Value: []byte("bar"), Flags: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := c.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(it.Value) != "bar" || it.Flags != 42 {
+		t.Fatalf("unexpected item %q flags %d", it.Value, it.Flags)
+	}
+
+	if _, err := c.Get("missing"); err != mc.ErrCacheMiss {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	if err := c.Add(&mc.Item{Key: "foo", Value: []byte("baz")}); err != mc.ErrNotStored {
+		t.Fatalf("expected add of an existing key to fail, got %v", err)
+	}
+
+	if err := c.Replace(&mc.Item{Key: "missing", Value: []byte("baz")}); err != mc.ErrNotStored {
+		t.Fatalf("expected replace of a missing key to fail, got %v", err)
+	}
+
+	if err := c.Add(&mc.Item{Key: "new", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// cas succeeds once, the second attempt holds a stale unique
+	it.Value = []byte("cas")
+	if err := c.CompareAndSwap(it); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.CompareAndSwap(it); err != mc.ErrCASConflict {
+		t.Fatalf("expected a cas conflict, got %v", err)
+	}
+
+	items, err := c.GetMulti([]string{"foo", "new", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || string(items["foo"].Value) != "cas" || string(items["new"].Value) != "1" {
+		t.Fatalf("unexpected items %v", items)
+	}
+
+	// a negative expiry hides the value right away
+	if err := c.Set(&mc.Item{Key: "gone", Value: []byte("x"), Expiration: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("gone"); err != mc.ErrCacheMiss {
+		t.Fatalf("expected the value to have expired, got %v", err)
+	}
+
+	if err := c.Set(&mc.Item{Key: "short", Value: []byte("x"), Expiration: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("short"); err != nil {
+		t.Fatalf("expected the value before it expires, got %v", err)
+	}
+
+	if err := c.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete("new"); err != mc.ErrCacheMiss {
+		t.Fatalf("expected the key to be gone, got %v", err)
+	}
+
+	if err := c.Set(&mc.Item{Key: "big", Value: make([]byte, 2048)}); err == nil {
+		t.Fatal("expected a value over MaxItemSize to be refused")
+	}
+
+	// the connection is still usable after refusing a value
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := c.Get("short"); err != mc.ErrCacheMiss {
+		t.Fatalf("expected the value to have expired, got %v", err)
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	srv := servertest.Start(t, "memcache", nil).Server
+
+	l := &Listener{}
+	if err := l.Start(srv, &MemcacheCfg{Bind: "127.0.0.1:40111"}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:40111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "set foo 0 0 3 noreply\r\nbar\r\nbogus\r\nget foo\r\n")
+
+	expected := []string{"ERROR\r\n", "VALUE foo 0 3\r\n", "bar\r\n", "END\r\n"}
+	for _, e := range expected {
+		if line, _ := r.ReadString('\n'); line != e {
+			t.Fatalf("expected %q, got %q", e, line)
+		}
+	}
+}
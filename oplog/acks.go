@@ -0,0 +1,166 @@
+package oplog
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+	"sync"
+	"time"
+)
+
+// acks are kept this long after the last one arrived, long enough for any
+// writer to stop waiting for them
+const ackTTL = time.Minute
+
+// Acknowledger confirms to the node an op was written on that the op has
+// been applied, for writes that wait for their peers
+type Acknowledger interface {
+	LocalName() string // where peers send the acknowledgements of our ops
+	Acknowledge(ops []*OpLog)
+}
+
+type ackEntry struct {
+	from    map[string]bool
+	last    time.Time
+	changed chan struct{}
+}
+
+// ackTable collects the acknowledgements of ops by ID, acks may arrive
+// before the writer starts waiting for them
+type ackTable struct {
+	mtx     sync.Mutex
+	entries map[string]*ackEntry
+}
+
+// entry returns the entry for an op, t.mtx must be held
+func (t *ackTable) entry(id string) *ackEntry {
+	if t.entries == nil {
+		t.entries = map[string]*ackEntry{}
+	}
+
+	e, ok := t.entries[id]
+	if !ok {
+		e = &ackEntry{from: map[string]bool{}, last: time.Now(), changed: make(chan struct{})}
+		t.entries[id] = e
+	}
+
+	return e
+}
+
+// expire forgets old entries, t.mtx must be held
+func (t *ackTable) expire() {
+	for id, e := range t.entries {
+		if time.Since(e.last) > ackTTL {
+			delete(t.entries, id)
+		}
+	}
+}
+
+func (h *Handler) SetAcknowledger(a Acknowledger) {
+	h.acker = a
+}
+
+// Acked records that the node from has applied the ops with the given IDs
+func (h *Handler) Acked(from string, ids []string) {
+	h.acks.mtx.Lock()
+	defer h.acks.mtx.Unlock()
+
+	h.acks.expire()
+	for _, id := range ids {
+		e := h.acks.entry(id)
+		if e.from[from] {
+			continue
+		}
+
+		e.from[from] = true
+		e.last = time.Now()
+		close(e.changed)
+		e.changed = make(chan struct{})
+	}
+}
+
+// WaitAcks waits until n peers have applied the op or the timeout passes,
+// it returns the number of peers that did, acks arriving later are ignored
+func (h *Handler) WaitAcks(id string, n int, timeout time.Duration) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	defer h.forgetAcks(id)
+
+	for {
+		h.acks.mtx.Lock()
+		e := h.acks.entry(id)
+		got, changed := len(e.from), e.changed
+		h.acks.mtx.Unlock()
+
+		if got >= n {
+			return got
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return got
+		}
+	}
+}
+
+func (h *Handler) forgetAcks(id string) {
+	h.acks.mtx.Lock()
+	defer h.acks.mtx.Unlock()
+
+	delete(h.acks.entries, id)
+}
+
+// AddTracked is AddWithContext returning the committed op, if ack is set
+// peers confirm when they have applied it, see WaitAcks
+func (h *Handler) AddTracked(ns string, key string, value []byte, mType string, ctx crdt.VersionVector, ack bool) (*OpLog, error) {
+	op := NewOp(key, value, ADD, mType)
+	op.Namespace = ns
+	op.Context = ctx
+	return h.submitTracked(op, ack)
+}
+
+// RemoveTracked is RemoveNS returning the committed op, if ack is set peers
+// confirm when they have applied it, see WaitAcks
+func (h *Handler) RemoveTracked(ns string, key string, ack bool) (*OpLog, error) {
+	op := NewOp(key, nil, REM, "")
+	op.Namespace = ns
+	return h.submitTracked(op, ack)
+}
+
+// RemovePrefixTracked removes every key starting with prefix as a single op
+// and returns the committed op, its Observed field holds the keys removed
+func (h *Handler) RemovePrefixTracked(ns string, prefix string, ack bool) (*OpLog, error) {
+	op := NewOp(prefix, nil, REMPREFIX, "")
+	op.Namespace = ns
+	return h.submitTracked(op, ack)
+}
+
+func (h *Handler) submitTracked(op *OpLog, ack bool) (*OpLog, error) {
+	if ack && h.acker != nil {
+		op.AckTo = h.acker.LocalName()
+	}
+
+	if err := h.submit(op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// acknowledge confirms the applied ops that were written on other nodes and
+// asked for it
+func (h *Handler) acknowledge(ops []*OpLog) {
+	if h.acker == nil {
+		return
+	}
+
+	out := make([]*OpLog, 0)
+	for _, op := range ops {
+		if op.AckTo != "" && h.foreign(op) {
+			out = append(out, op)
+		}
+	}
+
+	if len(out) > 0 {
+		h.acker.Acknowledge(out)
+	}
+}
@@ -0,0 +1,193 @@
+package oplog
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCausalTimeout is how long an op waits for the ops it depends on,
+	// after that it is applied anyway so a lost op can't stall a node forever
+	DefaultCausalTimeout = 10 * time.Second
+	maxHeld              = 10000
+	clockPollInterval    = 10 * time.Millisecond
+)
+
+type heldOp struct {
+	op    *OpLog
+	since time.Time
+}
+
+// causalBuffer holds ops from other nodes until everything they depend on
+// has been applied, e.g. a REM made after seeing an ADD waits for the ADD
+type causalBuffer struct {
+	mtx     sync.Mutex
+	held    []*heldOp
+	timeout time.Duration
+}
+
+// SetCausalTimeout sets how long ops wait for their dependencies
+func (h *Handler) SetCausalTimeout(d time.Duration) {
+	h.causal.mtx.Lock()
+	defer h.causal.mtx.Unlock()
+
+	h.causal.timeout = d
+}
+
+// Held returns the number of ops waiting for their dependencies
+func (h *Handler) Held() int {
+	h.causal.mtx.Lock()
+	defer h.causal.mtx.Unlock()
+
+	return len(h.causal.held)
+}
+
+// foreign checks if an op was made on another node, ops from older nodes
+// carry no origin and are applied as they come
+func (h *Handler) foreign(op *OpLog) bool {
+	if op.Origin == "" {
+		return false
+	}
+
+	self, err := h.db.NodeID()
+	return err != nil || op.Origin != self
+}
+
+// ready checks if everything an op depends on has been applied
+func ready(clock crdt.VersionVector, op *OpLog) bool {
+	if clock[op.Origin]+1 < op.Seq {
+		return false
+	}
+
+	for node, seq := range op.Deps {
+		if node != op.Origin && clock[node] < seq {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deliver applies the ops, and any held ops, whose dependencies are met in
+// causal order, and holds the rest
+func (h *Handler) deliver(ops []*OpLog) {
+	h.causal.mtx.Lock()
+	defer h.causal.mtx.Unlock()
+
+	now := time.Now()
+	for _, op := range ops {
+		h.causal.held = append(h.causal.held, &heldOp{op: op, since: now})
+	}
+
+	if len(h.causal.held) == 0 {
+		return
+	}
+
+	clock, err := h.db.Clock()
+	if err != nil {
+		log.Error("failed to read the clock, applying ops as they come: ", err)
+		clock = nil
+	}
+
+	timeout := h.causal.timeout
+	if timeout <= 0 {
+		timeout = DefaultCausalTimeout
+	}
+
+	// lower sequence numbers first, so a run of ops from one node is
+	// released in a single pass
+	sort.SliceStable(h.causal.held, func(i, j int) bool {
+		return h.causal.held[i].op.Seq < h.causal.held[j].op.Seq
+	})
+
+	release := make([]*OpLog, 0)
+	for progress := true; progress; {
+		progress = false
+		waiting := h.causal.held[:0]
+		for _, ho := range h.causal.held {
+			op := ho.op
+			switch {
+			case clock == nil || op.Origin == "" || ready(clock, op):
+			case now.Sub(ho.since) > timeout || len(h.causal.held) > maxHeld:
+				log.Warn("op ", op.ID, " is missing dependencies, applying it anyway")
+			default:
+				waiting = append(waiting, ho)
+				continue
+			}
+
+			release = append(release, op)
+			if clock != nil && clock[op.Origin] < op.Seq {
+				clock[op.Origin] = op.Seq
+			}
+			progress = true
+		}
+		h.causal.held = waiting
+	}
+
+	if len(release) > 0 {
+		h.applyBatch(release)
+	}
+}
+
+// expireHeld makes sure held ops are applied once they time out, even if no
+// other op arrives
+func (h *Handler) expireHeld(kill chan struct{}) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			h.deliver(nil)
+		case <-kill:
+			return
+		}
+	}
+}
+
+// Token returns the causal past of a committed local op, a node that has
+// applied everything in it has applied the op too
+func (op *OpLog) Token() crdt.VersionVector {
+	t := op.Deps.Copy()
+	if op.Origin != "" && t[op.Origin] < op.Seq {
+		t[op.Origin] = op.Seq
+	}
+
+	return t
+}
+
+// WaitFor waits until every op covered by token has been applied here, it
+// returns false if that doesn't happen within timeout. An op applied ahead of
+// one it didn't depend on doesn't count until the gap is filled
+func (h *Handler) WaitFor(token crdt.VersionVector, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		clock, err := h.db.Contiguous()
+		if err != nil {
+			return false, err
+		}
+
+		if clock.Descends(token) {
+			return true, nil
+		}
+
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(clockPollInterval)
+	}
+}
+
+// Position returns how many ops this node has applied without gaps, from
+// every origin, it only ever grows
+func (h *Handler) Position() (uint64, error) {
+	clock, err := h.db.Contiguous()
+	if err != nil {
+		return 0, err
+	}
+
+	return clock.Sum(), nil
+}
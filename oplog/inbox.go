@@ -0,0 +1,149 @@
+package oplog
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInboxSize  = 4096
+	DefaultInboxBatch = 128
+	maxGaps           = 10000
+	gapTTL            = 10 * time.Minute
+)
+
+// ErrBackpressure is returned when an op can't be queued because the
+// receiver is not keeping up
+var ErrBackpressure = errors.New("receiver is busy, op not queued")
+
+// Inbox is a bounded queue of ops received from peers. When it is full new
+// ops are refused rather than blocking the transport, and the IDs of ops that
+// were gossiped but refused are kept as gaps so they can be fetched again
+type Inbox struct {
+	ops     chan *OpLog
+	batch   int
+	mtx     sync.Mutex
+	gaps    map[string]time.Time
+	dropped uint64
+}
+
+// InboxStats describes how far behind the inbox is
+type InboxStats struct {
+	Queued   int
+	Capacity int
+	Dropped  uint64 // ops refused since the start
+	Gaps     int    // refused ops that have not been received since
+	Held     int    // ops waiting for the ops they depend on
+}
+
+func NewInbox(size, batch int) *Inbox {
+	if size <= 0 {
+		size = DefaultInboxSize
+	}
+
+	if batch <= 0 {
+		batch = DefaultInboxBatch
+	}
+
+	return &Inbox{
+		ops:   make(chan *OpLog, size),
+		batch: batch,
+		gaps:  map[string]time.Time{},
+	}
+}
+
+// Offer queues an op without blocking, it returns false if the inbox is full
+func (i *Inbox) Offer(op *OpLog) bool {
+	select {
+	case i.ops <- op:
+		i.mtx.Lock()
+		delete(i.gaps, op.ID)
+		i.mtx.Unlock()
+		return true
+	default:
+		i.mtx.Lock()
+		i.dropped++
+		i.mtx.Unlock()
+		return false
+	}
+}
+
+// OfferOrRecord queues an op, if the inbox is full the op ID is recorded as
+// a gap to be fetched from peers once the inbox has drained
+func (i *Inbox) OfferOrRecord(op *OpLog) bool {
+	if i.Offer(op) {
+		return true
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if len(i.gaps) < maxGaps {
+		i.gaps[op.ID] = time.Now()
+	}
+
+	return false
+}
+
+// Busy signals backpressure, senders should hold back while the inbox is
+// more than three quarters full
+func (i *Inbox) Busy() bool {
+	return len(i.ops)*4 > cap(i.ops)*3
+}
+
+// Gaps returns the IDs of refused ops that have not arrived since, gaps that
+// are too old to be fetched are forgotten, those ops only come back on rejoin
+func (i *Inbox) Gaps() []string {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	ids := make([]string, 0, len(i.gaps))
+	for id, at := range i.gaps {
+		if time.Since(at) > gapTTL {
+			log.Warn("giving up on resyncing op ", id)
+			delete(i.gaps, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func (i *Inbox) Stats() InboxStats {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return InboxStats{
+		Queued:   len(i.ops),
+		Capacity: cap(i.ops),
+		Dropped:  i.dropped,
+		Gaps:     len(i.gaps),
+	}
+}
+
+// next blocks for the next op and returns it with whatever else is queued, up
+// to the batch size, it returns nil if kill fires first
+func (i *Inbox) next(kill chan struct{}) []*OpLog {
+	var ops []*OpLog
+	select {
+	case op := <-i.ops:
+		ops = append(ops, op)
+	case <-kill:
+		return nil
+	}
+
+	for len(ops) < i.batch {
+		select {
+		case op := <-i.ops:
+			ops = append(ops, op)
+		default:
+			return ops
+		}
+	}
+
+	return ops
+}
@@ -3,12 +3,14 @@ package oplog
 import (
 	"fmt"
 	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/acl"
 	"github.com/lonelycode/yzma/db"
 	"github.com/lonelycode/yzma/logger"
 	"github.com/lonelycode/yzma/types/bcaster"
 	"github.com/lonelycode/yzma/types/crdt"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,8 +20,19 @@ var idGen = crdt.UniqueIDGUIDer{}
 type Opn string
 
 const (
-	ADD Opn = "ADD"
-	REM Opn = "REM"
+	ADD      Opn = "ADD"
+	REM      Opn = "REM"
+	NSCREATE Opn = "NSCREATE"
+	NSDROP   Opn = "NSDROP"
+	ACLSET   Opn = "ACLSET"
+	ACLDEL   Opn = "ACLDEL"
+	INCR     Opn = "INCR"
+	DECR     Opn = "DECR"
+	SADD     Opn = "SADD"
+	SREM     Opn = "SREM"
+	DOCPATCH Opn = "DOCPATCH"
+	// REMPREFIX removes every key starting with Key as a single op
+	REMPREFIX Opn = "REMPREFIX"
 )
 
 type Replicator interface {
@@ -36,44 +49,133 @@ func (r *InAppReplicator) Send(op *OpLog) error {
 		case r.Buffer <- op:
 			// ok
 		default:
-			// jump
+			return ErrBackpressure
 		}
 	}
 
 	return nil
 }
 
+// Persister is a Replicator that durably queues ops for its peers, Persist
+// runs in the transaction that applies an op, so an applied op is never
+// missing from the queue
+type Persister interface {
+	Persist(tx *db.DB, op *OpLog) error
+}
+
+// Outbox durably queues an encoded op until every peer has acknowledged it,
+// the op is queued in tx
+type Outbox interface {
+	Push(tx *db.DB, id string, msg []byte) error
+}
+
 type PeeringReplicator struct {
-	Queue *memberlist.TransmitLimitedQueue
+	Queue    *memberlist.TransmitLimitedQueue
+	Outbox   Outbox
+	Compress func(msg []byte) []byte // compresses gossiped messages, optional
+
+	// messages larger than this are only delivered by the outbox, gossip
+	// can't carry them, zero gossips every message
+	MaxBroadcast int
 }
 
+// Send gossips an op, the outbox delivers it to the peers that miss it
 func (r *PeeringReplicator) Send(op *OpLog) error {
+	if r.Queue == nil {
+		return nil
+	}
+
 	msg, err := db.Encode(op)
 	if err != nil {
 		return err
 	}
 
-	if r.Queue != nil {
+	if r.Compress != nil {
+		msg = r.Compress(msg)
+	}
+
+	if r.Outbox == nil || r.MaxBroadcast == 0 || len(msg) <= r.MaxBroadcast {
 		r.Queue.QueueBroadcast(&bcaster.Broadcast{Msg: msg, Notify: nil})
 	}
 
 	return nil
 }
 
+// Persist queues an op in the outbox
+func (r *PeeringReplicator) Persist(tx *db.DB, op *OpLog) error {
+	if r.Outbox == nil {
+		return nil
+	}
+
+	msg, err := db.Encode(op)
+	if err != nil {
+		return err
+	}
+
+	return r.Outbox.Push(tx, op.ID, msg)
+}
+
 type OpLog struct {
-	ID           string        // Operation ID, sortable
-	KID          string        // The actual ID that is written Buffer the DB on ADD
-	Key          string        // The key used in the interface
-	Op           Opn           // The operation (Add, remove etc.
-	Value        *crdt.TSValue // What Buffer store
+	ID           string              // Operation ID, sortable
+	KID          string              // The actual ID that is written Buffer the DB on ADD
+	Key          string              // The key used in the interface
+	Op           Opn                 // The operation (Add, remove etc.
+	Value        *crdt.TSValue       // What Buffer store
+	Namespace    string              // The namespace the key lives in, empty for the default
+	Delta        int64               // Amount to change a counter by, only set locally
+	Counter      *crdt.CounterState  // The new counter state of the origin node
+	Member       string              // The set member of SADD and SREM
+	Tags         []string            // The new tag of an SADD, the observed tags of an SREM or REM, or the token hashes an ACLSET replaces
+	Fields       crdt.ORMap          // The field registers changed by a DOCPATCH
+	Observed     map[string][]string // The keys and value IDs removed by a REMPREFIX
+	Context      crdt.VersionVector  // The client's read context of an ADD
+	Origin       string              // The node ID of the node the op was made on
+	Seq          uint64              // The position of the op in the origin's sequence
+	Deps         crdt.VersionVector  // The ops the origin had applied from every node when it made the op
+	AckTo        string              // The node to confirm the op was applied to, for writes with a write concern
 	IsFromRemote bool
+	done         chan error // Receives the result of the op once it is committed
+	removed      int        // The keys with a live value a local REMPREFIX removed
+	index        uint64     // The commit index of the op on this node
+}
+
+// complete reports the result of an op to whoever submitted or tracked it,
+// only the first result is kept
+func (op *OpLog) complete(err error) {
+	if op.done == nil {
+		return
+	}
+
+	select {
+	case op.done <- err:
+	default:
+	}
+}
+
+// CommitIndex returns the commit index the op got on this node, see
+// Handler.CommitIndex
+func (op *OpLog) CommitIndex() uint64 {
+	return op.index
+}
+
+// Removed returns how many keys that had a live value a REMPREFIX made on
+// this node removed
+func (op *OpLog) Removed() int {
+	return op.removed
+}
+
+// Track returns a channel that receives the result of an op received from a
+// peer once it has been committed, duplicates are reported as committed
+func (op *OpLog) Track() <-chan error {
+	op.done = make(chan error, 1)
+	return op.done
 }
 
 func NewOp(key string, value []byte, opn Opn, mType string) *OpLog {
 	ts := time.Now().UnixNano()
 	opId := fmt.Sprintf("%s.%s.%s", strconv.Itoa(int(ts)), string(opn), key)
 	vId := idGen.ValueID(nil)
-	kId := fmt.Sprintf("%s.%s.%s", strings.ToLower(string(opn)), key, vId)
+	kId := db.AddKey(key, vId)
 
 
 
@@ -87,89 +189,400 @@ func NewOp(key string, value []byte, opn Opn, mType string) *OpLog {
 }
 
 type Handler struct {
-	commitChan  chan *OpLog
-	replicaChan chan *OpLog
-	db          *db.DB
-	rep         Replicator
-	killChans   []chan struct{}
+	commitChan chan *OpLog
+	inbox      *Inbox
+	db         *db.DB
+	rep        Replicator
+	retention  time.Duration
+	killChans  []chan struct{}
+	workers    sync.WaitGroup
+	causal     causalBuffer
+	acker      Acknowledger
+	acks       ackTable
+	watches    watchTable
+	commitMtx  sync.Mutex
+	commits    uint64 // the commit index, updated atomically
 }
 
+// DefaultRetention is how long the IDs of applied ops are kept to detect
+// duplicates, ops replayed after that are applied again
+const DefaultRetention = 7 * 24 * time.Hour
+
 func (h *Handler) SetProcessChannel(ch chan *OpLog) {
 	h.commitChan = ch
 }
 
-func (h *Handler) SetReplicaChannel(ch chan *OpLog) {
-	h.replicaChan = ch
+// SetInbox sets the queue ops received from peers are applied from
+func (h *Handler) SetInbox(in *Inbox) {
+	h.inbox = in
+}
+
+func (h *Handler) InboxStats() InboxStats {
+	st := InboxStats{}
+	if h.inbox != nil {
+		st = h.inbox.Stats()
+	}
+
+	st.Held = h.Held()
+	return st
 }
 
 func (h *Handler) SetReplicator(rep Replicator) {
 	h.rep = rep
 }
 
-func (h *Handler) start(kill chan struct{}) {
+// SetRetention sets how long applied op IDs are kept, zero keeps them forever
+func (h *Handler) SetRetention(d time.Duration) {
+	h.retention = d
+}
+
+func (h *Handler) prune(kill chan struct{}) {
+	tick := time.NewTicker(time.Hour)
+	defer tick.Stop()
+
 	for {
 		select {
-		case op := <-h.commitChan:
-			err := h.processOp(op)
+		case <-tick.C:
+			n, err := h.db.PruneApplied(time.Now().Add(-h.retention))
 			if err != nil {
-				log.Error(err)
+				log.Error("failed to prune applied ops: ", err)
+				continue
 			}
+			log.Debug("pruned ", n, " applied ops")
 		case <-kill:
-			break
+			return
 		}
 	}
 }
 
-func (h *Handler) startReplChan(kill chan struct{}) {
+func (h *Handler) start(kill chan struct{}) {
 	for {
 		select {
-		case op := <-h.replicaChan:
-			op.IsFromRemote = true
+		case op := <-h.commitChan:
+			// ops replayed from a peer's oplog wait for their dependencies too
+			if h.foreign(op) {
+				h.deliver([]*OpLog{op})
+				continue
+			}
+
 			err := h.processOp(op)
 			if err != nil {
 				log.Error(err)
 			}
+			op.complete(err)
 		case <-kill:
-			break
+			return
 		}
+	}
+}
 
+func (h *Handler) startInbox(kill chan struct{}) {
+	for {
+		ops := h.inbox.next(kill)
+		if ops == nil {
+			return
+		}
+
+		for _, op := range ops {
+			op.IsFromRemote = true
+		}
+		h.deliver(ops)
 	}
 }
 
+// applyBatch applies ops in a single transaction, if one of them fails the
+// batch is rolled back and the ops are applied one by one, so only the
+// failing op is lost
+func (h *Handler) applyBatch(ops []*OpLog) {
+	applied, err := h.commit(ops)
+	if err == nil {
+		for _, op := range applied {
+			if !op.IsFromRemote {
+				h.replicate(op)
+			}
+		}
+
+		// duplicates are confirmed too, the first ack may have been lost
+		h.acknowledge(ops)
+		for _, op := range ops {
+			op.complete(nil)
+		}
+		return
+	}
+
+	done := make([]*OpLog, 0, len(ops))
+	for _, op := range ops {
+		err := h.processOp(op)
+		op.complete(err)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		done = append(done, op)
+	}
+	h.acknowledge(done)
+}
+
 func (h *Handler) processOp(op *OpLog) error {
+	applied, err := h.commit([]*OpLog{op})
+
+	// duplicates have been replicated when they were first applied
+	if err != nil || len(applied) == 0 {
+		return err
+	}
+
+	// don't replicate oplogs from remotes
+	if !op.IsFromRemote {
+		h.replicate(op)
+	}
+
+	return nil
+}
+
+// commit applies ops in a single transaction and returns the ones that were
+// not applied before, local ops are written to the oplog and the outbox in
+// the same transaction. Commits are serialized so the watches are notified in
+// the order the ops were committed
+func (h *Handler) commit(ops []*OpLog) ([]*OpLog, error) {
+	h.commitMtx.Lock()
+	defer h.commitMtx.Unlock()
+
+	applied := make([]*OpLog, 0, len(ops))
+	err := h.db.Batch(func(tx *db.DB) error {
+		applied = applied[:0]
+		for _, op := range ops {
+			ok, err := h.applyOnce(tx, op)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				continue
+			}
+
+			if !op.IsFromRemote {
+				if err := h.persist(tx, op); err != nil {
+					return err
+				}
+			}
+			applied = append(applied, op)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range applied {
+		op.index = atomic.AddUint64(&h.commits, 1)
+	}
+
+	h.notify(applied)
+	return applied, nil
+}
+
+// CommitIndex counts the ops committed on this node, starting from the
+// position the handler started at. Unlike the position it grows with every
+// op, including ops applied before the ones they follow.
+func (h *Handler) CommitIndex() uint64 {
+	return atomic.LoadUint64(&h.commits)
+}
+
+// applyOnce applies an op unless it has been applied before, it returns false
+// for duplicates
+func (h *Handler) applyOnce(d *db.DB, op *OpLog) (bool, error) {
+	done, err := d.Applied(op.ID)
+	if err != nil || done {
+		return false, err
+	}
+
+	if op.Origin == "" && !op.IsFromRemote {
+		if err := h.stamp(d, op); err != nil {
+			return false, err
+		}
+	}
+
+	if err := h.apply(d, op); err != nil {
+		return false, err
+	}
+
+	if op.Origin != "" {
+		if err := d.Advance(op.Origin, op.Seq); err != nil {
+			return false, err
+		}
+	}
+
+	return true, d.MarkApplied(op.ID)
+}
+
+// stamp makes a local op the next in this node's sequence, the ID is made
+// from the origin and sequence number so it is unique across the cluster
+func (h *Handler) stamp(d *db.DB, op *OpLog) error {
+	var err error
+	op.Origin, op.Seq, op.Deps, err = d.NextSeq()
+	if err != nil {
+		return err
+	}
+
+	op.ID = fmt.Sprintf("%d.%s.%d", op.Value.TS, op.Origin, op.Seq)
+	return nil
+}
+
+func (h *Handler) apply(d *db.DB, op *OpLog) error {
 	var err error
 	switch op.Op {
 	case ADD:
-		err = h.db.AddOp(op.KID, op.Value)
+		if err = h.version(d, op); err != nil {
+			break
+		}
+		err = d.AddOpNS(op.Namespace, op.KID, op.Value)
 	case REM:
-		err = h.db.Remove(op.Key)
+		err = h.remove(d, op)
+	case REMPREFIX:
+		err = h.removePrefix(d, op)
+	case NSCREATE:
+		err = d.CreateNamespace(op.Namespace)
+	case NSDROP:
+		err = d.DropNamespace(op.Namespace)
+	case ACLSET, ACLDEL:
+		err = h.putACL(d, op)
+	case INCR, DECR:
+		err = h.applyCounter(d, op)
+	case SADD:
+		for _, tag := range op.Tags {
+			if err = d.SetAdd(op.Key, op.Member, tag); err != nil {
+				break
+			}
+		}
+	case SREM:
+		err = d.SetRemove(op.Key, op.Member, op.Tags)
+	case DOCPATCH:
+		err = d.PatchDoc(op.Key, op.Fields)
 	default:
 		return fmt.Errorf("operation %s not supported", op.Op)
 	}
 
+	return err
+}
+
+// putACL stores the ACL of an op and tombstones the replaced token hashes it
+// carries in Tags
+func (h *Handler) putACL(d *db.DB, op *OpLog) error {
+	for _, hash := range op.Tags {
+		if err := d.PutACL(hash, &crdt.TSValue{TS: op.Value.TS}); err != nil {
+			return err
+		}
+	}
+
+	return d.PutACL(op.Key, op.Value)
+}
+
+// remove tombstones the values the origin of a REM observed, REMs from older
+// nodes don't carry them and remove everything this node has
+func (h *Handler) remove(d *db.DB, op *OpLog) error {
+	if op.Tags == nil && !op.IsFromRemote {
+		tags, err := d.Observed(op.Namespace, op.Key)
+		if err != nil {
+			return err
+		}
+		op.Tags = tags
+	}
+
+	if op.Tags == nil {
+		return d.RemoveNS(op.Namespace, op.Key)
+	}
+
+	return d.RemoveObservedNS(op.Namespace, op.Key, op.Tags)
+}
+
+// removePrefix tombstones the values of every key a REMPREFIX observed, the
+// origin records them when it applies the op so every replica removes the
+// same values
+func (h *Handler) removePrefix(d *db.DB, op *OpLog) error {
+	if op.Observed == nil && !op.IsFromRemote {
+		observed, err := d.ObservedPrefix(op.Namespace, op.Key)
+		if err != nil {
+			return err
+		}
+		op.Observed = observed
+
+		// expired values are removed too, but reads didn't see their keys
+		live, err := d.Keys(op.Namespace, op.Key)
+		if err != nil {
+			return err
+		}
+		op.removed = len(live)
+	}
+
+	return d.RemoveObservedKeys(op.Namespace, op.Observed)
+}
+
+// version sets the version vector of a local write, remote writes arrive
+// with theirs already set
+func (h *Handler) version(d *db.DB, op *OpLog) error {
+	if op.Value.VV != nil {
+		return nil
+	}
+
+	node, err := d.NodeID()
 	if err != nil {
 		return err
 	}
 
-	// don't replicate oplogs from remotes
-	if op.IsFromRemote {
-		return nil
+	op.Value.VV, err = d.NextVersion(op.Namespace, op.Key, node, op.Context)
+	return err
+}
+
+// applyCounter turns a counter delta into the new state of this node, which
+// is what gets replicated, so that applying an op twice is harmless
+func (h *Handler) applyCounter(d *db.DB, op *OpLog) error {
+	if op.Counter != nil {
+		return d.MergeCounter(op.Key, op.Counter)
+	}
+
+	by := op.Delta
+	if op.Op == DECR {
+		by = -by
+	}
+
+	state, err := d.IncrCounter(op.Key, by)
+	if err != nil {
+		return err
 	}
 
-	return h.replicate(op)
+	op.Counter = state
+	return nil
 }
 
-func (h *Handler) replicate(op *OpLog) error {
+// persist writes a local op to the oplog and queues it for the peers, in the
+// transaction that applies it
+func (h *Handler) persist(tx *db.DB, op *OpLog) error {
 	if h.rep == nil {
 		return nil
 	}
 
-	err := h.db.StoreOpLog(op.ID, op)
-	if err != nil {
+	if err := tx.StoreOpLog(op.ID, op); err != nil {
 		return err
 	}
 
-	return h.rep.Send(op)
+	if p, ok := h.rep.(Persister); ok {
+		return p.Persist(tx, op)
+	}
+
+	return nil
+}
+
+// replicate sends a committed op to the peers, peers that miss it get it
+// from the outbox or the oplog
+func (h *Handler) replicate(op *OpLog) {
+	if h.rep == nil {
+		return
+	}
+
+	if err := h.rep.Send(op); err != nil {
+		log.Error("failed to replicate op ", op.ID, ": ", err)
+	}
 }
 
 func (h *Handler) Start(db *db.DB) {
@@ -181,43 +594,207 @@ func (h *Handler) Start(db *db.DB) {
 		h.db = db
 	}
 
+	pos, err := h.Position()
+	if err != nil {
+		log.Error("failed to read the position, commit indexes start at zero: ", err)
+	}
+	atomic.StoreUint64(&h.commits, pos)
+
 	workers := 1
 	h.killChans = make([]chan struct{}, 0)
 	for i := 0; i <= workers; i++ {
-		readCh := make(chan struct{})
-		h.killChans = append(h.killChans, readCh)
-		go h.start(readCh)
-		if h.rep != nil {
-			replKChan := make(chan struct{})
-			h.killChans = append(h.killChans, replKChan)
-			go h.startReplChan(replKChan)
+		h.spawn(h.start)
+		if h.inbox != nil {
+			h.spawn(h.startInbox)
 		}
 	}
 
+	h.spawn(h.expireHeld)
+	if h.retention > 0 {
+		h.spawn(h.prune)
+	}
+
 }
 
+// spawn runs a worker until its kill channel is closed
+func (h *Handler) spawn(worker func(kill chan struct{})) {
+	kill := make(chan struct{})
+	h.killChans = append(h.killChans, kill)
+	h.workers.Add(1)
+	go func() {
+		defer h.workers.Done()
+		worker(kill)
+	}()
+}
+
+// Stop stops the workers and waits for them to finish what they are doing
 func (h *Handler) Stop() {
 	log.Infof("stopping %v workers", len(h.killChans))
 	for _, ch := range h.killChans {
-		select {
-		case ch <- struct{}{}:
-		default:
+		close(ch)
+	}
+	h.killChans = nil
+	h.workers.Wait()
+}
 
-		}
+// submit queues a local op and waits until it has been committed, or has
+// failed to commit
+func (h *Handler) submit(op *OpLog) error {
+	op.done = make(chan error, 1)
+	h.commitChan <- op
+	if err := <-op.done; err != nil {
+		return &CommitError{Op: op.ID, Err: err}
 	}
+
+	return nil
+}
+
+// CommitError is returned when a valid op could not be written to the DB
+type CommitError struct {
+	Op  string
+	Err error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("failed to commit op %s: %v", e.Op, e.Err)
 }
 
-func (h *Handler) Add(key string, value []byte, mType string) {
+func (h *Handler) Add(key string, value []byte, mType string) error {
 	op := NewOp(key, value, ADD, mType)
-	h.commitChan <- op
+	return h.submit(op)
 }
 
-func (h *Handler) Remove(key string) {
+func (h *Handler) Remove(key string) error {
 	op := NewOp(key, nil, REM, "")
-	h.commitChan <- op
+	return h.submit(op)
+}
+
+func (h *Handler) AddNS(ns string, key string, value []byte, mType string) error {
+	return h.AddWithContext(ns, key, value, mType, nil)
+}
+
+// AddWithContext writes a value that supersedes the values the client read
+// with the context ctx
+func (h *Handler) AddWithContext(ns string, key string, value []byte, mType string, ctx crdt.VersionVector) error {
+	op := NewOp(key, value, ADD, mType)
+	op.Namespace = ns
+	op.Context = ctx
+	return h.submit(op)
+}
+
+// AddExpiring writes a value that reads stop returning once ttl has passed,
+// ctx is the client's read context as for AddWithContext
+func (h *Handler) AddExpiring(ns string, key string, value []byte, mType string, ctx crdt.VersionVector, ttl time.Duration) error {
+	op := NewOp(key, value, ADD, mType)
+	op.Namespace = ns
+	op.Context = ctx
+	op.Value.Expires = op.Value.TS + int64(ttl)
+	return h.submit(op)
+}
+
+func (h *Handler) RemoveNS(ns string, key string) error {
+	op := NewOp(key, nil, REM, "")
+	op.Namespace = ns
+	return h.submit(op)
+}
+
+func (h *Handler) CreateNamespace(ns string) error {
+	op := NewOp("", nil, NSCREATE, "")
+	op.Namespace = ns
+	return h.submit(op)
+}
+
+func (h *Handler) DropNamespace(ns string) error {
+	op := NewOp("", nil, NSDROP, "")
+	op.Namespace = ns
+	return h.submit(op)
+}
+
+// SetACL stores the ACL of a principal, the ACLs this node has for the
+// principal's other tokens are removed by the same op, so an old token stops
+// working once the new one is set
+func (h *Handler) SetACL(a *acl.ACL) error {
+	enc, err := db.Encode(a)
+	if err != nil {
+		return err
+	}
+
+	acls, err := h.db.ACLs()
+	if err != nil {
+		return err
+	}
+
+	op := NewOp(a.TokenHash, enc, ACLSET, "")
+	for _, ex := range acls {
+		if ex.Principal == a.Principal && ex.TokenHash != a.TokenHash {
+			op.Tags = append(op.Tags, ex.TokenHash)
+		}
+	}
+
+	return h.submit(op)
+}
+
+func (h *Handler) DeleteACL(tokenHash string) error {
+	return h.submit(NewOp(tokenHash, nil, ACLDEL, ""))
+}
+
+func (h *Handler) Incr(key string, by int64) error {
+	op := NewOp(key, nil, INCR, "")
+	op.Delta = by
+	return h.submit(op)
+}
+
+func (h *Handler) Decr(key string, by int64) error {
+	op := NewOp(key, nil, DECR, "")
+	op.Delta = by
+	return h.submit(op)
+}
+
+func (h *Handler) SetAdd(key, member string) error {
+	op := NewOp(key, nil, SADD, "")
+	op.Member = member
+	op.Tags = []string{idGen.ValueID(nil)}
+	return h.submit(op)
+}
+
+// SetRemove removes the adds of member this node has observed, adds that
+// happen concurrently on other nodes are kept
+func (h *Handler) SetRemove(key, member string) error {
+	tags, err := h.db.SetTags(key, member)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	op := NewOp(key, nil, SREM, "")
+	op.Member = member
+	op.Tags = tags
+	return h.submit(op)
+}
+
+// PatchDoc applies a JSON merge patch to a document
+func (h *Handler) PatchDoc(key string, patch []byte) error {
+	node, err := h.db.NodeID()
+	if err != nil {
+		return err
+	}
+
+	op := NewOp(key, nil, DOCPATCH, "")
+	op.Fields, err = crdt.FromMergePatch(patch, op.Value.TS, node)
+	if err != nil {
+		return err
+	}
+
+	return h.submit(op)
 }
 
+// Replicate applies an op replayed from a peer's oplog, it is handled like
+// any other op received from a peer: never restamped or replicated again
 func (h *Handler) Replicate(op *OpLog) {
+	op.IsFromRemote = true
 	h.commitChan <- op
 }
 
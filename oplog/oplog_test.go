@@ -1,10 +1,13 @@
 package oplog
 
 import (
+	"errors"
+	"github.com/hashicorp/memberlist"
 	"github.com/lonelycode/yzma/db"
 	"github.com/lonelycode/yzma/types/crdt"
 	"github.com/satori/go.uuid"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -108,3 +111,714 @@ func TestDB_AddAddRemoveContains(t *testing.T) {
 	}
 }
 
+func TestCounterConvergence(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+
+	b1 := make(chan *OpLog, 100)
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: b1})
+	h1.Start(d1)
+
+	b2 := make(chan *OpLog, 100)
+	h2 := &Handler{}
+	h2.SetReplicator(&InAppReplicator{Buffer: b2})
+	h2.Start(d2)
+
+	for i := 0; i < 10; i++ {
+		h1.Incr("hits", 2)
+		h2.Incr("hits", 1)
+		h2.Decr("hits", 1)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// deliver everything twice, re-delivery must not count twice
+	deliver := func(from chan *OpLog, to *Handler) {
+		ops := make([]*OpLog, 0)
+		for len(from) > 0 {
+			ops = append(ops, <-from)
+		}
+
+		for i := 0; i < 2; i++ {
+			for _, op := range ops {
+				op.IsFromRemote = true
+				if err := to.processOp(op); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	deliver(b1, h2)
+	deliver(b2, h1)
+
+	for i, d := range []*db.DB{d1, d2} {
+		v, ok := d.Counter("hits")
+		if !ok || v != 20 {
+			t.Errorf("Expected counter on node %d to be 20, got %d (%v)", i+1, v, ok)
+		}
+	}
+}
+
+func TestMultiValueRegister(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+
+	d1.Options.CollisionStrategy = crdt.MVRStrat
+	d2.Options.CollisionStrategy = crdt.MVRStrat
+
+	b1 := make(chan *OpLog, 10)
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: b1})
+	h1.Start(d1)
+
+	h2 := &Handler{}
+	h2.SetReplicator(&InAppReplicator{Buffer: make(chan *OpLog, 10)})
+	h2.Start(d2)
+
+	// a node overwriting its own value leaves no siblings
+	h2.Add("cart", []byte("a"), "")
+	time.Sleep(50 * time.Millisecond)
+	h2.Add("cart", []byte("b"), "")
+
+	// a concurrent write on another node is kept as a sibling
+	h1.Add("cart", []byte("c"), "")
+	time.Sleep(50 * time.Millisecond)
+
+	op := <-b1
+	op.IsFromRemote = true
+	if err := h2.processOp(op); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := d2.Load("cart")
+	if len(v) != 2 {
+		t.Fatalf("Expected 2 siblings, got %v", len(v))
+	}
+
+	// writing with the read context resolves the siblings
+	h2.AddWithContext("", "cart", []byte("b+c"), "", v.Context())
+	time.Sleep(50 * time.Millisecond)
+
+	v, ok := d2.Load("cart")
+	if !ok || len(v) != 1 {
+		t.Fatalf("Expected a single value, got %v", len(v))
+	}
+
+	if d, _ := v.Extract(); string(d.([]byte)) != "b+c" {
+		t.Errorf("Expected b+c, got %s", d)
+	}
+}
+
+func TestInboxBatchesAndGaps(t *testing.T) {
+	d, err := db.NewWithStore(db.NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Options.CollisionStrategy = crdt.LWWStrat
+
+	in := NewInbox(2, 2)
+	ops := []*OpLog{
+		NewOp("a", []byte("1"), ADD, ""),
+		NewOp("b", []byte("2"), ADD, ""),
+		NewOp("c", []byte("3"), ADD, ""),
+	}
+	ops[2].ID = "gap"
+
+	for i, op := range ops {
+		if ok := in.OfferOrRecord(op); ok != (i < 2) {
+			t.Fatalf("op %d: expected accepted to be %v", i, i < 2)
+		}
+	}
+
+	if gaps := in.Gaps(); len(gaps) != 1 || gaps[0] != "gap" {
+		t.Fatalf("expected the refused op to be a gap, got %v", gaps)
+	}
+
+	if !in.Busy() {
+		t.Error("expected a full inbox to signal backpressure")
+	}
+
+	h := &Handler{}
+	h.SetInbox(in)
+	h.Start(d)
+	time.Sleep(50 * time.Millisecond)
+
+	// the op is resent by a peer and fills the gap
+	done := ops[2].Track()
+	if !in.OfferOrRecord(ops[2]) {
+		t.Fatal("expected a drained inbox to accept the op")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the op to be reported as committed")
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, ok := d.Load(k); !ok {
+			t.Errorf("expected to find %s", k)
+		}
+	}
+
+	if st := h.InboxStats(); st.Gaps != 0 || st.Dropped != 1 {
+		t.Errorf("unexpected inbox stats: %+v", st)
+	}
+
+	r := &InAppReplicator{Buffer: make(chan *OpLog, 1)}
+	r.Send(ops[0])
+	if err := r.Send(ops[1]); err != ErrBackpressure {
+		t.Errorf("expected backpressure from a full replicator, got %v", err)
+	}
+}
+
+type pushRecorder struct {
+	ids []string
+}
+
+func (p *pushRecorder) Push(tx *db.DB, id string, msg []byte) error {
+	p.ids = append(p.ids, id)
+	return nil
+}
+
+func TestLargeOpsSkipGossip(t *testing.T) {
+	small := NewOp("a", []byte("v"), ADD, "")
+	large := NewOp("b", make([]byte, 2048), ADD, "")
+
+	q := &memberlist.TransmitLimitedQueue{NumNodes: func() int { return 2 }, RetransmitMult: 1}
+	ob := &pushRecorder{}
+	r := &PeeringReplicator{Queue: q, Outbox: ob, MaxBroadcast: 1024}
+	for _, op := range []*OpLog{small, large} {
+		if err := r.Persist(nil, op); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Send(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q.NumQueued() != 1 || len(ob.ids) != 2 {
+		t.Fatalf("expected only the small op to be gossiped, %d gossiped, %d queued", q.NumQueued(), len(ob.ids))
+	}
+
+	// without a queue the large op can only be gossiped
+	q.Reset()
+	r.Outbox = nil
+	if err := r.Send(large); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.NumQueued() != 1 {
+		t.Fatal("expected the large op to be gossiped without a queue")
+	}
+}
+
+// failingStore fails every write to a bucket made in a batch
+type failingStore struct {
+	db.Store
+	bucket string
+}
+
+func (f *failingStore) Batch(fn func(b db.Batch) error) error {
+	return f.Store.Batch(func(b db.Batch) error {
+		return fn(&failingBatch{Batch: b, bucket: f.bucket})
+	})
+}
+
+type failingBatch struct {
+	db.Batch
+	bucket string
+}
+
+func (f *failingBatch) Put(bucket string, key, value []byte) error {
+	if bucket == f.bucket {
+		return errors.New("injected failure")
+	}
+
+	return f.Batch.Put(bucket, key, value)
+}
+
+func TestOpLogFailureRollsBack(t *testing.T) {
+	h, d, n := NewDB()
+	defer teardown(d, n)
+	h.SetReplicator(&InAppReplicator{})
+
+	store := d.Store
+	d.Store = &failingStore{Store: store, bucket: db.OPS}
+	if err := h.Add("k", []byte("v"), ""); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	if _, ok := d.Load("k"); ok {
+		t.Fatal("expected the failed write not to be applied")
+	}
+
+	d.Store = store
+	if err := h.Add("k", []byte("v"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Load("k"); !ok {
+		t.Fatal("expected the retried write to be applied")
+	}
+}
+
+func dump(t *testing.T, d *db.DB) map[string]string {
+	out := map[string]string{}
+	buckets := []string{db.KEYS, db.OPS, db.NAMESPACES, db.ACLS, db.META, db.COUNTERS, db.SETS, db.DOCS, db.APPLIED, "ns.tenant"}
+	for _, b := range buckets {
+		err := d.Store.Iterate(b, nil, func(k, v []byte) error {
+			out[b+"/"+string(k)] = string(v)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return out
+}
+
+func TestReplayIsIdempotent(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: make(chan *OpLog, 100)})
+	h1.Start(d1)
+
+	rep2 := &InAppReplicator{Buffer: make(chan *OpLog, 100)}
+	h2 := &Handler{}
+	h2.SetReplicator(rep2)
+	h2.Start(d2)
+
+	h1.Add("a", []byte("1"), "")
+	h1.Add("b", []byte("2"), "")
+	time.Sleep(20 * time.Millisecond)
+	h1.Remove("a")
+	h1.AddNS("tenant", "c", []byte("3"), "")
+	h1.Incr("hits", 5)
+	h1.SetAdd("tags", "x")
+	h1.PatchDoc("doc", []byte(`{"name": "yzma"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	// an op from a node that predates origins and sequence numbers
+	legacy := NewOp("legacy", []byte("old"), ADD, "")
+
+	// ops replayed on join go through Replicate, like MergeRemoteState does
+	replay := func() {
+		ids := []string{legacy.ID}
+		for _, b := range d1.OpLog("") {
+			op := &OpLog{}
+			if err := db.Decode(b, op); err != nil {
+				t.Fatal(err)
+			}
+
+			ids = append(ids, op.ID)
+			h2.Replicate(op)
+		}
+
+		old := *legacy
+		h2.Replicate(&old)
+		waitApplied(t, d2, ids)
+	}
+
+	replay()
+
+	// a write made after the remove must survive the remove being replayed
+	if err := h2.Add("a", []byte("new"), ""); err != nil {
+		t.Fatal(err)
+	}
+	<-rep2.Buffer
+
+	before := dump(t, d2)
+	replay()
+	after := dump(t, d2)
+
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("replaying the oplog again changed the DB, %d keys before, %d after", len(before), len(after))
+	}
+
+	if n := len(rep2.Buffer); n != 0 {
+		t.Errorf("expected replayed ops not to be replicated again, %d were", n)
+	}
+
+	v, ok := d2.Load("a")
+	if !ok {
+		t.Fatal("expected to find a")
+	}
+
+	if d, _ := v.Extract(); string(d.([]byte)) != "new" {
+		t.Errorf("expected new, got %s", d)
+	}
+
+	if c, _ := d2.Counter("hits"); c != 5 {
+		t.Errorf("expected the counter to be 5, got %d", c)
+	}
+
+	// the legacy op must not have been taken into the local sequence
+	self, _ := d2.NodeID()
+	if clock, _ := d2.Clock(); clock[self] != 1 {
+		t.Errorf("expected only the local write in the sequence, got %d", clock[self])
+	}
+}
+
+// waitApplied waits until every op has been applied to d
+func waitApplied(t *testing.T, d *db.DB, ids []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			done, err := d.Applied(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if done {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("op %s was not applied", id)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestCausalDelivery(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+	_, d3, n3 := NewDB()
+	defer teardown(d3, n3)
+
+	b1 := make(chan *OpLog, 10)
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: b1})
+	h1.Start(d1)
+
+	b2 := make(chan *OpLog, 10)
+	h2 := &Handler{}
+	h2.SetReplicator(&InAppReplicator{Buffer: b2})
+	h2.Start(d2)
+
+	h3 := &Handler{}
+	h3.Start(d3)
+
+	// node 2 removes a value it got from node 1
+	h1.Add("k", []byte("v"), "")
+	time.Sleep(50 * time.Millisecond)
+	add := <-b1
+	add.IsFromRemote = true
+	h2.deliver([]*OpLog{add})
+
+	h2.Remove("k")
+	time.Sleep(50 * time.Millisecond)
+	rem := <-b2
+
+	if rem.Origin == add.Origin || rem.Deps[add.Origin] != add.Seq {
+		t.Fatalf("expected the remove to depend on the add, got %v", rem.Deps)
+	}
+
+	// node 3 gets the remove first, it must wait for the add
+	rem.IsFromRemote = true
+	h3.deliver([]*OpLog{rem})
+	if h3.Held() != 1 {
+		t.Fatalf("expected the remove to be held, %d held", h3.Held())
+	}
+
+	if applied, _ := d3.Applied(rem.ID); applied {
+		t.Fatal("expected the remove not to be applied before the add")
+	}
+
+	h3.deliver([]*OpLog{add})
+	if h3.Held() != 0 {
+		t.Fatalf("expected both ops to be applied, %d held", h3.Held())
+	}
+
+	if _, ok := d3.Load("k"); ok {
+		t.Error("expected k to be removed")
+	}
+
+	clock, _ := d3.Clock()
+	if clock[add.Origin] != add.Seq || clock[rem.Origin] != rem.Seq {
+		t.Errorf("unexpected clock %v", clock)
+	}
+
+	// an op whose dependencies never arrive is applied after the timeout
+	h3.SetCausalTimeout(10 * time.Millisecond)
+	orphan := NewOp("o", []byte("v"), ADD, "")
+	orphan.Origin, orphan.Seq, orphan.IsFromRemote = "lost", 2, true
+	orphan.Value.VV = crdt.VersionVector{"lost": 2}
+	h3.deliver([]*OpLog{orphan})
+	time.Sleep(20 * time.Millisecond)
+	h3.deliver(nil)
+
+	if _, ok := d3.Load("o"); !ok {
+		t.Error("expected the orphaned op to be applied after the timeout")
+	}
+}
+
+func TestCommitIndexOutOfOrder(t *testing.T) {
+	h, d, n := NewDB()
+	defer teardown(d, n)
+	h.SetCausalTimeout(10 * time.Millisecond)
+
+	w := h.Watch("", "", 10)
+	defer h.Unwatch(w)
+
+	if err := h.Add("a", []byte("v"), ""); err != nil {
+		t.Fatal(err)
+	}
+	first := <-w.C()
+	pos, _ := h.Position()
+
+	// an op past a gap is applied once it times out, the position stays
+	orphan := NewOp("b", []byte("v"), ADD, "")
+	orphan.Origin, orphan.Seq, orphan.IsFromRemote = "lost", 2, true
+	orphan.Value.VV = crdt.VersionVector{"lost": 2}
+	h.deliver([]*OpLog{orphan})
+	second := <-w.C()
+
+	if p, _ := h.Position(); p != pos {
+		t.Fatalf("expected the position to stay at %d, got %d", pos, p)
+	}
+
+	if second.CommitIndex() != first.CommitIndex()+1 || h.CommitIndex() != second.CommitIndex() {
+		t.Fatalf("expected the commit index to grow, got %d then %d", first.CommitIndex(), second.CommitIndex())
+	}
+}
+
+func TestSynchronousWrites(t *testing.T) {
+	handler, d, n := NewDB()
+	defer teardown(d, n)
+
+	// no sleep, the write is committed when Add returns
+	if err := handler.Add("sync", []byte("foo"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Load("sync"); !ok {
+		t.Fatal("expected the write to be visible once acknowledged")
+	}
+
+	// bolt refuses keys over 32KB, the failure must reach the caller
+	big := string(make([]byte, 40*1024))
+	err := handler.Add(big, []byte("foo"), "")
+	if _, ok := err.(*CommitError); !ok {
+		t.Fatalf("expected a commit error, got %v", err)
+	}
+
+	if err := handler.Remove("sync"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Load("sync"); ok {
+		t.Fatal("expected the remove to be visible once acknowledged")
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+
+	b1 := make(chan *OpLog, 10)
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: b1})
+	h1.Start(d1)
+
+	h2 := &Handler{}
+	h2.Start(d2)
+
+	op, err := h1.AddTracked("", "k", []byte("v"), "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := op.Token()
+	if token[op.Origin] != op.Seq {
+		t.Fatalf("expected the token to cover the write, got %v", token)
+	}
+
+	// node 2 hasn't seen the write yet
+	ok, err := h2.WaitFor(token, 20*time.Millisecond)
+	if err != nil || ok {
+		t.Fatalf("expected node 2 to be behind the token, got %v %v", ok, err)
+	}
+
+	// the read waits for the write to arrive
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rep := <-b1
+		rep.IsFromRemote = true
+		h2.deliver([]*OpLog{rep})
+	}()
+
+	ok, err = h2.WaitFor(token, time.Second)
+	if err != nil || !ok {
+		t.Fatalf("expected node 2 to catch up with the token, got %v %v", ok, err)
+	}
+
+	if _, found := d2.Load("k"); !found {
+		t.Error("expected the write to be readable once the token is covered")
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	_, d1, n1 := NewDB()
+	defer teardown(d1, n1)
+	_, d2, n2 := NewDB()
+	defer teardown(d2, n2)
+
+	b1 := make(chan *OpLog, 10)
+	h1 := &Handler{}
+	h1.SetReplicator(&InAppReplicator{Buffer: b1})
+	h1.Start(d1)
+
+	h2 := &Handler{}
+	h2.Start(d2)
+
+	keys := []string{"t1/a", "t1/b", "t1/c.d", "t10/x", "other"}
+	for _, k := range keys {
+		if err := h1.Add(k, []byte("v"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// node 2 writes to the prefix before it sees the remove
+	if err := h2.Add("t1/new", []byte("v"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := h1.RemovePrefixTracked("", "t1/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(op.Observed) != 3 {
+		t.Fatalf("expected 3 keys to be removed, got %v", op.Observed)
+	}
+
+	ops := make([]*OpLog, 0)
+	for len(b1) > 0 {
+		rep := <-b1
+		rep.IsFromRemote = true
+		ops = append(ops, rep)
+	}
+
+	if len(ops) != len(keys)+1 {
+		t.Fatalf("expected the prefix delete to replicate as one op, got %d ops", len(ops))
+	}
+	h2.deliver(ops)
+
+	for _, d := range []*db.DB{d1, d2} {
+		for _, k := range []string{"t1/a", "t1/b", "t1/c.d"} {
+			if _, ok := d.Load(k); ok {
+				t.Errorf("expected %s to be removed", k)
+			}
+		}
+
+		for _, k := range []string{"t10/x", "other"} {
+			if _, ok := d.Load(k); !ok {
+				t.Errorf("expected %s to be kept", k)
+			}
+		}
+	}
+
+	if _, ok := d2.Load("t1/new"); !ok {
+		t.Error("expected a concurrent write under the prefix to be kept")
+	}
+}
+
+func TestRemovePrefixCountsLiveKeys(t *testing.T) {
+	h, d, n := NewDB()
+	defer teardown(d, n)
+
+	if err := h.Add("p/live", []byte("v"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.AddExpiring("", "p/expired", []byte("v"), "", nil, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	op, err := h.RemovePrefixTracked("", "p/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired value is tombstoned, but only the live key is reported
+	if len(op.Observed) != 2 || op.Removed() != 1 {
+		t.Fatalf("expected 2 keys observed and 1 removed, got %v and %d", op.Observed, op.Removed())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, d, n := NewDB()
+	defer teardown(d, n)
+
+	h := &Handler{}
+	h.Start(d)
+
+	w := h.Watch("", "w/", 10)
+	slow := h.Watch("", "w/", 1)
+
+	for _, k := range []string{"w/a", "other", "w/b"} {
+		if err := h.Add(k, []byte("v"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := h.RemovePrefixTracked("", "w/", false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Opn{ADD, ADD, REMPREFIX}
+	received := []*OpLog{}
+	for _, e := range expected {
+		op := <-w.C()
+		if op.Op != e {
+			t.Fatalf("expected %s, got %s of %s", e, op.Op, op.Key)
+		}
+		received = append(received, op)
+	}
+
+	// the slow watch kept the first op and was dropped on the second
+	op := <-slow.C()
+	if op == nil || op.Key != "w/a" {
+		t.Fatalf("expected the first op, got %v", op)
+	}
+
+	// every watch gets its own copy
+	op.Value.Value[0] = 'x'
+	if op == received[0] || string(received[0].Value.Value) != "v" {
+		t.Fatal("expected the watches not to share ops")
+	}
+
+	if _, ok := <-slow.C(); ok {
+		t.Fatal("expected the slow watch to be closed")
+	}
+
+	h.Unwatch(w)
+	h.Unwatch(slow)
+	if _, ok := <-w.C(); ok {
+		t.Fatal("expected the watch to be closed")
+	}
+}
@@ -0,0 +1,170 @@
+package oplog
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+	"strings"
+	"sync"
+)
+
+// Watch is a subscription to the key writes applied on this node
+type Watch struct {
+	ns     string
+	prefix string
+	ch     chan *OpLog
+}
+
+// C receives copies of the ADD, REM and REMPREFIX ops of keys starting with
+// the prefix in the order they are committed, it is closed when the watch ends or is
+// dropped because its reader fell behind
+func (w *Watch) C() <-chan *OpLog {
+	return w.ch
+}
+
+func (w *Watch) matches(op *OpLog) bool {
+	if op.Namespace != w.ns {
+		return false
+	}
+
+	switch op.Op {
+	case ADD, REM:
+		return strings.HasPrefix(op.Key, w.prefix)
+	case REMPREFIX:
+		for k := range op.Observed {
+			if strings.HasPrefix(k, w.prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// send queues an op without blocking, it fails if the watch is full
+func (w *Watch) send(op *OpLog) bool {
+	select {
+	case w.ch <- op:
+		return true
+	default:
+		return false
+	}
+}
+
+type watchTable struct {
+	mtx     sync.Mutex
+	watches map[*Watch]struct{}
+}
+
+// Watch subscribes to the writes of keys in ns starting with prefix, up to
+// buffer ops are queued for a slow reader before the watch is dropped
+func (h *Handler) Watch(ns string, prefix string, buffer int) *Watch {
+	w := &Watch{
+		ns:     ns,
+		prefix: prefix,
+		ch:     make(chan *OpLog, buffer),
+	}
+
+	h.watches.mtx.Lock()
+	defer h.watches.mtx.Unlock()
+
+	if h.watches.watches == nil {
+		h.watches.watches = map[*Watch]struct{}{}
+	}
+	h.watches.watches[w] = struct{}{}
+
+	return w
+}
+
+// Unwatch ends a watch, it is safe to call after the watch was dropped
+func (h *Handler) Unwatch(w *Watch) {
+	h.watches.mtx.Lock()
+	defer h.watches.mtx.Unlock()
+
+	if _, ok := h.watches.watches[w]; ok {
+		delete(h.watches.watches, w)
+		close(w.ch)
+	}
+}
+
+// notify passes committed ops to the watches, it never blocks the apply
+// loop, a watch that is full is dropped instead
+func (h *Handler) notify(ops []*OpLog) {
+	h.watches.mtx.Lock()
+	defer h.watches.mtx.Unlock()
+
+	for w := range h.watches.watches {
+		for _, op := range ops {
+			if !w.matches(op) {
+				continue
+			}
+
+			if !w.send(copyOp(op)) {
+				delete(h.watches.watches, w)
+				close(w.ch)
+				break
+			}
+		}
+	}
+}
+
+// copyOp copies the fields of an op a watcher can read, so watchers don't
+// share the op that is still being replicated and acknowledged
+func copyOp(op *OpLog) *OpLog {
+	cp := &OpLog{
+		ID:           op.ID,
+		KID:          op.KID,
+		Key:          op.Key,
+		Op:           op.Op,
+		Namespace:    op.Namespace,
+		Delta:        op.Delta,
+		Member:       op.Member,
+		Origin:       op.Origin,
+		Seq:          op.Seq,
+		AckTo:        op.AckTo,
+		IsFromRemote: op.IsFromRemote,
+		index:        op.index,
+		Context:      copyVV(op.Context),
+		Deps:         copyVV(op.Deps),
+	}
+
+	if op.Value != nil {
+		v := *op.Value
+		v.Value = append([]byte(nil), op.Value.Value...)
+		v.VV = copyVV(op.Value.VV)
+		cp.Value = &v
+	}
+
+	if op.Counter != nil {
+		c := *op.Counter
+		cp.Counter = &c
+	}
+
+	if op.Tags != nil {
+		cp.Tags = append([]string(nil), op.Tags...)
+	}
+
+	if op.Fields != nil {
+		cp.Fields = crdt.ORMap{}
+		for f, r := range op.Fields {
+			reg := *r
+			reg.Value = append([]byte(nil), r.Value...)
+			cp.Fields[f] = &reg
+		}
+	}
+
+	if op.Observed != nil {
+		cp.Observed = make(map[string][]string, len(op.Observed))
+		for k, ids := range op.Observed {
+			cp.Observed[k] = append([]string(nil), ids...)
+		}
+	}
+
+	return cp
+}
+
+func copyVV(v crdt.VersionVector) crdt.VersionVector {
+	if v == nil {
+		return nil
+	}
+
+	return v.Copy()
+}
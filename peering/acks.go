@@ -0,0 +1,57 @@
+package peering
+
+import (
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/oplog"
+)
+
+// LocalName is the member name peers send acknowledgements to
+func (p *PeerManager) LocalName() string {
+	return p.members.LocalNode().Name
+}
+
+// NumPeers returns the number of live members other than this node
+func (p *PeerManager) NumPeers() int {
+	return p.members.NumMembers() - 1
+}
+
+// Acknowledge tells the nodes that wrote ops with a write concern that they
+// have been applied here
+func (p *PeerManager) Acknowledge(ops []*oplog.OpLog) {
+	byNode := map[string][]string{}
+	for _, op := range ops {
+		byNode[op.AckTo] = append(byNode[op.AckTo], op.ID)
+	}
+
+	self := p.LocalName()
+	for to, ids := range byNode {
+		enc, err := db.Encode(&directAck{From: self, IDs: ids})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		// don't hold up the inbox on a slow peer
+		go func(to string, msg []byte) {
+			for _, n := range p.members.Members() {
+				if n.Name == to {
+					err := p.members.SendReliable(n, p.compressFor(n, msg))
+					if err != nil {
+						log.Debug("failed to confirm ops to ", to, ": ", err)
+					}
+					return
+				}
+			}
+		}(to, append([]byte{appliedMsg}, enc...))
+	}
+}
+
+func (p *PeerDelegate) handleApplied(b []byte) {
+	a := &directAck{}
+	if err := db.Decode(b, a); err != nil {
+		log.Error("failed to decode applied ops: ", err)
+		return
+	}
+
+	p.oplogHandler.Acked(a.From, a.IDs)
+}
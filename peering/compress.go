@@ -0,0 +1,61 @@
+package peering
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/compression"
+)
+
+// supports checks if a node advertised that it can read data compressed with
+// algo, older nodes advertise nothing
+func supports(n *memberlist.Node, algo string) bool {
+	meta := &PeerData{}
+	if err := json.Unmarshal(n.Meta, meta); err != nil {
+		return false
+	}
+
+	for _, a := range meta.Compression {
+		if a == algo {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressFor compresses a message sent directly to a node that can read it
+func (p *PeerManager) compressFor(n *memberlist.Node, msg []byte) []byte {
+	if p.compression == compression.None || !supports(n, p.compression) {
+		return msg
+	}
+
+	return compression.Encode(p.compression, msg)
+}
+
+// CompressBroadcast compresses a message that may reach any node, only if
+// every other node in the cluster can read it
+func (p *PeerManager) CompressBroadcast(msg []byte) []byte {
+	if p.compression == compression.None || p.members == nil {
+		return msg
+	}
+
+	self := p.members.LocalNode().Name
+	others := 0
+	for _, n := range p.members.Members() {
+		if n.Name == self {
+			continue
+		}
+
+		if !supports(n, p.compression) {
+			return msg
+		}
+		others++
+	}
+
+	// nothing is known about a node we are joining for the first time
+	if others == 0 {
+		return msg
+	}
+
+	return compression.Encode(p.compression, msg)
+}
@@ -7,9 +7,11 @@ import (
 )
 
 type PeerData struct {
-	NodeName   string
-	APIIngress string
-	Token      string
+	NodeName    string
+	NodeID      string `json:",omitempty"` // the stable ID of the node's DB, the name changes on restart
+	APIIngress  string
+	Token       string
+	Compression []string `json:",omitempty"` // algorithms this node can read
 }
 
 type PeerConfig struct {
@@ -21,8 +23,13 @@ type PeerConfig struct {
 	Join             []string
 	Block            []string
 	Federation       *PeerData
-	ReplicaChan      chan *oplog.OpLog
+	Inbox            *oplog.Inbox // ops received from peers, created by the server if not set
+	InboxSize        int
+	InboxBatch       int
 	OpLogHandler     *oplog.Handler
+	ChaosMode        bool // wraps the transport so faults can be injected at runtime
+	Outbox           OutboxConfig
+	Compression      string // snappy (default) or none, only used with peers that support it
 }
 
 type Config struct {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/compression"
 	"github.com/lonelycode/yzma/db"
 	"github.com/lonelycode/yzma/oplog"
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -13,8 +14,10 @@ import (
 type PeerDelegate struct {
 	cfg          *PeerData
 	bcast        *memberlist.TransmitLimitedQueue
-	bcastChan    chan *oplog.OpLog
+	inbox        *oplog.Inbox
 	oplogHandler *oplog.Handler
+	outbox       *Outbox
+	resync       *Resyncer
 }
 
 var (
@@ -37,22 +40,38 @@ func (p *PeerDelegate) NotifyMsg(b []byte) {
 		return
 	}
 
+	b, err := compression.Decode(b)
+	if err != nil || len(b) == 0 {
+		log.Error("failed to decompress message: ", err)
+		return
+	}
+
+	switch b[0] {
+	case opsMsg:
+		p.handleOps(b[1:])
+		return
+	case ackMsg:
+		p.handleAck(b[1:])
+		return
+	case resyncMsg:
+		p.resync.handle(b[1:])
+		return
+	case appliedMsg:
+		p.handleApplied(b[1:])
+		return
+	}
+
 	log.Debug("Message is: ", string(b))
 	op := &oplog.OpLog{}
-	err := db.Decode(b, op)
+	err = db.Decode(b, op)
 	if err != nil {
 		log.Error(err)
+		return
 	}
 
-	if p.bcastChan != nil {
-		select {
-		case p.bcastChan <- op:
-			log.Debug("notification sent to DB")
-		default:
-			log.Debug("notification bounced, channel busy")
-		}
+	if p.inbox != nil && !p.inbox.OfferOrRecord(op) {
+		log.Debug("inbox full, op ", op.ID, " will be resynced")
 	}
-	return
 }
 
 func (p *PeerDelegate) GetBroadcasts(overhead, limit int) [][]byte {
@@ -74,6 +93,8 @@ func (p *PeerDelegate) LocalState(join bool) []byte {
 		return nil
 	}
 
+	// the state is sent before the metadata of the remote node has been
+	// merged, there is no telling if it can read compressed state
 	return dat
 }
 
@@ -87,10 +108,16 @@ func (p *PeerDelegate) MergeRemoteState(buf []byte, join bool) {
 		return
 	}
 
+	buf, err := compression.Decode(buf)
+	if err != nil {
+		log.Error("failed to decompress remote state: ", err)
+		return
+	}
+
 	var h codec.Handle = new(codec.MsgpackHandle)
 	var dec = codec.NewDecoderBytes(buf, h)
 	var arrayDat [][]byte
-	err := dec.Decode(&arrayDat)
+	err = dec.Decode(&arrayDat)
 	if err != nil {
 		log.Error(err)
 	}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/compression"
 	"github.com/sirupsen/logrus"
 	"strings"
 )
@@ -91,7 +92,28 @@ func (p *PeerManager) Init(cfg *PeerConfig) error {
 		RetransmitMult: 3,
 	}
 
+	p.compression = cfg.Compression
+	if p.compression == "" {
+		p.compression = compression.Snappy
+	}
+
+	if err := compression.Validate(p.compression); err != nil {
+		return err
+	}
+
+	if p.compression != compression.None && cfg.Federation != nil {
+		cfg.Federation.Compression = []string{p.compression}
+	}
+
+	members := func() []*memberlist.Node { return p.members.Members() }
+	self := func() string { return p.members.LocalNode().Name }
+	local := func() *memberlist.Node { return p.members.LocalNode() }
+	send := func(n *memberlist.Node, msg []byte) error { return p.members.SendReliable(n, p.compressFor(n, msg)) }
+	p.outbox = &Outbox{cfg: cfg.Outbox, members: members, self: local, send: send}
+	p.resync = &Resyncer{inbox: cfg.Inbox, members: members, self: self, send: send}
+
 	listCfg := memberlist.DefaultWANConfig()
+	p.maxBroadcast = listCfg.UDPBufferSize
 	listCfg.Name = p.cfg.Name
 	listCfg.AdvertiseAddr = p.cfg.AdvertiseAddress
 	listCfg.AdvertisePort = p.cfg.AdvertisePort
@@ -100,8 +122,10 @@ func (p *PeerManager) Init(cfg *PeerConfig) error {
 	listCfg.Delegate = &PeerDelegate{
 		cfg:          p.cfg.Federation,
 		bcast:        p.Broadcasts,
-		bcastChan:    p.cfg.ReplicaChan,
+		inbox:        p.cfg.Inbox,
 		oplogHandler: p.cfg.OpLogHandler,
+		outbox:       p.outbox,
+		resync:       p.resync,
 	}
 	listCfg.BindAddr = p.cfg.BindAddr
 
@@ -115,12 +139,18 @@ func (p *PeerManager) Init(cfg *PeerConfig) error {
 		BindPort:  p.cfg.BindPort,
 	}
 
-	var err error
-	listCfg.Transport, err = NewWebTransport(webTSConf)
+	transport, err := NewWebTransport(webTSConf)
 	if err != nil {
 		return err
 	}
 
+	listCfg.Transport = transport
+	if p.cfg.ChaosMode {
+		log.Warn("chaos mode enabled, faults can be injected into the transport")
+		p.faults = NewFaultTransport(transport)
+		listCfg.Transport = p.faults
+	}
+
 	list, err := memberlist.Create(listCfg)
 	if err != nil {
 		return fmt.Errorf("Failed to create memberlist: " + err.Error())
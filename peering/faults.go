@@ -0,0 +1,173 @@
+package peering
+
+import (
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// FaultConfig describes the faults injected into the peering transport when
+// chaos mode is enabled, rates are probabilities between 0 and 1
+type FaultConfig struct {
+	DropRate      float64  // chance an outbound packet is silently dropped
+	DuplicateRate float64  // chance an outbound packet is sent twice
+	ReorderRate   float64  // chance an outbound packet is held back by ReorderMs
+	ReorderMs     int      // how long re-ordered packets are held back
+	LatencyMs     int      // fixed latency added to every outbound packet
+	JitterMs      int      // random extra latency up to this value
+	BlockOutbound []string // peer addresses (host:port) we cannot send to
+	BlockInbound  []string // peer addresses (host:port) we ignore packets from
+}
+
+// FaultTransport wraps a memberlist transport and injects network faults
+// into it, it is used to test convergence under partitions. Packets are
+// subject to all faults, streams are only subject to outbound partitions
+// because the remote port of an inbound stream can't be mapped to a peer.
+type FaultTransport struct {
+	memberlist.Transport
+	mtx      sync.RWMutex
+	faults   *FaultConfig
+	rndMtx   sync.Mutex
+	rnd      *rand.Rand
+	packetCh chan *memberlist.Packet
+}
+
+// NewFaultTransport wraps a transport, faults are disabled until SetFaults
+// is called
+func NewFaultTransport(t memberlist.Transport) *FaultTransport {
+	ft := &FaultTransport{
+		Transport: t,
+		faults:    &FaultConfig{},
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		packetCh:  make(chan *memberlist.Packet),
+	}
+
+	go ft.filterPackets()
+
+	return ft
+}
+
+// SetFaults replaces the active fault configuration, a nil config heals
+// the transport
+func (t *FaultTransport) SetFaults(cfg *FaultConfig) {
+	if cfg == nil {
+		cfg = &FaultConfig{}
+	}
+
+	t.mtx.Lock()
+	t.faults = cfg
+	t.mtx.Unlock()
+
+	log.Warn("fault injection updated: ", fmt.Sprintf("%+v", *cfg))
+}
+
+// Faults returns the active fault configuration
+func (t *FaultTransport) Faults() *FaultConfig {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	cp := *t.faults
+	return &cp
+}
+
+func (t *FaultTransport) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	t.rndMtx.Lock()
+	defer t.rndMtx.Unlock()
+	return t.rnd.Float64() < rate
+}
+
+func (t *FaultTransport) delay(f *FaultConfig) time.Duration {
+	d := time.Duration(f.LatencyMs) * time.Millisecond
+	if f.JitterMs > 0 {
+		t.rndMtx.Lock()
+		d += time.Duration(t.rnd.Intn(f.JitterMs)) * time.Millisecond
+		t.rndMtx.Unlock()
+	}
+
+	if t.chance(f.ReorderRate) {
+		d += time.Duration(f.ReorderMs) * time.Millisecond
+	}
+
+	return d
+}
+
+func isListed(addr string, list []string) bool {
+	for _, a := range list {
+		if a == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// See Transport.
+func (t *FaultTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	f := t.Faults()
+	if isListed(addr, f.BlockOutbound) || t.chance(f.DropRate) {
+		// pretend it was sent, UDP wouldn't know any better
+		return time.Now(), nil
+	}
+
+	sends := 1
+	if t.chance(f.DuplicateRate) {
+		sends = 2
+	}
+
+	for i := 0; i < sends; i++ {
+		d := t.delay(f)
+		if d == 0 {
+			if _, err := t.Transport.WriteTo(b, addr); err != nil {
+				return time.Time{}, err
+			}
+			continue
+		}
+
+		// memberlist may re-use the buffer once we return
+		cp := make([]byte, len(b))
+		copy(cp, b)
+		go func() {
+			time.Sleep(d)
+			t.Transport.WriteTo(cp, addr)
+		}()
+	}
+
+	return time.Now(), nil
+}
+
+// See Transport.
+func (t *FaultTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	f := t.Faults()
+	if isListed(addr, f.BlockOutbound) {
+		return nil, fmt.Errorf("dial %s: partitioned by fault injection", addr)
+	}
+
+	if d := t.delay(f); d > 0 {
+		time.Sleep(d)
+	}
+
+	return t.Transport.DialTimeout(addr, timeout)
+}
+
+// See Transport.
+func (t *FaultTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+func (t *FaultTransport) filterPackets() {
+	for p := range t.Transport.PacketCh() {
+		f := t.Faults()
+		if p.From != nil && isListed(p.From.String(), f.BlockInbound) {
+			continue
+		}
+
+		t.packetCh <- p
+	}
+}
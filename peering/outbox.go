@@ -0,0 +1,434 @@
+package peering
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/oplog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize   = 100
+	defaultRetryMinMs  = 250
+	defaultRetryMaxMs  = 30000
+	defaultPeerTTLMins = 60 * 24
+
+	// how long a batch of direct ops may take to commit before the ones that
+	// are done are acknowledged
+	commitTimeout = 15 * time.Second
+)
+
+// Direct messages start with a type byte, gossiped ops are plain msgpack
+// maps and never start with one of these
+const (
+	opsMsg     byte = 0x01
+	ackMsg     byte = 0x02
+	resyncMsg  byte = 0x03
+	appliedMsg byte = 0x04 // ops with a write concern that were applied
+)
+
+type OutboxConfig struct {
+	Disabled    bool
+	BatchSize   int // ops sent to a peer in one message
+	RetryMinMs  int // first retry of an unacknowledged batch
+	RetryMaxMs  int // retries back off up to this
+	PeerTTLMins int // how long ops are kept for a peer that has gone away
+}
+
+// directOps is a batch of ops sent straight to a peer, the peer replies with
+// the IDs it committed
+type directOps struct {
+	From string
+	Ops  [][]byte
+}
+
+type directAck struct {
+	From string
+	IDs  []string
+	Busy bool // the peer's inbox is filling up, hold back
+}
+
+type peerQueue struct {
+	lastSeen time.Time
+	next     time.Time
+	backoff  time.Duration
+	attempts int
+}
+
+// PeerBacklog describes the ops waiting to be delivered to a peer
+type PeerBacklog struct {
+	Peer      string
+	Pending   int
+	Attempts  int // sends since the last acknowledgement
+	NextRetry time.Time
+	LastSeen  time.Time
+}
+
+// Outbox is a durable per-peer queue of outbound ops. Ops are still gossiped,
+// but they are also sent directly to every known peer until it acknowledges
+// them, so a peer that was unreachable for a while catches up once it is back.
+// Queues are keyed by peer ID so they survive a peer restarting
+type Outbox struct {
+	cfg     OutboxConfig
+	members func() []*memberlist.Node
+	self    func() *memberlist.Node
+	send    func(*memberlist.Node, []byte) error
+	db      *db.DB
+	mtx     sync.Mutex
+	peers   map[string]*peerQueue
+	stop    chan struct{}
+}
+
+// peerID returns the stable ID of a node, older nodes don't advertise one and
+// are known by their name
+func peerID(n *memberlist.Node) string {
+	meta := &PeerData{}
+	if err := json.Unmarshal(n.Meta, meta); err != nil || meta.NodeID == "" {
+		return n.Name
+	}
+
+	return meta.NodeID
+}
+
+func (o *Outbox) minBackoff() time.Duration {
+	return time.Duration(o.cfg.RetryMinMs) * time.Millisecond
+}
+
+// Start begins delivering queued ops, ops are only queued once started
+func (o *Outbox) Start(d *db.DB) error {
+	if o.cfg.BatchSize <= 0 {
+		o.cfg.BatchSize = defaultBatchSize
+	}
+
+	if o.cfg.RetryMinMs <= 0 {
+		o.cfg.RetryMinMs = defaultRetryMinMs
+	}
+
+	if o.cfg.RetryMaxMs < o.cfg.RetryMinMs {
+		o.cfg.RetryMaxMs = defaultRetryMaxMs
+	}
+
+	if o.cfg.PeerTTLMins <= 0 {
+		o.cfg.PeerTTLMins = defaultPeerTTLMins
+	}
+
+	// peers with ops left over from before a restart get a full TTL to return
+	backlog, err := d.OutboundBacklog()
+	if err != nil {
+		return err
+	}
+
+	o.mtx.Lock()
+	o.peers = map[string]*peerQueue{}
+	for p := range backlog {
+		o.peers[p] = &peerQueue{lastSeen: time.Now(), backoff: o.minBackoff()}
+	}
+	o.db = d
+	o.stop = make(chan struct{})
+	o.mtx.Unlock()
+
+	go o.run(o.stop)
+	return nil
+}
+
+func (o *Outbox) Stop() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.stop != nil {
+		close(o.stop)
+		o.stop = nil
+	}
+	o.db = nil
+}
+
+func (o *Outbox) run(stop chan struct{}) {
+	tick := time.NewTicker(o.minBackoff())
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			o.flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refresh tracks every live peer, o.mtx must be held
+func (o *Outbox) refresh() map[string]*memberlist.Node {
+	alive := map[string]*memberlist.Node{}
+	self := o.self().Name
+	now := time.Now()
+	for _, n := range o.members() {
+		if n.Name == self {
+			continue
+		}
+
+		id := peerID(n)
+		alive[id] = n
+		q, ok := o.peers[id]
+		if !ok {
+			q = &peerQueue{backoff: o.minBackoff()}
+			o.peers[id] = q
+		}
+		q.lastSeen = now
+	}
+
+	return alive
+}
+
+// Push queues an op for every known peer in tx
+func (o *Outbox) Push(tx *db.DB, id string, msg []byte) error {
+	o.mtx.Lock()
+	if o.db == nil {
+		o.mtx.Unlock()
+		return nil
+	}
+
+	o.refresh()
+	peers := make([]string, 0, len(o.peers))
+	for p := range o.peers {
+		peers = append(peers, p)
+	}
+	o.mtx.Unlock()
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return tx.QueueOutbound(peers, id, msg)
+}
+
+func (o *Outbox) flush() {
+	o.mtx.Lock()
+	d := o.db
+	if d == nil {
+		o.mtx.Unlock()
+		return
+	}
+
+	alive := o.refresh()
+	now := time.Now()
+	ttl := time.Duration(o.cfg.PeerTTLMins) * time.Minute
+	due := make([]string, 0)
+	gone := make([]string, 0)
+	for p, q := range o.peers {
+		if now.Sub(q.lastSeen) > ttl {
+			delete(o.peers, p)
+			gone = append(gone, p)
+			continue
+		}
+
+		if _, ok := alive[p]; ok && !now.Before(q.next) {
+			due = append(due, p)
+		}
+	}
+	o.mtx.Unlock()
+
+	// ops are queued with o.mtx held inside a write transaction, so the DB
+	// is only written once it is released
+	for _, p := range gone {
+		log.Warn("peer ", p, " has been gone for too long, dropping its replication queue")
+		if err := d.DropOutbound(p); err != nil {
+			log.Error("failed to drop replication queue: ", err)
+		}
+	}
+
+	for _, p := range due {
+		ids, msgs, err := d.Outbound(p, o.cfg.BatchSize)
+		if err != nil {
+			log.Error("failed to read replication queue: ", err)
+			continue
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		enc, err := db.Encode(&directOps{From: peerID(o.self()), Ops: msgs})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		err = o.send(alive[p], append([]byte{opsMsg}, enc...))
+		if err != nil {
+			log.Debug("failed to send ", len(ids), " queued ops to ", p, ": ", err)
+		}
+
+		// resend if no ack arrives in time, even if the send worked
+		o.mtx.Lock()
+		if q, ok := o.peers[p]; ok {
+			q.attempts++
+			o.backOff(q)
+		}
+		o.mtx.Unlock()
+	}
+}
+
+// backOff delays the next batch sent to a peer, o.mtx must be held
+func (o *Outbox) backOff(q *peerQueue) {
+	q.next = time.Now().Add(q.backoff)
+	q.backoff *= 2
+	if max := time.Duration(o.cfg.RetryMaxMs) * time.Millisecond; q.backoff > max {
+		q.backoff = max
+	}
+}
+
+// ack removes the ops a peer committed from its queue
+func (o *Outbox) ack(a *directAck) {
+	o.mtx.Lock()
+	d := o.db
+	if q, ok := o.peers[a.From]; ok {
+		q.attempts = 0
+		if a.Busy {
+			// the peer is falling behind, give it time to drain its inbox
+			o.backOff(q)
+		} else {
+			// the peer is keeping up, send the next batch straight away
+			q.backoff = o.minBackoff()
+			q.next = time.Time{}
+		}
+	}
+	o.mtx.Unlock()
+
+	if d == nil || len(a.IDs) == 0 {
+		return
+	}
+
+	if err := d.AckOutbound(a.From, a.IDs); err != nil {
+		log.Error("failed to acknowledge ops: ", err)
+	}
+}
+
+// reply acknowledges the committed ops of a batch to the sender, a busy
+// receiver replies even if nothing was committed so the sender backs off
+func (o *Outbox) reply(to string, ids []string, busy bool) {
+	if len(ids) == 0 && !busy {
+		return
+	}
+
+	enc, err := db.Encode(&directAck{From: peerID(o.self()), IDs: ids, Busy: busy})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, n := range o.members() {
+		if peerID(n) == to {
+			if err := o.send(n, append([]byte{ackMsg}, enc...)); err != nil {
+				log.Debug("failed to acknowledge ops to ", to, ": ", err)
+			}
+			return
+		}
+	}
+}
+
+// Backlog returns the replication backlog of every known peer
+func (o *Outbox) Backlog() ([]PeerBacklog, error) {
+	o.mtx.Lock()
+	d := o.db
+	o.mtx.Unlock()
+
+	if d == nil {
+		return []PeerBacklog{}, nil
+	}
+
+	pending, err := d.OutboundBacklog()
+	if err != nil {
+		return nil, err
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	out := make([]PeerBacklog, 0, len(o.peers))
+	for p, q := range o.peers {
+		out = append(out, PeerBacklog{
+			Peer:      p,
+			Pending:   pending[p],
+			Attempts:  q.attempts,
+			NextRetry: q.next,
+			LastSeen:  q.lastSeen,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Peer < out[j].Peer
+	})
+
+	return out, nil
+}
+
+// handleOps hands a batch of direct ops to the oplog handler, only the ops
+// that were committed are acknowledged, the rest will be sent again
+func (p *PeerDelegate) handleOps(b []byte) {
+	msg := &directOps{}
+	if err := db.Decode(b, msg); err != nil {
+		log.Error("failed to decode queued ops: ", err)
+		return
+	}
+
+	ids := make([]string, 0, len(msg.Ops))
+	pending := make([]<-chan error, 0, len(msg.Ops))
+	for _, bOp := range msg.Ops {
+		op := &oplog.OpLog{}
+		if err := db.Decode(bOp, op); err != nil {
+			log.Error("failed to decode queued op: ", err)
+			continue
+		}
+
+		done := op.Track()
+		if p.inbox == nil || !p.inbox.Offer(op) {
+			log.Debug("inbox full, op ", op.ID, " will be sent again")
+			continue
+		}
+		ids = append(ids, op.ID)
+		pending = append(pending, done)
+	}
+
+	go p.awaitCommit(msg.From, ids, pending)
+}
+
+// awaitCommit acknowledges the ops of a batch once they are committed, ops
+// that are still waiting for their dependencies when the time is up are
+// sent again
+func (p *PeerDelegate) awaitCommit(from string, ids []string, pending []<-chan error) {
+	timeout := time.NewTimer(commitTimeout)
+	defer timeout.Stop()
+
+	committed := make([]string, 0, len(ids))
+	for i, done := range pending {
+		select {
+		case err := <-done:
+			if err == nil {
+				committed = append(committed, ids[i])
+			}
+		case <-timeout.C:
+			p.outbox.reply(from, committed, p.busy())
+			return
+		}
+	}
+
+	p.outbox.reply(from, committed, p.busy())
+}
+
+// busy checks if senders should hold back
+func (p *PeerDelegate) busy() bool {
+	return p.inbox == nil || p.inbox.Busy()
+}
+
+func (p *PeerDelegate) handleAck(b []byte) {
+	a := &directAck{}
+	if err := db.Decode(b, a); err != nil {
+		log.Error("failed to decode ack: ", err)
+		return
+	}
+
+	p.outbox.ack(a)
+}
@@ -1,9 +1,11 @@
 package peering
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/db"
 	"github.com/satori/go.uuid"
 	"net"
 	"strings"
@@ -21,6 +23,11 @@ type PeerManager struct {
 	fixedServers []*Definition
 	Broadcasts   *memberlist.TransmitLimitedQueue
 	Name         string
+	faults       *FaultTransport
+	outbox       *Outbox
+	resync       *Resyncer
+	compression  string
+	maxBroadcast int
 }
 
 func (p *PeerManager) Join(peers []string) error {
@@ -29,6 +36,48 @@ func (p *PeerManager) Join(peers []string) error {
 	return err
 }
 
+// MaxBroadcast is the size of the largest message gossip can carry, larger
+// messages are never sent and stay queued
+func (p *PeerManager) MaxBroadcast() int {
+	return p.maxBroadcast
+}
+
+// Member is a live node of the cluster
+type Member struct {
+	Name       string
+	Address    string
+	APIIngress string
+	Self       bool
+}
+
+// Members returns the live nodes of the cluster, this one included
+func (p *PeerManager) Members() []Member {
+	self := p.members.LocalNode().Name
+	nodes := p.members.Members()
+	ret := make([]Member, 0, len(nodes))
+	for _, n := range nodes {
+		// the token in the metadata is never passed on
+		meta := &PeerData{}
+		if err := json.Unmarshal(n.Meta, meta); err != nil {
+			log.Debug("failed to decode the metadata of ", n.Name, ": ", err)
+		}
+
+		ret = append(ret, Member{
+			Name:       n.Name,
+			Address:    n.Address(),
+			APIIngress: meta.APIIngress,
+			Self:       n.Name == self,
+		})
+	}
+
+	return ret
+}
+
+// Shutdown stops taking part in the cluster, without leaving it first
+func (p *PeerManager) Shutdown() error {
+	return p.members.Shutdown()
+}
+
 func (p *PeerManager) Leave() error {
 	log.Info("received leave request")
 	err := p.members.Leave(time.Second * 30)
@@ -39,6 +88,58 @@ func (p *PeerManager) Leave() error {
 	return nil
 }
 
+// SetFaults changes the faults injected into the transport, this is only
+// possible if the peer manager was started in chaos mode
+func (p *PeerManager) SetFaults(cfg *FaultConfig) error {
+	if p.faults == nil {
+		return errors.New("fault injection requires chaos mode")
+	}
+
+	p.faults.SetFaults(cfg)
+	return nil
+}
+
+// Faults returns the faults currently injected into the transport
+func (p *PeerManager) Faults() (*FaultConfig, error) {
+	if p.faults == nil {
+		return nil, errors.New("fault injection requires chaos mode")
+	}
+
+	return p.faults.Faults(), nil
+}
+
+// StartReplication starts the durable replication queue and the resync of
+// missed ops on top of d
+func (p *PeerManager) StartReplication(d *db.DB) error {
+	p.resync.Start(d)
+	if p.cfg.Outbox.Disabled {
+		log.Warn("replication queue disabled, unreachable peers only catch up on rejoin")
+		return nil
+	}
+
+	return p.outbox.Start(d)
+}
+
+func (p *PeerManager) StopReplication() {
+	p.resync.Stop()
+	p.outbox.Stop()
+}
+
+// Outbox returns the durable replication queue, it is nil when the queue is
+// disabled
+func (p *PeerManager) Outbox() *Outbox {
+	if p.cfg.Outbox.Disabled {
+		return nil
+	}
+
+	return p.outbox
+}
+
+// ReplicationBacklog returns the ops waiting to be delivered to each peer
+func (p *PeerManager) ReplicationBacklog() ([]PeerBacklog, error) {
+	return p.outbox.Backlog()
+}
+
 func resolveList(hosts []string) ([]string, error) {
 	out := make([]string, len(hosts))
 
@@ -0,0 +1,146 @@
+package peering
+
+import (
+	"github.com/hashicorp/memberlist"
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/oplog"
+	"sync"
+	"time"
+)
+
+const (
+	resyncInterval = time.Second
+	maxResyncIDs   = 500
+)
+
+// resyncReq asks peers for ops that were gossiped to us but refused because
+// our inbox was full
+type resyncReq struct {
+	From string
+	IDs  []string
+}
+
+// Resyncer fetches the ops recorded as gaps by the inbox from peers, and
+// answers the requests of other peers from the stored oplog
+type Resyncer struct {
+	inbox   *oplog.Inbox
+	members func() []*memberlist.Node
+	self    func() string
+	send    func(*memberlist.Node, []byte) error
+	db      *db.DB
+	mtx     sync.Mutex
+	stop    chan struct{}
+}
+
+func (r *Resyncer) Start(d *db.DB) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.db = d
+	r.stop = make(chan struct{})
+	go r.run(r.stop)
+}
+
+func (r *Resyncer) Stop() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.db = nil
+}
+
+func (r *Resyncer) run(stop chan struct{}) {
+	tick := time.NewTicker(resyncInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			r.request()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// request asks every peer for the missing ops, only the origin of an op
+// stores it, so it can't be asked directly
+func (r *Resyncer) request() {
+	if r.inbox == nil || r.inbox.Busy() {
+		return
+	}
+
+	ids := r.inbox.Gaps()
+	if len(ids) == 0 {
+		return
+	}
+
+	if len(ids) > maxResyncIDs {
+		ids = ids[:maxResyncIDs]
+	}
+
+	enc, err := db.Encode(&resyncReq{From: r.self(), IDs: ids})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	log.Info("requesting ", len(ids), " missed ops from peers")
+	self := r.self()
+	for _, n := range r.members() {
+		if n.Name == self {
+			continue
+		}
+
+		if err := r.send(n, append([]byte{resyncMsg}, enc...)); err != nil {
+			log.Debug("failed to request resync from ", n.Name, ": ", err)
+		}
+	}
+}
+
+// handle answers a resync request with the requested ops we have
+func (r *Resyncer) handle(b []byte) {
+	req := &resyncReq{}
+	if err := db.Decode(b, req); err != nil {
+		log.Error("failed to decode resync request: ", err)
+		return
+	}
+
+	r.mtx.Lock()
+	d := r.db
+	r.mtx.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	ops, err := d.Ops(req.IDs)
+	if err != nil {
+		log.Error("failed to read ops for resync: ", err)
+		return
+	}
+
+	if len(ops) == 0 {
+		return
+	}
+
+	enc, err := db.Encode(&directOps{From: r.self(), Ops: ops})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	go func() {
+		for _, n := range r.members() {
+			if n.Name == req.From {
+				if err := r.send(n, append([]byte{opsMsg}, enc...)); err != nil {
+					log.Debug("failed to send resync to ", n.Name, ": ", err)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,30 @@
+package resp
+
+import (
+	"github.com/lonelycode/yzma/logger"
+	"github.com/spf13/viper"
+)
+
+type RESPCfg struct {
+	Bind       string // e.g. :6379, the listener only starts if set
+	Namespace  string // namespace the commands work on, the default if empty
+	EnableACL  bool   // require AUTH with a token that is allowed by the ACLs
+	AdminToken string // token that bypasses the ACLs
+}
+
+type Config struct {
+	RESP *RESPCfg
+}
+
+var sconf = &Config{}
+
+var log = logger.GetLogger("resp")
+
+func GetConf() *RESPCfg {
+	err := viper.Unmarshal(sconf)
+	if err != nil {
+		log.Fatal("failed to read RESP config: ", err)
+	}
+
+	return sconf.RESP
+}
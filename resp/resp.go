@@ -0,0 +1,597 @@
+package resp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/server"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is reported to clients by HELLO
+const version = "0.1"
+
+// Listener serves the Redis protocol (RESP2, and RESP3 after HELLO 3) on top
+// of a server
+type Listener struct {
+	server *server.Server
+	cfg    *RESPCfg
+	rc     *redcon.Server
+	mtx    sync.Mutex
+}
+
+// session is the state of a client connection
+type session struct {
+	proto  int
+	acl    *acl.ACL
+	admin  bool
+	authed bool
+}
+
+type command func(l *Listener, c redcon.Conn, s *session, args [][]byte)
+
+var commands = map[string]command{
+	"PING":    ping,
+	"ECHO":    echo,
+	"HELLO":   hello,
+	"AUTH":    auth,
+	"SELECT":  selectDB,
+	"COMMAND": commandInfo,
+	"QUIT":    quit,
+	"GET":     get,
+	"MGET":    mget,
+	"SET":     set,
+	"MSET":    mset,
+	"DEL":     del,
+	"EXISTS":  exists,
+	"SCAN":    scan,
+	"INCR":    incrBy(1, false),
+	"INCRBY":  incrBy(1, true),
+	"DECR":    incrBy(-1, false),
+	"DECRBY":  incrBy(-1, true),
+}
+
+// arity is the number of arguments of a command including its name, a
+// negative arity is a minimum
+var arity = map[string]int{
+	"PING": -1, "ECHO": 2, "HELLO": -1, "AUTH": -2, "SELECT": 2, "COMMAND": -1, "QUIT": 1,
+	"GET": 2, "MGET": -2, "SET": -3, "MSET": -3, "DEL": -2, "EXISTS": -2, "SCAN": -2,
+	"INCR": 2, "INCRBY": 3, "DECR": 2, "DECRBY": 3,
+}
+
+// Start listens on cfg.Bind, it returns once the listener is ready
+func (l *Listener) Start(srv *server.Server, cfg *RESPCfg) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.server = srv
+	l.cfg = cfg
+	l.rc = redcon.NewServer(cfg.Bind, l.handle, l.accept, nil)
+
+	ready := make(chan error, 1)
+	go l.rc.ListenServeAndSignal(ready)
+	if err := <-ready; err != nil {
+		return err
+	}
+
+	log.Info("RESP listening on ", cfg.Bind)
+	return nil
+}
+
+func (l *Listener) Stop() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.rc == nil {
+		return nil
+	}
+
+	return l.rc.Close()
+}
+
+func (l *Listener) accept(c redcon.Conn) bool {
+	c.SetContext(&session{proto: 2})
+	return true
+}
+
+func (l *Listener) handle(c redcon.Conn, cmd redcon.Command) {
+	s := c.Context().(*session)
+	name := strings.ToUpper(string(cmd.Args[0]))
+	fn, ok := commands[name]
+	if !ok {
+		c.WriteError(fmt.Sprintf("ERR unknown command '%s'", cmd.Args[0]))
+		return
+	}
+
+	n := arity[name]
+	if (n > 0 && len(cmd.Args) != n) || (n < 0 && len(cmd.Args) < -n) {
+		c.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	if l.cfg.EnableACL && !s.authed && name != "AUTH" && name != "HELLO" && name != "PING" && name != "QUIT" {
+		c.WriteError("NOAUTH Authentication required.")
+		return
+	}
+
+	fn(l, c, s, cmd.Args[1:])
+}
+
+// allowed checks the session's ACL, the error is written to the client if
+// the operation is not allowed
+func (l *Listener) allowed(c redcon.Conn, s *session, key string, op acl.Operation) bool {
+	if !l.cfg.EnableACL || s.admin || s.acl.Allowed(l.cfg.Namespace, key, op) {
+		return true
+	}
+
+	c.WriteError(fmt.Sprintf("NOPERM %s not allowed on %s", op, key))
+	return false
+}
+
+// writeNull writes a null in the protocol of the session
+func writeNull(c redcon.Conn, s *session) {
+	if s.proto >= 3 {
+		c.WriteRaw([]byte("_\r\n"))
+		return
+	}
+
+	c.WriteNull()
+}
+
+func writeErr(c redcon.Conn, err error) {
+	c.WriteError("ERR " + err.Error())
+}
+
+func ping(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	if len(args) > 0 {
+		c.WriteBulk(args[0])
+		return
+	}
+
+	c.WriteString("PONG")
+}
+
+func echo(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	c.WriteBulk(args[0])
+}
+
+// hello switches the protocol version, RESP3 clients get a map back
+func hello(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	proto := s.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil || v < 2 || v > 3 {
+			c.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		switch strings.ToUpper(string(args[0])) {
+		case "AUTH":
+			if len(args) < 3 {
+				c.WriteError("ERR syntax error")
+				return
+			}
+			if !l.login(c, s, string(args[2])) {
+				return
+			}
+			args = args[3:]
+		case "SETNAME":
+			if len(args) < 2 {
+				c.WriteError("ERR syntax error")
+				return
+			}
+			args = args[2:]
+		default:
+			c.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	if l.cfg.EnableACL && !s.authed {
+		c.WriteError("NOAUTH HELLO must be called with the client already authenticated")
+		return
+	}
+
+	s.proto = proto
+	if proto >= 3 {
+		c.WriteRaw([]byte("%5\r\n"))
+	} else {
+		c.WriteArray(10)
+	}
+
+	c.WriteBulkString("server")
+	c.WriteBulkString("yzma")
+	c.WriteBulkString("version")
+	c.WriteBulkString(version)
+	c.WriteBulkString("proto")
+	c.WriteInt(proto)
+	c.WriteBulkString("mode")
+	c.WriteBulkString("cluster")
+	c.WriteBulkString("role")
+	c.WriteBulkString("master")
+}
+
+func auth(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	// AUTH [username] token, the username is ignored
+	if l.login(c, s, string(args[len(args)-1])) {
+		c.WriteString("OK")
+	}
+}
+
+// login authenticates the session with an API token
+func (l *Listener) login(c redcon.Conn, s *session, token string) bool {
+	if !l.cfg.EnableACL {
+		s.authed = true
+		return true
+	}
+
+	if l.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(l.cfg.AdminToken)) == 1 {
+		s.authed, s.admin = true, true
+		return true
+	}
+
+	a, err := l.server.ACLForToken(token)
+	if err != nil {
+		writeErr(c, err)
+		return false
+	}
+
+	if a == nil {
+		c.WriteError("WRONGPASS invalid token")
+		return false
+	}
+
+	s.authed, s.acl = true, a
+	return true
+}
+
+// selectDB only accepts database 0, use a listener per namespace instead
+func selectDB(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	if string(args[0]) != "0" {
+		c.WriteError("ERR only database 0 is available")
+		return
+	}
+
+	c.WriteString("OK")
+}
+
+// commandInfo keeps clients that introspect the server at startup happy
+func commandInfo(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	c.WriteArray(0)
+}
+
+func quit(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	c.WriteString("OK")
+	c.Close()
+}
+
+// load returns the value of a key, siblings are resolved to the newest value
+// as Redis has no way to return them
+func (l *Listener) load(key string) ([]byte, bool) {
+	dat, ok := l.server.LoadNS(l.cfg.Namespace, key)
+	if ok && len(dat) > 0 {
+		return dat.Newest().Value, true
+	}
+
+	// counters live in the default namespace
+	if l.cfg.Namespace == db.DefaultNS {
+		if n, ok := l.server.Counter(key); ok {
+			return []byte(strconv.FormatInt(n, 10)), true
+		}
+	}
+
+	return nil, false
+}
+
+func get(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	key := string(args[0])
+	if !l.allowed(c, s, key, acl.Read) {
+		return
+	}
+
+	v, ok := l.load(key)
+	if !ok {
+		writeNull(c, s)
+		return
+	}
+
+	c.WriteBulk(v)
+}
+
+func mget(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	for _, k := range args {
+		if !l.allowed(c, s, string(k), acl.Read) {
+			return
+		}
+	}
+
+	c.WriteArray(len(args))
+	for _, k := range args {
+		v, ok := l.load(string(k))
+		if !ok {
+			writeNull(c, s)
+			continue
+		}
+		c.WriteBulk(v)
+	}
+}
+
+// set supports EX and PX, NX and XX are refused as they can't be honoured
+// with concurrent writers on other nodes
+func set(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	key := string(args[0])
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "EX", "PX":
+			if ttl != 0 || i+1 >= len(args) {
+				c.WriteError("ERR syntax error")
+				return
+			}
+
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				c.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		case "NX", "XX":
+			c.WriteError("ERR NX and XX are not supported, writes are accepted by every node")
+			return
+		default:
+			c.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	if !l.allowed(c, s, key, acl.Write) {
+		return
+	}
+
+	var err error
+	if ttl > 0 {
+		err = l.server.AddWithTTL(l.cfg.Namespace, key, args[1], "", nil, ttl)
+	} else {
+		err = l.server.AddNS(l.cfg.Namespace, key, args[1], "")
+	}
+
+	if err != nil {
+		writeErr(c, err)
+		return
+	}
+
+	c.WriteString("OK")
+}
+
+func mset(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	if len(args)%2 != 0 {
+		c.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if !l.allowed(c, s, string(args[i]), acl.Write) {
+			return
+		}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if err := l.server.AddNS(l.cfg.Namespace, string(args[i]), args[i+1], ""); err != nil {
+			writeErr(c, err)
+			return
+		}
+	}
+
+	c.WriteString("OK")
+}
+
+func del(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	for _, k := range args {
+		if !l.allowed(c, s, string(k), acl.Delete) {
+			return
+		}
+	}
+
+	n := 0
+	for _, k := range args {
+		key := string(k)
+		_, found := l.server.LoadNS(l.cfg.Namespace, key)
+		if found {
+			if err := l.server.RemoveNS(l.cfg.Namespace, key); err != nil {
+				writeErr(c, err)
+				return
+			}
+		}
+
+		reset, err := l.resetCounter(key)
+		if err != nil {
+			writeErr(c, err)
+			return
+		}
+
+		if found || reset {
+			n++
+		}
+	}
+
+	c.WriteInt(n)
+}
+
+// resetCounter brings a counter back to zero, counters can't be removed, an
+// increment made concurrently on another node is kept
+func (l *Listener) resetCounter(key string) (bool, error) {
+	if l.cfg.Namespace != db.DefaultNS {
+		return false, nil
+	}
+
+	n, ok := l.server.Counter(key)
+	switch {
+	case !ok || n == 0:
+		return false, nil
+	case n > 0:
+		return true, l.server.Decr(key, n)
+	default:
+		return true, l.server.Incr(key, -n)
+	}
+}
+
+func exists(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	n := 0
+	for _, k := range args {
+		if !l.allowed(c, s, string(k), acl.Read) {
+			return
+		}
+
+		if _, ok := l.load(string(k)); ok {
+			n++
+		}
+	}
+
+	c.WriteInt(n)
+}
+
+// incrBy maps the INCR family onto counters, which can be changed on any node
+// at the same time
+func incrBy(sign int64, withArg bool) command {
+	return func(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+		key := string(args[0])
+		by := int64(1)
+		if withArg {
+			n, err := strconv.ParseInt(string(args[1]), 10, 64)
+			if err != nil {
+				c.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			by = n
+		}
+		by *= sign
+
+		if !l.allowed(c, s, key, acl.Write) {
+			return
+		}
+
+		if l.cfg.Namespace != db.DefaultNS {
+			c.WriteError("ERR counters are only available in the default namespace")
+			return
+		}
+
+		// values and counters are kept apart, a value would hide the counter
+		if _, ok := l.server.LoadNS(l.cfg.Namespace, key); ok {
+			c.WriteError("ERR the key holds a value, counters can't be changed with INCR")
+			return
+		}
+
+		var err error
+		switch {
+		case by > 0:
+			err = l.server.Incr(key, by)
+		case by < 0:
+			err = l.server.Decr(key, -by)
+		}
+
+		if err != nil {
+			writeErr(c, err)
+			return
+		}
+
+		n, _ := l.server.Counter(key)
+		c.WriteInt64(n)
+	}
+}
+
+const defaultScanCount = 10
+
+// scan pages through the keys in order, the cursor is the position of the
+// next key, so a key removed during a scan may make it skip another key
+func scan(l *Listener, c redcon.Conn, s *session, args [][]byte) {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		c.WriteError("ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.WriteError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				c.WriteError("ERR syntax error")
+				return
+			}
+		case "TYPE":
+			if strings.ToLower(string(args[i+1])) != "string" {
+				c.WriteArray(2)
+				c.WriteBulkString("0")
+				c.WriteArray(0)
+				return
+			}
+		default:
+			c.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	keys, err := l.server.Keys(l.cfg.Namespace, literalPrefix(pattern))
+	if err != nil {
+		writeErr(c, err)
+		return
+	}
+
+	page := make([]string, 0, count)
+	next := cursor
+	for ; next < len(keys) && len(page) < count; next++ {
+		k := keys[next]
+		if !match.Match(k, pattern) {
+			continue
+		}
+
+		if l.cfg.EnableACL && !s.admin && !s.acl.Allowed(l.cfg.Namespace, k, acl.Read) {
+			continue
+		}
+		page = append(page, k)
+	}
+
+	if next >= len(keys) {
+		next = 0
+	}
+
+	c.WriteArray(2)
+	c.WriteBulkString(strconv.Itoa(next))
+	c.WriteArray(len(page))
+	for _, k := range page {
+		c.WriteBulkString(k)
+	}
+}
+
+// literalPrefix returns the part of a glob pattern before the first wildcard,
+// only keys starting with it can match
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
@@ -0,0 +1,150 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/lonelycode/yzma/server/servertest"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRedisClient(t *testing.T) {
+	srv := servertest.Start(t, "resp", nil).Server
+
+	l := &Listener{}
+	if err := l.Start(srv, &RESPCfg{Bind: "127.0.0.1:39811"}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:39811"})
+	defer c.Close()
+
+	if err := c.Set("foo", "bar", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := c.Get("foo").Result(); err != nil || v != "bar" {
+		t.Fatalf("expected bar, got %q %v", v, err)
+	}
+
+	if _, err := c.Get("missing").Result(); err != redis.Nil {
+		t.Fatalf("expected a nil reply for a missing key, got %v", err)
+	}
+
+	// PX expiry
+	if err := c.Set("short", "lived", 100*time.Millisecond).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := c.Exists("short", "foo", "missing").Result(); n != 2 {
+		t.Fatalf("expected 2 keys to exist, got %d", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := c.Get("short").Result(); err != redis.Nil {
+		t.Fatalf("expected the key to expire, got %v", err)
+	}
+
+	if err := c.MSet("a.1", "x", "a.2", "y", "ab", "z").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals, err := c.MGet("a.1", "missing", "ab").Result()
+	if err != nil || !reflect.DeepEqual(vals, []interface{}{"x", nil, "z"}) {
+		t.Fatalf("unexpected MGET reply %v %v", vals, err)
+	}
+
+	if n, err := c.IncrBy("hits", 5).Result(); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %d %v", n, err)
+	}
+
+	if n, err := c.IncrBy("hits", -2).Result(); err != nil || n != 3 {
+		t.Fatalf("expected 3, got %d %v", n, err)
+	}
+
+	if v, _ := c.Get("hits").Result(); v != "3" {
+		t.Fatalf("expected GET to read the counter, got %q", v)
+	}
+
+	if err := c.Incr("foo").Err(); err == nil {
+		t.Fatal("expected INCR of a key holding a value to be refused")
+	}
+
+	if n, err := c.Del("hits").Result(); err != nil || n != 1 {
+		t.Fatalf("expected the counter to be deleted, got %d %v", n, err)
+	}
+
+	if v, _ := c.Get("hits").Result(); v != "0" {
+		t.Fatalf("expected a deleted counter to read 0, got %q", v)
+	}
+
+	// scan in small pages
+	found := []string{}
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor, err = c.Scan(cursor, "a*", 1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, keys...)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, []string{"a.1", "a.2", "ab"}) {
+		t.Fatalf("unexpected SCAN result %v", found)
+	}
+
+	if n, err := c.Del("a.1", "missing", "ab").Result(); err != nil || n != 2 {
+		t.Fatalf("expected 2 keys to be deleted, got %d %v", n, err)
+	}
+
+	if _, err := c.Get("a.1").Result(); err != redis.Nil {
+		t.Fatalf("expected a.1 to be deleted, got %v", err)
+	}
+
+	if v, _ := c.Get("a.2").Result(); v != "y" {
+		t.Fatalf("expected a.2 to be kept, got %q", v)
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	srv := servertest.Start(t, "resp", nil).Server
+
+	l := &Listener{}
+	if err := l.Start(srv, &RESPCfg{Bind: "127.0.0.1:39911"}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:39911")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "HELLO 3\r\n")
+	if line, _ := r.ReadString('\n'); line != "%5\r\n" {
+		t.Fatalf("expected a map reply, got %q", line)
+	}
+
+	// skip the 5 pairs, every entry is a bulk string of two lines except
+	// the integer proto
+	for i := 0; i < 19; i++ {
+		r.ReadString('\n')
+	}
+
+	fmt.Fprint(conn, "GET missing\r\n")
+	if line, _ := r.ReadString('\n'); line != "_\r\n" {
+		t.Fatalf("expected a RESP3 null, got %q", line)
+	}
+}
@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"github.com/lonelycode/yzma/logger"
+	"github.com/spf13/viper"
+)
+
+type S3Cfg struct {
+	Bind       string // e.g. :9000, the API only starts if set
+	EnableACL  bool   // require an access key that is allowed by the ACLs on every request
+	AdminToken string // access key that bypasses the ACLs
+	ChunkSize  int    // size of the values objects are split into, 512KB if not set
+	MaxSize    int64  // largest object or part accepted in bytes, 5GB if not set
+
+	// chunks no object points to are removed every GCIntervalMins (10 if
+	// not set) once they have been unreferenced for GCGraceMins (60 if not
+	// set), so reads and writes in progress keep their chunks
+	GCIntervalMins int
+	GCGraceMins    int
+}
+
+type Config struct {
+	S3 *S3Cfg
+}
+
+var sconf = &Config{}
+
+var log = logger.GetLogger("s3")
+
+func GetConf() *S3Cfg {
+	err := viper.Unmarshal(sconf)
+	if err != nil {
+		log.Fatal("failed to read S3 config: ", err)
+	}
+
+	return sconf.S3
+}
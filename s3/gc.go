@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	defaultGCIntervalMins = 10
+	defaultGCGraceMins    = 60
+)
+
+func (s *S3API) gcInterval() time.Duration {
+	if s.cfg.GCIntervalMins > 0 {
+		return time.Duration(s.cfg.GCIntervalMins) * time.Minute
+	}
+
+	return defaultGCIntervalMins * time.Minute
+}
+
+func (s *S3API) gcGrace() time.Duration {
+	if s.cfg.GCGraceMins > 0 {
+		return time.Duration(s.cfg.GCGraceMins) * time.Minute
+	}
+
+	return defaultGCGraceMins * time.Minute
+}
+
+func (s *S3API) runCollector(stop chan struct{}) {
+	tick := time.NewTicker(s.gcInterval())
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			s.collect(s.gcGrace())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// collect removes the chunks of the uploads no object points to once they
+// have been unreferenced for grace. Objects are replaced and deleted without
+// touching their chunks: a read in progress may still need them, and two
+// nodes replacing an object at the same time each only know the object they
+// replaced, here every node sees the one that lost.
+func (s *S3API) collect(grace time.Duration) {
+	s.gcMtx.Lock()
+	defer s.gcMtx.Unlock()
+
+	namespaces, err := s.server.Namespaces()
+	if err != nil {
+		log.Error("failed to list buckets to collect: ", err)
+		return
+	}
+
+	exists := map[string]bool{}
+	for _, ns := range namespaces {
+		exists[ns] = true
+	}
+
+	now := time.Now()
+	seen := map[string]time.Time{}
+	for _, ns := range namespaces {
+		if !strings.HasSuffix(ns, chunksSuffix) {
+			continue
+		}
+
+		bucket := strings.TrimSuffix(ns, chunksSuffix)
+		uploads, err := s.unreferenced(bucket, exists[bucket])
+		if err != nil {
+			log.Error("failed to collect bucket ", bucket, ": ", err)
+			continue
+		}
+
+		for _, upload := range uploads {
+			id := bucket + "/" + upload
+			first, ok := s.gcSeen[id]
+			if !ok {
+				first = now
+			}
+
+			if now.Sub(first) < grace {
+				seen[id] = first
+				continue
+			}
+
+			s.removeChunks(bucket, upload)
+		}
+	}
+
+	// uploads that are referenced again or gone start over
+	s.gcSeen = seen
+}
+
+// unreferenced returns the uploads of a bucket that have chunks but are
+// neither an object nor a multipart upload in progress, the chunks of the
+// first object put into a bucket are written before the bucket is created
+func (s *S3API) unreferenced(bucket string, exists bool) ([]string, error) {
+	chunks, err := s.server.Keys(chunksNS(bucket), "")
+	if err != nil {
+		return nil, err
+	}
+
+	stored := map[string]bool{}
+	referenced := map[string]bool{}
+	for _, k := range chunks {
+		i := strings.Index(k, "/")
+		if i < 0 {
+			// the description of a multipart upload that is not completed
+			referenced[k] = true
+			continue
+		}
+		stored[k[:i]] = true
+	}
+
+	keys := []string{}
+	if exists && len(stored) > 0 {
+		keys, err = s.server.Keys(bucket, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range keys {
+		dat, _ := s.server.LoadNS(bucket, k)
+		for _, v := range dat {
+			if obj, ok := describe(v); ok {
+				referenced[obj.Upload] = true
+			}
+		}
+	}
+
+	uploads := make([]string, 0)
+	for u := range stored {
+		if !referenced[u] {
+			uploads = append(uploads, u)
+		}
+	}
+
+	return uploads, nil
+}
@@ -0,0 +1,207 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// largest part number S3 accepts
+const maxPartNumber = 10000
+
+// upload is a multipart upload that is not completed yet, it is kept in the
+// chunks namespace under its ID, the chunks and parts under the ID and a /
+type upload struct {
+	Key         string
+	ContentType string
+	Metadata    map[string]string `json:",omitempty"`
+}
+
+// loadUpload returns the upload of key with an ID
+func (s *S3API) loadUpload(bucket, key, id string) (*upload, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return nil, errNoSuchUpload
+	}
+
+	v, ok := s.load(chunksNS(bucket), id)
+	if !ok {
+		return nil, errNoSuchUpload
+	}
+
+	u := &upload{}
+	if err := json.Unmarshal(v.Value, u); err != nil {
+		return nil, err
+	}
+
+	if u.Key != key {
+		return nil, errNoSuchUpload
+	}
+
+	return u, nil
+}
+
+func (s *S3API) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.authorize(w, r, bucket, key, acl.Write) {
+		return
+	}
+
+	data, err := json.Marshal(&upload{Key: key, ContentType: contentType(r), Metadata: metadata(r)})
+	if err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	id := newUploadID()
+	if err := s.server.AddNS(chunksNS(bucket), id, data, "application/json"); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	writeXML(w, http.StatusOK, &struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+// uploadPart stores a part, uploading a part again replaces it
+func (s *S3API) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	if !s.authorize(w, r, bucket, key, acl.Write) {
+		return
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		writeError(w, r, invalidArgument(fmt.Sprintf("Part number must be an integer between 1 and %d", maxPartNumber)))
+		return
+	}
+
+	if _, err := s.loadUpload(bucket, key, id); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	p, err := s.writePart(bucket, id, number, body(r))
+	if err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	if err := s.server.AddNS(chunksNS(bucket), partKey(id, number), data, "application/json"); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(p.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+// completeUpload turns the parts listed by the client into an object, parts
+// that are not listed are kept until the object is removed
+func (s *S3API) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	if !s.authorize(w, r, bucket, key, acl.Write) {
+		return
+	}
+
+	u, err := s.loadUpload(bucket, key, id)
+	if err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	req := &struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}{}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	obj := &object{ContentType: u.ContentType, Metadata: u.Metadata, Upload: id}
+
+	// the ETag of a multipart object is the MD5 of the MD5s of its parts
+	h := md5.New()
+	for i, rp := range req.Parts {
+		if i > 0 && rp.PartNumber <= req.Parts[i-1].PartNumber {
+			writeError(w, r, errInvalidPartOrder)
+			return
+		}
+
+		v, ok := s.load(chunksNS(bucket), partKey(id, rp.PartNumber))
+		if !ok {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+
+		p := &part{}
+		if err := json.Unmarshal(v.Value, p); err != nil {
+			writeError(w, r, errorFor(err))
+			return
+		}
+
+		sum, err := hex.DecodeString(p.ETag)
+		if err != nil || strings.Trim(rp.ETag, `"`) != p.ETag {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+
+		h.Write(sum)
+		obj.Size += p.Size
+		obj.Parts = append(obj.Parts, p)
+	}
+	obj.ETag = fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(obj.Parts))
+
+	if err := s.store(bucket, key, obj); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	if err := s.server.RemoveNS(chunksNS(bucket), id); err != nil {
+		log.Error("failed to remove completed upload ", id, ": ", err)
+	}
+
+	writeXML(w, http.StatusOK, &struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: strconv.Quote(obj.ETag)})
+}
+
+func (s *S3API) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	if !s.authorize(w, r, bucket, key, acl.Write) {
+		return
+	}
+
+	if _, err := s.loadUpload(bucket, key, id); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	// the parts are left to the collector, the upload may have been
+	// completed on another node
+	if err := s.server.RemoveNS(chunksNS(bucket), id); err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,544 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/types/crdt"
+	"github.com/satori/go.uuid"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChunkSize = 512 * 1024
+	defaultMaxSize   = 5 << 30
+	defaultMaxKeys   = 1000
+
+	// objectType is the mime type of the values describing objects, their
+	// data is in the chunks they point to
+	objectType = "application/vnd.yzma.s3-object+json"
+	chunkType  = "application/octet-stream"
+
+	// the chunks of a bucket are kept in the namespace named after it with
+	// this suffix, no bucket has an underscore in its name
+	chunksSuffix = "_chunks"
+)
+
+// object is the value of the key of an object, its data is split into chunks
+// that are stored separately, so that no single value gets large
+type object struct {
+	Size        int64
+	ETag        string
+	ContentType string
+	Metadata    map[string]string `json:",omitempty"`
+	Upload      string            // the keys of the chunks start with this and a /
+	Parts       []*part
+}
+
+// part is a part of a multipart upload, an object put in one go has a single
+// part
+type part struct {
+	Number    int
+	Size      int64
+	ETag      string
+	ChunkSize int64
+}
+
+func chunksNS(bucket string) string {
+	return bucket + chunksSuffix
+}
+
+func partKey(upload string, number int) string {
+	return fmt.Sprintf("%s/%05d", upload, number)
+}
+
+func chunkKey(upload string, number int, n int64) string {
+	return fmt.Sprintf("%s/%06d", partKey(upload, number), n)
+}
+
+func newUploadID() string {
+	return strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
+
+func (s *S3API) chunkSize() int64 {
+	if s.cfg.ChunkSize > 0 {
+		return int64(s.cfg.ChunkSize)
+	}
+
+	return defaultChunkSize
+}
+
+func (s *S3API) maxSize() int64 {
+	if s.cfg.MaxSize > 0 {
+		return s.cfg.MaxSize
+	}
+
+	return defaultMaxSize
+}
+
+// describe returns the object a value stands for, values that were not
+// written through this API are objects of their own
+func describe(v *crdt.TSValue) (*object, bool) {
+	if v.MimeType == objectType {
+		obj := &object{}
+		if err := json.Unmarshal(v.Value, obj); err != nil {
+			log.Error("failed to decode object: ", err)
+			return nil, false
+		}
+		return obj, true
+	}
+
+	sum := md5.Sum(v.Value)
+	return &object{Size: int64(len(v.Value)), ETag: hex.EncodeToString(sum[:]), ContentType: v.MimeType}, false
+}
+
+// load returns the newest value of a key, objects have no siblings
+func (s *S3API) load(ns, key string) (*crdt.TSValue, bool) {
+	dat, ok := s.server.LoadNS(ns, key)
+	if !ok || len(dat) == 0 {
+		return nil, false
+	}
+
+	return dat.Newest(), true
+}
+
+// fill reads until buf is full or the reader ends
+func fill(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// writePart stores the data of a part as chunks
+func (s *S3API) writePart(bucket, upload string, number int, data io.Reader) (*part, error) {
+	p := &part{Number: number, ChunkSize: s.chunkSize()}
+	h := md5.New()
+	data = io.LimitReader(data, s.maxSize()+1)
+
+	for n := int64(0); ; n++ {
+		// the value keeps the buffer, so every chunk gets its own
+		buf := make([]byte, p.ChunkSize)
+		read, err := fill(data, buf)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		p.Size += int64(read)
+		if p.Size > s.maxSize() {
+			return nil, errTooLarge
+		}
+
+		if read > 0 {
+			h.Write(buf[:read])
+			if err := s.server.AddNS(chunksNS(bucket), chunkKey(upload, number, n), buf[:read], chunkType); err != nil {
+				return nil, err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	p.ETag = hex.EncodeToString(h.Sum(nil))
+	return p, nil
+}
+
+// store writes the value of an object, the chunks of the object it replaces
+// are left to the collector
+func (s *S3API) store(bucket, key string, obj *object) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	return s.server.AddNS(bucket, key, data, objectType)
+}
+
+func (s *S3API) removeChunks(bucket, upload string) {
+	if _, err := s.server.RemovePrefix(chunksNS(bucket), upload+"/", server.ConcernLocal); err != nil {
+		log.Error("failed to remove the chunks of upload ", upload, ": ", err)
+	}
+}
+
+func setMetadata(w http.ResponseWriter, obj *object) {
+	for k, v := range obj.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+}
+
+// metadata returns the user metadata sent with a request
+func metadata(r *http.Request) map[string]string {
+	var meta map[string]string
+	for k := range r.Header {
+		if !strings.HasPrefix(k, "X-Amz-Meta-") {
+			continue
+		}
+
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[strings.TrimPrefix(k, "X-Amz-Meta-")] = r.Header.Get(k)
+	}
+
+	return meta
+}
+
+func contentType(r *http.Request) string {
+	if t := r.Header.Get("Content-Type"); t != "" {
+		return t
+	}
+
+	return "binary/octet-stream"
+}
+
+func (s *S3API) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.authorize(w, r, bucket, key, acl.Write) {
+		return
+	}
+
+	upload := newUploadID()
+	p, err := s.writePart(bucket, upload, 1, body(r))
+	if err != nil {
+		s.removeChunks(bucket, upload)
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	obj := &object{
+		Size:        p.Size,
+		ETag:        p.ETag,
+		ContentType: contentType(r),
+		Metadata:    metadata(r),
+		Upload:      upload,
+		Parts:       []*part{p},
+	}
+
+	if err := s.store(bucket, key, obj); err != nil {
+		s.removeChunks(bucket, upload)
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(obj.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+// byteRange reads the Range header of a request, the end is inclusive. A
+// header that can't be read or asks for several ranges is ignored, as it is
+// by S3.
+func byteRange(r *http.Request, size int64) (int64, int64, bool, error) {
+	h := r.Header.Get("Range")
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return 0, size - 1, false, nil
+	}
+
+	bounds := strings.SplitN(strings.TrimPrefix(h, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, size - 1, false, nil
+	}
+
+	start, end := int64(0), size-1
+	if bounds[0] == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, size - 1, false, nil
+		}
+		if n < size {
+			start = size - n
+		}
+	} else {
+		n, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return 0, size - 1, false, nil
+		}
+		start = n
+
+		if bounds[1] != "" {
+			e, err := strconv.ParseInt(bounds[1], 10, 64)
+			if err != nil || e < start {
+				return 0, size - 1, false, nil
+			}
+			if e < end {
+				end = e
+			}
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+
+	return start, end, true, nil
+}
+
+// getObject serves GetObject and HeadObject
+func (s *S3API) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.authorize(w, r, bucket, key, acl.Read) {
+		return
+	}
+
+	v, ok := s.load(bucket, key)
+	if !ok {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+
+	obj, chunked := describe(v)
+	if obj == nil {
+		writeError(w, r, internalError(fmt.Errorf("object %s/%s can't be read", bucket, key)))
+		return
+	}
+
+	start, end, partial, err := byteRange(r, obj.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Size))
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("ETag", strconv.Quote(obj.ETag))
+	w.Header().Set("Last-Modified", time.Unix(0, v.TS).UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	setMetadata(w, obj)
+
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, obj.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == "HEAD" || obj.Size == 0 {
+		return
+	}
+
+	if !chunked {
+		w.Write(v.Value[start : end+1])
+		return
+	}
+
+	if err := s.copyRange(w, bucket, obj, start, end); err != nil {
+		// the status is sent, the client sees a short body, this only
+		// happens to reads that outlast the collector's grace period
+		log.Error("failed to read object ", bucket, "/", key, ": ", err)
+	}
+}
+
+// copyRange writes the bytes of an object from start to end
+func (s *S3API) copyRange(w io.Writer, bucket string, obj *object, start, end int64) error {
+	offset := int64(0)
+	for _, p := range obj.Parts {
+		if offset > end {
+			break
+		}
+
+		for n := int64(0); n*p.ChunkSize < p.Size; n++ {
+			from := offset + n*p.ChunkSize
+			to := from + p.ChunkSize - 1
+			if to >= offset+p.Size {
+				// the last chunk of a part is short
+				to = offset + p.Size - 1
+			}
+			if to < start {
+				continue
+			}
+			if from > end {
+				break
+			}
+
+			v, ok := s.load(chunksNS(bucket), chunkKey(obj.Upload, p.Number, n))
+			if !ok {
+				return fmt.Errorf("chunk %d of part %d is missing, the object was collected", n, p.Number)
+			}
+
+			data := v.Value
+			if end < to {
+				data = data[:end-from+1]
+			}
+			if start > from {
+				data = data[start-from:]
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+
+		offset += p.Size
+	}
+
+	return nil
+}
+
+func (s *S3API) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.authorize(w, r, bucket, key, acl.Delete) {
+		return
+	}
+
+	// deleting a missing object succeeds, its chunks are left to the
+	// collector
+	if old, ok := s.server.LoadNS(bucket, key); ok && len(old) > 0 {
+		if err := s.server.RemoveNS(bucket, key); err != nil {
+			writeError(w, r, errorFor(err))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []*listEntry
+	CommonPrefixes        []*commonPrefix
+}
+
+// listObjects serves ListObjectsV2, the continuation token is the last key or
+// common prefix returned
+func (s *S3API) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	res := &listResult{
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           defaultMaxKeys,
+	}
+
+	if !s.authorize(w, r, bucket, res.Prefix, acl.Read) {
+		return
+	}
+
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, invalidArgument("max-keys must be a positive number"))
+			return
+		}
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+
+	after := res.StartAfter
+	skipPrefix := ""
+	if res.ContinuationToken != "" {
+		tok, err := base64.URLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			writeError(w, r, invalidArgument("The continuation token provided is incorrect"))
+			return
+		}
+		after = string(tok)
+
+		// every key of a common prefix was returned with it
+		if res.Delimiter != "" && strings.Contains(strings.TrimPrefix(after, res.Prefix), res.Delimiter) {
+			skipPrefix = after
+		}
+	}
+
+	keys, err := s.server.Keys(bucket, res.Prefix)
+	if err != nil {
+		writeError(w, r, errorFor(err))
+		return
+	}
+
+	last := ""
+	for _, k := range keys {
+		if k <= after || (skipPrefix != "" && strings.HasPrefix(k, skipPrefix)) {
+			continue
+		}
+
+		if res.Delimiter != "" {
+			if i := strings.Index(k[len(res.Prefix):], res.Delimiter); i >= 0 {
+				cp := k[:len(res.Prefix)+i+len(res.Delimiter)]
+				if cp == last {
+					continue
+				}
+
+				if res.KeyCount == res.MaxKeys {
+					res.IsTruncated = true
+					break
+				}
+
+				res.CommonPrefixes = append(res.CommonPrefixes, &commonPrefix{Prefix: cp})
+				res.KeyCount++
+				last = cp
+				continue
+			}
+		}
+
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+
+		// the key may have been removed since it was listed
+		v, ok := s.load(bucket, k)
+		if !ok {
+			continue
+		}
+
+		obj, _ := describe(v)
+		if obj == nil {
+			continue
+		}
+
+		res.Contents = append(res.Contents, &listEntry{
+			Key:          k,
+			LastModified: time.Unix(0, v.TS).UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         strconv.Quote(obj.ETag),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+		res.KeyCount++
+		last = k
+	}
+
+	if res.IsTruncated && last != "" {
+		res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
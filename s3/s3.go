@@ -0,0 +1,328 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket names are a subset of the namespace names, they can't contain the
+// underscore that the namespaces holding chunks use
+var validBucket = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// S3API serves a subset of the S3 API on top of a server, buckets are
+// namespaces
+type S3API struct {
+	server *server.Server
+	cfg    *S3Cfg
+	http   *http.Server
+	mtx    sync.Mutex
+	stop   chan struct{}
+
+	gcMtx  sync.Mutex
+	gcSeen map[string]time.Time // when an upload was first seen unreferenced
+}
+
+// Start listens on cfg.Bind, it returns once the listener is ready
+func (s *S3API) Start(srv *server.Server, cfg *S3Cfg) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ln, err := net.Listen("tcp", cfg.Bind)
+	if err != nil {
+		return err
+	}
+
+	s.server = srv
+	s.cfg = cfg
+
+	// keys are not paths, a//b and ../a are valid keys
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/{bucket}", s.Bucket).Methods("GET")
+	r.HandleFunc("/{bucket}/", s.Bucket).Methods("GET")
+	r.HandleFunc("/{bucket}/{key:.+}", s.Object)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errNotImplemented)
+	})
+	s.http = &http.Server{Handler: r}
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+
+	s.stop = make(chan struct{})
+	go s.runCollector(s.stop)
+
+	log.Info("S3 API listening on ", cfg.Bind)
+	return nil
+}
+
+func (s *S3API) Stop() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.http == nil {
+		return nil
+	}
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
+	return s.http.Close()
+}
+
+// Bucket handles the requests made to a bucket
+func (s *S3API) Bucket(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+	if !validBucket.MatchString(bucket) {
+		writeError(w, r, errInvalidBucketName)
+		return
+	}
+
+	q := r.URL.Query()
+	if _, ok := q["location"]; ok {
+		// every bucket is in the default region
+		writeXML(w, http.StatusOK, &struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		}{})
+		return
+	}
+
+	if q.Get("list-type") != "2" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	s.listObjects(w, r, bucket)
+}
+
+// Object handles the requests made to an object and its multipart uploads
+func (s *S3API) Object(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket, key := vars["bucket"], vars["key"]
+	if !validBucket.MatchString(bucket) {
+		writeError(w, r, errInvalidBucketName)
+		return
+	}
+
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == "GET" && uploadID == "":
+		s.getObject(w, r, bucket, key)
+	case r.Method == "HEAD":
+		s.getObject(w, r, bucket, key)
+	case r.Method == "PUT" && uploadID != "":
+		s.uploadPart(w, r, bucket, key, uploadID)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") == "":
+		s.putObject(w, r, bucket, key)
+	case r.Method == "DELETE" && uploadID != "":
+		s.abortUpload(w, r, bucket, key, uploadID)
+	case r.Method == "DELETE":
+		s.deleteObject(w, r, bucket, key)
+	case r.Method == "POST" && uploads:
+		s.createUpload(w, r, bucket, key)
+	case r.Method == "POST" && uploadID != "":
+		s.completeUpload(w, r, bucket, key, uploadID)
+	default:
+		writeError(w, r, errNotImplemented)
+	}
+}
+
+// accessKey returns the access key a request is signed with, it is used as
+// the token, the signature is not checked
+func accessKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		// Credential=<key>/<date>/<region>/s3/aws4_request, SignedHeaders=...
+		i := strings.Index(auth, "Credential=")
+		if i < 0 {
+			return ""
+		}
+		return strings.SplitN(auth[i+len("Credential="):], "/", 2)[0]
+	case strings.HasPrefix(auth, "AWS "):
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	}
+
+	// presigned URLs
+	return strings.SplitN(r.URL.Query().Get("X-Amz-Credential"), "/", 2)[0]
+}
+
+// authorize checks the access key of a request against the ACLs, if the
+// request can't go ahead the error is written to the client
+func (s *S3API) authorize(w http.ResponseWriter, r *http.Request, bucket, key string, op acl.Operation) bool {
+	if !s.cfg.EnableACL {
+		return true
+	}
+
+	err := s.server.Authorize(accessKey(r), s.cfg.AdminToken, bucket, key, op)
+	switch err.(type) {
+	case nil:
+		return true
+	case *server.DeniedError:
+		writeError(w, r, errAccessDenied)
+	default:
+		if err == server.ErrNoToken || err == server.ErrUnknownToken {
+			writeError(w, r, errInvalidAccessKey)
+		} else {
+			writeError(w, r, internalError(err))
+		}
+	}
+
+	return false
+}
+
+// apiError is an error as S3 reports it
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+var (
+	errAccessDenied      = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errInvalidAccessKey  = &apiError{"InvalidAccessKeyId", "The access key does not exist", http.StatusForbidden}
+	errInvalidBucketName = &apiError{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	errNoSuchKey         = &apiError{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload      = &apiError{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errInvalidPart       = &apiError{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder  = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errMalformedXML      = &apiError{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errInvalidRange      = &apiError{"InvalidRange", "The requested range is not satisfiable", http.StatusRequestedRangeNotSatisfiable}
+	errTooLarge          = &apiError{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed size", http.StatusBadRequest}
+	errIncompleteBody    = &apiError{"IncompleteBody", "You did not provide the number of bytes specified", http.StatusBadRequest}
+	errMalformedChunk    = &apiError{"InvalidArgument", "The chunked body is malformed", http.StatusBadRequest}
+	errNotImplemented    = &apiError{"NotImplemented", "This operation is not supported", http.StatusNotImplemented}
+)
+
+func invalidArgument(msg string) *apiError {
+	return &apiError{"InvalidArgument", msg, http.StatusBadRequest}
+}
+
+func internalError(err error) *apiError {
+	log.Error(err)
+	return &apiError{"InternalError", "We encountered an internal error, please try again", http.StatusInternalServerError}
+}
+
+// errorFor turns an error into the S3 error reported for it
+func errorFor(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+
+	return internalError(err)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(e.Status)
+		return
+	}
+
+	writeXML(w, e.Status, &struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// body returns the data sent with a request, decoding it if it was sent in
+// signed chunks
+func body(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return &chunkedReader{r: bufio.NewReader(r.Body)}
+	}
+
+	return r.Body
+}
+
+// chunkedReader decodes an aws-chunked body, the chunk signatures and the
+// trailing checksums are not checked
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64 // bytes left in the current chunk
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.left == 0 {
+		// <hex size>[;chunk-signature=<signature>]\r\n
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, errIncompleteBody
+		}
+
+		size := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n < 0 {
+			return 0, errMalformedChunk
+		}
+
+		if n == 0 {
+			// only trailers follow
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		return n, errIncompleteBody
+	}
+
+	if err == nil && c.left == 0 {
+		// every chunk ends with a CRLF
+		if _, err := c.r.Discard(2); err != nil {
+			return n, errIncompleteBody
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,448 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server/servertest"
+	"github.com/minio/minio-go"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func read(t *testing.T, c *minio.Client, bucket, key string, opts minio.GetObjectOptions) []byte {
+	obj, err := c.GetObject(bucket, key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestObjects(t *testing.T) {
+	srv := servertest.Start(t, "s3", nil).Server
+
+	a := &S3API{}
+	if err := a.Start(srv, &S3Cfg{Bind: "127.0.0.1:40511", ChunkSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	c, err := minio.New("127.0.0.1:40511", "key", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(3000)
+	opts := minio.PutObjectOptions{ContentType: "text/plain", UserMetadata: map[string]string{"Owner": "build"}}
+	if _, err := c.PutObject("artifacts", "docs/a.txt", bytes.NewReader(data), int64(len(data)), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.StatObject("artifacts", "docs/a.txt", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 3000 || info.ETag != md5Hex(data) || info.ContentType != "text/plain" || info.Metadata.Get("X-Amz-Meta-Owner") != "build" {
+		t.Fatalf("unexpected object info %+v", info)
+	}
+
+	if got := read(t, c, "artifacts", "docs/a.txt", minio.GetObjectOptions{}); !bytes.Equal(got, data) {
+		t.Fatal("object data does not match")
+	}
+
+	// the range spans three chunks
+	ranged := minio.GetObjectOptions{}
+	ranged.SetRange(1000, 2100)
+	if got := read(t, c, "artifacts", "docs/a.txt", ranged); !bytes.Equal(got, data[1000:2101]) {
+		t.Fatal("ranged data does not match")
+	}
+
+	// the chunks of a replaced object are collected
+	data = randomData(1500)
+	if _, err := c.PutObject("artifacts", "docs/a.txt", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(t, c, "artifacts", "docs/a.txt", minio.GetObjectOptions{}); !bytes.Equal(got, data) {
+		t.Fatal("replaced object data does not match")
+	}
+
+	a.collect(0)
+	if chunks, _ := srv.Keys(chunksNS("artifacts"), ""); len(chunks) != 2 {
+		t.Fatalf("expected the 2 chunks of the new object, got %v", chunks)
+	}
+
+	for _, k := range []string{"docs/b.txt", "img/c.png", "top"} {
+		if _, err := c.PutObject("artifacts", k, bytes.NewReader([]byte(k)), int64(len(k)), minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := []string{}
+	for obj := range c.ListObjectsV2("artifacts", "", true, nil) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+
+	if fmt.Sprint(keys) != "[docs/a.txt docs/b.txt img/c.png top]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// page through the top level one entry at a time
+	core := minio.Core{Client: c}
+	keys = keys[:0]
+	token := ""
+	for {
+		res, err := core.ListObjectsV2("artifacts", "", token, false, "/", 1, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range res.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		for _, obj := range res.Contents {
+			keys = append(keys, obj.Key)
+		}
+
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+
+	if fmt.Sprint(keys) != "[docs/ img/ top]" {
+		t.Fatalf("unexpected top level %v", keys)
+	}
+
+	for _, k := range []string{"docs/a.txt", "docs/b.txt", "img/c.png", "top"} {
+		if err := c.RemoveObject("artifacts", k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = c.StatObject("artifacts", "top", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).StatusCode != 404 {
+		t.Fatalf("expected a removed object to be missing, got %v", err)
+	}
+
+	obj, err := c.GetObject("artifacts", "top", minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := obj.Stat(); minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Fatalf("expected NoSuchKey, got %v", err)
+	}
+
+	a.collect(0)
+	if chunks, _ := srv.Keys(chunksNS("artifacts"), ""); len(chunks) != 0 {
+		t.Fatalf("expected every chunk to be removed, got %v", chunks)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	srv := servertest.Start(t, "s3", nil).Server
+
+	a := &S3API{}
+	if err := a.Start(srv, &S3Cfg{Bind: "127.0.0.1:40611", ChunkSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	core, err := minio.NewCore("127.0.0.1:40611", "key", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := core.NewMultipartUpload("builds", "release.tar", minio.PutObjectOptions{ContentType: "application/x-tar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts can be uploaded in any order and again
+	data := [][]byte{randomData(2500), randomData(700), randomData(100)}
+	parts := make([]minio.CompletePart, len(data))
+	for _, i := range []int{1, 0, 2, 1} {
+		p, err := core.PutObjectPart("builds", "release.tar", id, i+1, bytes.NewReader(data[i]), int64(len(data[i])), "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[i] = minio.CompletePart{PartNumber: i + 1, ETag: p.ETag}
+	}
+
+	// an unknown ETag fails the upload
+	bad := []minio.CompletePart{parts[0], {PartNumber: 2, ETag: "0123"}}
+	if _, err := core.CompleteMultipartUpload("builds", "release.tar", id, bad); minio.ToErrorResponse(err).Code != "InvalidPart" {
+		t.Fatalf("expected InvalidPart, got %v", err)
+	}
+
+	// only the listed parts make up the object
+	etag, err := core.CompleteMultipartUpload("builds", "release.tar", id, parts[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums := md5.Sum(append(md5Sum(data[0]), md5Sum(data[1])...))
+	if etag != `"`+hex.EncodeToString(sums[:])+`-2"` {
+		t.Fatalf("unexpected multipart ETag %s", etag)
+	}
+
+	want := append(append([]byte{}, data[0]...), data[1]...)
+	if got := read(t, core.Client, "builds", "release.tar", minio.GetObjectOptions{}); !bytes.Equal(got, want) {
+		t.Fatal("multipart object data does not match")
+	}
+
+	ranged := minio.GetObjectOptions{}
+	ranged.SetRange(2000, 2999)
+	if got := read(t, core.Client, "builds", "release.tar", ranged); !bytes.Equal(got, want[2000:3000]) {
+		t.Fatal("ranged data across parts does not match")
+	}
+
+	info, err := core.StatObject("builds", "release.tar", minio.StatObjectOptions{})
+	if err != nil || info.Size != 3200 || info.ContentType != "application/x-tar" {
+		t.Fatalf("unexpected object info %+v, %v", info, err)
+	}
+
+	if _, err := core.PutObjectPart("builds", "release.tar", id, 1, bytes.NewReader(data[0]), 2500, "", "", nil); minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		t.Fatalf("expected the completed upload to be gone, got %v", err)
+	}
+
+	// an aborted upload leaves nothing behind
+	id, err = core.NewMultipartUpload("builds", "aborted.tar", minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := core.PutObjectPart("builds", "aborted.tar", id, 1, bytes.NewReader(data[0]), 2500, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := core.AbortMultipartUpload("builds", "aborted.tar", id); err != nil {
+		t.Fatal(err)
+	}
+
+	a.collect(0)
+	if keys, _ := srv.Keys(chunksNS("builds"), id); len(keys) != 0 {
+		t.Fatalf("expected the aborted upload to be removed, got %v", keys)
+	}
+}
+
+// writeFunc calls fn before the first write
+type writeFunc struct {
+	bytes.Buffer
+	fn func()
+}
+
+func (w *writeFunc) Write(p []byte) (int, error) {
+	if w.fn != nil {
+		w.fn()
+		w.fn = nil
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestReadDuringReplace(t *testing.T) {
+	srv := servertest.Start(t, "s3", nil).Server
+
+	a := &S3API{}
+	if err := a.Start(srv, &S3Cfg{Bind: "127.0.0.1:40811", ChunkSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	c, err := minio.New("127.0.0.1:40811", "key", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(5000)
+	if _, err := c.PutObject("artifacts", "a.bin", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := a.load("artifacts", "a.bin")
+	obj, _ := describe(v)
+
+	// the object is replaced and the collector runs after the first chunk
+	// of the old one was sent
+	w := &writeFunc{fn: func() {
+		if _, err := c.PutObject("artifacts", "a.bin", bytes.NewReader([]byte("new")), 3, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		a.collect(a.gcGrace())
+	}}
+
+	if err := a.copyRange(w, "artifacts", obj, 0, obj.Size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(w.Bytes(), data) {
+		t.Fatal("expected the whole old object to be read")
+	}
+}
+
+func TestConcurrentReplace(t *testing.T) {
+	nodes := []*servertest.Node{servertest.Start(t, "s3a", nil), servertest.Start(t, "s3b", nil)}
+	if err := nodes[1].Join([]string{nodes[0].Addr}); err != nil {
+		t.Fatal(err)
+	}
+
+	apis := make([]*S3API, len(nodes))
+	clients := make([]*minio.Client, len(nodes))
+	for i, n := range nodes {
+		bind := fmt.Sprintf("127.0.0.1:%d", 40911+i)
+		apis[i] = &S3API{}
+		if err := apis[i].Start(n.Server, &S3Cfg{Bind: bind, ChunkSize: 1024}); err != nil {
+			t.Fatal(err)
+		}
+		defer apis[i].Stop()
+
+		c, err := minio.New(bind, "key", "secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = c
+	}
+
+	// both nodes replace the object at the same time, each only knows the
+	// object it replaced
+	errs := make(chan error, len(clients))
+	for _, c := range clients {
+		go func(c *minio.Client) {
+			data := randomData(3000)
+			_, err := c.PutObject("artifacts", "a.bin", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+			errs <- err
+		}(c)
+	}
+
+	for range clients {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// once both nodes agree on the winner only its chunks are left
+	winner := func(i int) string {
+		v, ok := apis[i].load("artifacts", "a.bin")
+		if !ok {
+			return ""
+		}
+		obj, _ := describe(v)
+		return obj.Upload
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := winner(0)
+		chunks, _ := nodes[1].Keys(chunksNS("artifacts"), "")
+		if w != "" && w == winner(1) && len(chunks) == 6 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes did not converge, winners %s and %s, %d chunks", w, winner(1), len(chunks))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	apis[0].collect(0)
+	for {
+		chunks, _ := nodes[1].Keys(chunksNS("artifacts"), "")
+		if len(chunks) == 3 && strings.HasPrefix(chunks[0], winner(1)+"/") {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the chunks of the winner to be left, got %v", chunks)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func md5Sum(data []byte) []byte {
+	sum := md5.Sum(data)
+	return sum[:]
+}
+
+func TestACL(t *testing.T) {
+	srv := servertest.Start(t, "s3", nil).Server
+
+	a := &S3API{}
+	if err := a.Start(srv, &S3Cfg{Bind: "127.0.0.1:40711", EnableACL: true, AdminToken: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	err := srv.SetACL("reader", &acl.ACL{
+		Principal: "reader",
+		Rules:     []acl.Rule{{Namespace: "pub", Ops: []acl.Operation{acl.Read}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, _ := minio.New("127.0.0.1:40711", "admin", "secret", false)
+	reader, _ := minio.New("127.0.0.1:40711", "reader", "secret", false)
+	unknown, _ := minio.New("127.0.0.1:40711", "unknown", "secret", false)
+
+	if _, err := admin.PutObject("pub", "x", bytes.NewReader([]byte("x")), 1, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(t, reader, "pub", "x", minio.GetObjectOptions{}); string(got) != "x" {
+		t.Fatalf("expected the reader to read pub/x, got %q", got)
+	}
+
+	_, err = reader.PutObject("pub", "x", bytes.NewReader([]byte("y")), 1, minio.PutObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "AccessDenied" {
+		t.Fatalf("expected the reader not to write, got %v", err)
+	}
+
+	_, err = unknown.StatObject("pub", "x", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).StatusCode != 403 {
+		t.Fatalf("expected an unknown key to be refused, got %v", err)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	body := "5;chunk-signature=ab\r\nhello\r\n6;chunk-signature=cd\r\n world\r\n0;chunk-signature=ef\r\nx-amz-checksum-crc32:AAAA\r\n\r\n"
+	got, err := ioutil.ReadAll(&chunkedReader{r: bufio.NewReader(strings.NewReader(body))})
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("unexpected body %q, %v", got, err)
+	}
+
+	// a body that ends early is an error
+	_, err = ioutil.ReadAll(&chunkedReader{r: bufio.NewReader(strings.NewReader("5;chunk-signature=ab\r\nhel"))})
+	if err != errIncompleteBody {
+		t.Fatalf("expected an incomplete body, got %v", err)
+	}
+}
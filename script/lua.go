@@ -0,0 +1,280 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lonelycode/yzma/logger"
+	"github.com/lonelycode/yzma/types/crdt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"io/ioutil"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var log = logger.GetLogger("script")
+
+const (
+	DefaultTimeoutMs   = 50
+	DefaultMaxStack    = 64 * 1024 // values on the Lua stack
+	DefaultMaxMemoryMB = 64
+	maxCallDepth       = 64
+	maxStringRep       = 1024 * 1024
+
+	// how often the allocations of a running script are checked
+	memCheckInterval = time.Millisecond
+)
+
+// ErrMemoryLimit is returned for scripts stopped for allocating too much
+var ErrMemoryLimit = errors.New("merge script allocated too much memory")
+
+// Config registers a Lua merge function for all keys with Prefix, the
+// script must define a global function merge(values) that returns the
+// surfaced value as a string
+type Config struct {
+	Prefix      string
+	File        string // path to the script
+	Source      string // inline script, used if File is empty
+	TimeoutMs   int    // max run time of a single merge
+	MaxStack    int    // max number of values on the Lua stack
+	MaxMemoryMB int    // max memory a single merge may allocate
+}
+
+// MergeFunc is a compiled, sandboxed Lua merge function
+type MergeFunc struct {
+	name      string
+	proto     *lua.FunctionProto
+	timeout   time.Duration
+	maxStack  int
+	maxMemory uint64
+}
+
+// Load reads and compiles the script of a config
+func Load(cfg *Config) (*MergeFunc, error) {
+	src := cfg.Source
+	if cfg.File != "" {
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		src = string(b)
+	}
+
+	if src == "" {
+		return nil, fmt.Errorf("merge script for %s has no source", cfg.Prefix)
+	}
+
+	return Compile(cfg.Prefix, src, cfg.TimeoutMs, cfg.MaxStack, cfg.MaxMemoryMB)
+}
+
+func Compile(name, src string, timeoutMs, maxStack, maxMemoryMB int) (*MergeFunc, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeoutMs <= 0 {
+		timeoutMs = DefaultTimeoutMs
+	}
+
+	if maxStack <= 0 {
+		maxStack = DefaultMaxStack
+	}
+
+	if maxMemoryMB <= 0 {
+		maxMemoryMB = DefaultMaxMemoryMB
+	}
+
+	return &MergeFunc{
+		name:      name,
+		proto:     proto,
+		timeout:   time.Duration(timeoutMs) * time.Millisecond,
+		maxStack:  maxStack,
+		maxMemory: uint64(maxMemoryMB) * 1024 * 1024,
+	}, nil
+}
+
+// allocated returns how many bytes the process has allocated so far
+func allocated() uint64 {
+	s := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(s)
+	return s[0].Value.Uint64()
+}
+
+// limitMemory cancels a running script once more than max bytes have been
+// allocated since it started. Go can't count the allocations of a single
+// goroutine, so those of the rest of the process count too and a busy node
+// may stop a script early, which then falls back like a timeout
+func limitMemory(ctx context.Context, cancel func(), max uint64, exceeded *int32) {
+	start := allocated()
+	tick := time.NewTicker(memCheckInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if allocated()-start > max {
+				atomic.StoreInt32(exceeded, 1)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sandbox creates a fresh Lua state with only the safe parts of the standard
+// library, so scripts can't touch the file system or keep state between runs
+func (m *MergeFunc) sandbox() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   maxCallDepth,
+		RegistrySize:    1024,
+		RegistryMaxSize: m.maxStack,
+	})
+
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, unsafe := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+
+	// string.rep is the easiest way to allocate a lot of memory in one call
+	strLib := L.GetGlobal("string").(*lua.LTable)
+	rep := strLib.RawGetString("rep")
+	strLib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		if len(L.CheckString(1))*L.CheckInt(2) > maxStringRep {
+			L.RaiseError("string.rep result too large")
+		}
+
+		L.Push(rep)
+		L.Push(L.Get(1))
+		L.Push(L.Get(2))
+		L.Call(2, 1)
+		return 1
+	}))
+
+	return L
+}
+
+// Merge runs the script against all sibling values, the returned payload has
+// a single value with the newest timestamp of the siblings
+func (m *MergeFunc) Merge(values crdt.Payload) (crdt.Payload, error) {
+	ids := make([]string, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+
+	// scripts see the siblings in the same order on every node
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := values[ids[i]], values[ids[j]]
+		if a.TS != b.TS {
+			return a.TS < b.TS
+		}
+		return ids[i] < ids[j]
+	})
+
+	L := m.sandbox()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	var exceeded int32
+	go limitMemory(ctx, cancel, m.maxMemory, &exceeded)
+
+	// a script stopped for its memory reports a cancelled context
+	failed := func(err error) error {
+		if atomic.LoadInt32(&exceeded) == 1 {
+			return ErrMemoryLimit
+		}
+		return err
+	}
+
+	L.Push(L.NewFunctionFromProto(m.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, failed(err)
+	}
+
+	fn, ok := L.GetGlobal("merge").(*lua.LFunction)
+	if !ok {
+		return nil, errors.New("script does not define a merge function")
+	}
+
+	arg := L.NewTable()
+	for _, id := range ids {
+		v := values[id]
+		t := L.NewTable()
+		t.RawSetString("id", lua.LString(id))
+		// a float64 can't hold a nanosecond timestamp, ts keeps it as a
+		// string, sec and nsec as numbers
+		t.RawSetString("ts", lua.LString(strconv.FormatInt(v.TS, 10)))
+		t.RawSetString("sec", lua.LNumber(v.TS/int64(time.Second)))
+		t.RawSetString("nsec", lua.LNumber(v.TS%int64(time.Second)))
+		t.RawSetString("value", lua.LString(v.Value))
+		t.RawSetString("mime", lua.LString(v.MimeType))
+		arg.Append(t)
+	}
+
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, arg)
+	if err != nil {
+		return nil, failed(err)
+	}
+
+	ret := L.Get(-1)
+	str, ok := ret.(lua.LString)
+	if !ok {
+		return nil, fmt.Errorf("merge must return a string, got %s", ret.Type())
+	}
+
+	newest := values[ids[len(ids)-1]]
+	return crdt.Payload{ids[len(ids)-1]: &crdt.TSValue{
+		TS:       newest.TS,
+		Value:    []byte(string(str)),
+		MimeType: newest.MimeType,
+		VV:       values.Context(),
+	}}, nil
+}
+
+// Resolver wraps the merge function as a collision strategy, if the script
+// fails the newest value is surfaced instead so reads never fail
+func (m *MergeFunc) Resolver() crdt.Resolver {
+	lww, _ := crdt.GetResolver(crdt.LWWStrat)
+	return func(values crdt.Payload) crdt.Payload {
+		if len(values) < 2 {
+			return values
+		}
+
+		merged, err := m.Merge(values)
+		if err != nil {
+			log.Error("merge script ", m.name, " failed, falling back to lww: ", err)
+			return lww(values)
+		}
+
+		return merged
+	}
+}
@@ -0,0 +1,140 @@
+package script
+
+import (
+	"github.com/lonelycode/yzma/types/crdt"
+	"strings"
+	"testing"
+)
+
+const cartScript = `
+function merge(values)
+	local seen = {}
+	local items = {}
+	for _, v in ipairs(values) do
+		for item in string.gmatch(v.value, "[^,]+") do
+			if not seen[item] then
+				seen[item] = true
+				table.insert(items, item)
+			end
+		end
+	end
+	table.sort(items)
+	return table.concat(items, ",")
+end
+`
+
+func siblings() crdt.Payload {
+	return crdt.Payload{
+		"a": &crdt.TSValue{TS: 1, Value: []byte("milk,eggs"), MimeType: "text/plain"},
+		"b": &crdt.TSValue{TS: 2, Value: []byte("bread,milk"), MimeType: "text/plain"},
+	}
+}
+
+func TestMergeScript(t *testing.T) {
+	fn, err := Compile("cart.", cartScript, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := fn.Merge(siblings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merged) != 1 {
+		t.Fatalf("expected a single value, got %d", len(merged))
+	}
+
+	v, ok := merged["b"]
+	if !ok {
+		t.Fatal("expected the merged value to replace the newest sibling")
+	}
+
+	if string(v.Value) != "bread,eggs,milk" || v.TS != 2 {
+		t.Fatalf("unexpected merge result: %s at %d", v.Value, v.TS)
+	}
+}
+
+func TestMergeScriptLimits(t *testing.T) {
+	tests := map[string]string{
+		"timeout":   `function merge(values) while true do end end`,
+		"recursion": `function merge(values) return merge(values) end`,
+		"memory":    `function merge(values) return string.rep("x", 1e9) end`,
+		"sandbox":   `function merge(values) return loadstring("return 'x'")() end`,
+		"no io":     `function merge(values) return io.open("/etc/passwd"):read("*a") end`,
+		"type":      `function merge(values) return 1 end`,
+		"missing":   `local x = 1`,
+	}
+
+	for name, src := range tests {
+		fn, err := Compile(name, src, 20, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fn.Merge(siblings()); err == nil {
+			t.Fatalf("%s: expected the script to fail", name)
+		}
+
+		// the resolver falls back to lww rather than failing the read
+		res := fn.Resolver()(siblings())
+		if len(res) != 1 || !strings.HasPrefix(string(res["b"].Value), "bread") {
+			t.Fatalf("%s: expected lww fallback, got %v", name, res)
+		}
+	}
+}
+
+func TestMergeScriptMemory(t *testing.T) {
+	tests := map[string]string{
+		"concat": `function merge(values)
+			local s = values[1].value
+			for i = 1, 64 do s = s .. s end
+			return s
+		end`,
+		"table": `function merge(values)
+			local t = {}
+			for i = 1, 1e9 do t[i] = values[1].value .. i end
+			return t[1]
+		end`,
+	}
+
+	for name, src := range tests {
+		// the run time is not what stops the script
+		fn, err := Compile(name, src, 10000, 0, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fn.Merge(siblings()); err != ErrMemoryLimit {
+			t.Fatalf("%s: expected the memory limit to stop the script, got %v", name, err)
+		}
+	}
+}
+
+func TestMergeScriptTimestamps(t *testing.T) {
+	// one nanosecond apart, a float64 can't tell them apart
+	values := crdt.Payload{
+		"a": &crdt.TSValue{TS: 1600000000000000001, Value: []byte("a")},
+		"b": &crdt.TSValue{TS: 1600000000000000002, Value: []byte("b")},
+	}
+
+	fn, err := Compile("ts", `function merge(values)
+		local a, b = values[1], values[2]
+		if a.ts < b.ts and a.sec == b.sec and a.nsec < b.nsec then
+			return a.ts .. "<" .. b.ts
+		end
+		return "tie"
+	end`, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := fn.Merge(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := string(merged["b"].Value); v != "1600000000000000001<1600000000000000002" {
+		t.Fatalf("unexpected merge result %s", v)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+)
+
+var (
+	ErrNoToken      = errors.New("authorization required")
+	ErrUnknownToken = errors.New("unknown token")
+)
+
+// DeniedError is returned when a token is not allowed an operation
+type DeniedError struct {
+	Op  acl.Operation
+	Key string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%s not allowed on %s", e.Op, e.Key)
+}
+
+// Authorize checks an API token against the ACLs, adminToken bypasses them
+// if set. This is shared by every API that takes tokens.
+func (s *Server) Authorize(token string, adminToken string, ns string, key string, op acl.Operation) error {
+	if token == "" {
+		return ErrNoToken
+	}
+
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return nil
+	}
+
+	pACL, err := s.ACLForToken(token)
+	if err != nil {
+		return err
+	}
+
+	if pACL == nil {
+		return ErrUnknownToken
+	}
+
+	allowed := pACL.Allowed(ns, key, op)
+	if op == acl.Admin {
+		allowed = pACL.IsAdmin()
+	}
+
+	if !allowed {
+		return &DeniedError{Op: op, Key: key}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package server_test
+
+import (
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/server/servertest"
+	"testing"
+)
+
+func TestACLRotation(t *testing.T) {
+	srv := servertest.Start(t, "acl", nil).Server
+
+	rules := []acl.Rule{{Prefix: "app/", Ops: []acl.Operation{acl.Read}}}
+	for _, token := range []string{"old", "new"} {
+		if err := srv.SetACL(token, &acl.ACL{Principal: "app", Rules: rules}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := srv.Authorize("new", "", "", "app/x", acl.Read); err != nil {
+		t.Fatalf("expected the new token to work, got %v", err)
+	}
+
+	if err := srv.Authorize("old", "", "", "app/x", acl.Read); err != server.ErrUnknownToken {
+		t.Fatalf("expected the old token to be rejected, got %v", err)
+	}
+
+	// other principals keep their ACLs
+	if err := srv.SetACL("other", &acl.ACL{Principal: "other", Rules: rules}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.DeleteACL("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	acls, err := srv.ACLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(acls) != 1 || acls[0].Principal != "other" {
+		t.Fatalf("expected only the other principal to be left, got %v", acls)
+	}
+}
@@ -0,0 +1,214 @@
+package server_test
+
+import (
+	"fmt"
+	"github.com/lonelycode/yzma/peering"
+	"github.com/lonelycode/yzma/server"
+	"github.com/lonelycode/yzma/server/servertest"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startChaosNodes starts nodes whose transport faults can be injected into,
+// the nodes are joined to the first one
+func startChaosNodes(t *testing.T, prefix string, n int, cfg *server.Config) ([]*servertest.Node, []string) {
+	nodes := make([]*servertest.Node, n)
+	addrs := make([]string, n)
+	for i := range nodes {
+		nodes[i] = servertest.Start(t, fmt.Sprintf("%s%d", prefix, i), &servertest.Options{Config: cfg, ChaosMode: true})
+		addrs[i] = nodes[i].Addr
+	}
+
+	for _, n := range nodes[1:] {
+		if err := n.Join(addrs[:1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	return nodes, addrs
+}
+
+func TestConvergenceAfterPartition(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+
+	nodes, addrs := startChaosNodes(t, "c", 3, nil)
+
+	// cut node 0 off from the rest, and make the rest of the network unreliable
+	nodes[0].SetFaults(&peering.FaultConfig{BlockOutbound: addrs[1:], BlockInbound: addrs[1:]})
+	for _, n := range nodes[1:] {
+		n.SetFaults(&peering.FaultConfig{
+			DropRate:      0.2,
+			DuplicateRate: 0.2,
+			ReorderRate:   0.3,
+			ReorderMs:     50,
+			LatencyMs:     5,
+			JitterMs:      10,
+			BlockOutbound: addrs[:1],
+			BlockInbound:  addrs[:1],
+		})
+	}
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("chaos-%d", i)
+	}
+
+	wg := sync.WaitGroup{}
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *servertest.Node) {
+			defer wg.Done()
+			for w := 0; w < 50; w++ {
+				k := keys[rand.Intn(len(keys))]
+				n.Add(k, []byte(fmt.Sprintf("%d-%d", i, w)), "")
+				time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	time.Sleep(1 * time.Second)
+
+	// heal, and force a full state exchange between all nodes
+	for i, n := range nodes {
+		n.SetFaults(nil)
+		for j := range nodes {
+			if i == j {
+				continue
+			}
+
+			if err := n.Join([]string{addrs[j]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	converged := false
+	for attempt := 0; attempt < 20 && !converged; attempt++ {
+		time.Sleep(500 * time.Millisecond)
+
+		converged = true
+		for _, k := range keys {
+			want, _ := nodes[0].Load(k)
+			for _, n := range nodes[1:] {
+				got, _ := n.Load(k)
+				if !reflect.DeepEqual(want, got) {
+					converged = false
+				}
+			}
+		}
+	}
+
+	if !converged {
+		for _, k := range keys {
+			for i, n := range nodes {
+				v, ok := n.Load(k)
+				d, _ := v.Extract()
+				t.Logf("node %d key %s: found=%v value=%s", i, k, ok, d)
+			}
+		}
+		t.Fatal("nodes did not converge after the partition healed")
+	}
+}
+
+func TestCatchUpFromReplicationQueue(t *testing.T) {
+	nodes, addrs := startChaosNodes(t, "q", 2, nil)
+
+	// cut the nodes off long enough for gossip to give up on the writes, but
+	// not long enough for node 1 to be declared dead
+	nodes[0].SetFaults(&peering.FaultConfig{BlockOutbound: addrs[1:], BlockInbound: addrs[1:]})
+	nodes[1].SetFaults(&peering.FaultConfig{BlockOutbound: addrs[:1], BlockInbound: addrs[:1]})
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("queued-%d", i)
+		nodes[0].Add(keys[i], []byte("v"), "")
+	}
+
+	time.Sleep(3 * time.Second)
+
+	backlog, err := nodes[0].ReplicationBacklog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backlog) != 1 || backlog[0].Pending != len(keys) {
+		t.Fatalf("expected %d ops queued for one peer, got %+v", len(keys), backlog)
+	}
+
+	// heal without a join, the queue alone has to deliver the writes
+	nodes[0].SetFaults(nil)
+	nodes[1].SetFaults(nil)
+
+	for attempt := 0; attempt < 40; attempt++ {
+		time.Sleep(250 * time.Millisecond)
+
+		missing := 0
+		for _, k := range keys {
+			if _, ok := nodes[1].Load(k); !ok {
+				missing++
+			}
+		}
+
+		backlog, _ = nodes[0].ReplicationBacklog()
+		if missing == 0 && backlog[0].Pending == 0 {
+			return
+		}
+	}
+
+	t.Fatalf("peer did not catch up, backlog: %+v", backlog)
+}
+
+func TestWriteConcern(t *testing.T) {
+	nodes, addrs := startChaosNodes(t, "w", 3, &server.Config{WriteTimeoutMs: 1000})
+
+	if err := nodes[0].CheckConcern(3); err == nil {
+		t.Error("expected a concern of more peers than are alive to be rejected")
+	}
+
+	if err := nodes[0].CheckConcern(2); err != nil {
+		t.Error(err)
+	}
+
+	res, err := nodes[0].AddWithConcern("", "acked", []byte("v"), "", nil, server.ConcernAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Met() || res.Acks != 2 {
+		t.Fatalf("expected both peers to confirm the write, got %+v", res)
+	}
+
+	// acknowledged by every peer means readable on every peer
+	for i, n := range nodes[1:] {
+		if _, ok := n.Load("acked"); !ok {
+			t.Fatalf("node %d acknowledged a write it does not have", i+1)
+		}
+	}
+
+	// with one peer cut off only one can confirm
+	nodes[0].SetFaults(&peering.FaultConfig{BlockOutbound: addrs[2:], BlockInbound: addrs[2:]})
+	defer nodes[0].SetFaults(nil)
+
+	res, err = nodes[0].AddWithConcern("", "partial", []byte("v"), "", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Met() {
+		t.Fatalf("expected one peer to confirm the write, got %+v", res)
+	}
+
+	res, err = nodes[0].RemoveWithConcern("", "partial", server.ConcernAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Met() || res.OpID == "" || res.Acks != 1 {
+		t.Fatalf("expected the write concern to time out with the op ID, got %+v", res)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"github.com/lonelycode/yzma/oplog"
+	"github.com/lonelycode/yzma/types/crdt"
+	"time"
+)
+
+const (
+	defaultWriteTimeoutMs = 5000
+	defaultSessionWaitMs  = 1000
+)
+
+// WriteConcern is the number of peers that must have applied a write before
+// it is acknowledged
+type WriteConcern int
+
+const (
+	ConcernLocal WriteConcern = 0
+	ConcernAll   WriteConcern = -1 // every peer that is alive when the write is made
+)
+
+// WriteResult describes a committed write
+type WriteResult struct {
+	OpID     string
+	Token    string // session token covering the write, see WaitFor
+	Acks     int
+	Required int
+	Removed  int `json:",omitempty"` // keys removed by a prefix delete
+}
+
+// CheckConcern rejects write concerns that can't be met because fewer peers
+// are alive
+func (s *Server) CheckConcern(wc WriteConcern) error {
+	if n := s.peers.NumPeers(); int(wc) > n {
+		return fmt.Errorf("write concern of %d peers can't be met, %d peers are alive", wc, n)
+	}
+
+	return nil
+}
+
+// Met checks if enough peers applied the write in time
+func (r *WriteResult) Met() bool {
+	return r.Acks >= r.Required
+}
+
+// AddWithConcern writes a value and waits for wc peers to apply it
+func (s *Server) AddWithConcern(ns string, key string, value []byte, mType string, ctx crdt.VersionVector, wc WriteConcern) (*WriteResult, error) {
+	op, err := s.opHandler.AddTracked(ns, key, value, mType, ctx, wc != ConcernLocal)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.await(op, wc), nil
+}
+
+// RemoveWithConcern removes a key and waits for wc peers to apply it
+func (s *Server) RemoveWithConcern(ns string, key string, wc WriteConcern) (*WriteResult, error) {
+	op, err := s.opHandler.RemoveTracked(ns, key, wc != ConcernLocal)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.await(op, wc), nil
+}
+
+// RemovePrefix removes every key starting with prefix with a single op and
+// waits for wc peers to apply it
+func (s *Server) RemovePrefix(ns string, prefix string, wc WriteConcern) (*WriteResult, error) {
+	op, err := s.opHandler.RemovePrefixTracked(ns, prefix, wc != ConcernLocal)
+	if err != nil {
+		return nil, err
+	}
+
+	res := s.await(op, wc)
+	res.Removed = op.Removed()
+	return res, nil
+}
+
+func (s *Server) await(op *oplog.OpLog, wc WriteConcern) *WriteResult {
+	res := &WriteResult{OpID: op.ID, Token: op.Token().String()}
+	if wc == ConcernLocal {
+		return res
+	}
+
+	res.Required = int(wc)
+	if wc == ConcernAll {
+		res.Required = s.peers.NumPeers()
+	}
+
+	timeout := defaultWriteTimeoutMs
+	if s.cfg.WriteTimeoutMs > 0 {
+		timeout = s.cfg.WriteTimeoutMs
+	}
+
+	res.Acks = s.opHandler.WaitAcks(op.ID, res.Required, time.Duration(timeout)*time.Millisecond)
+	return res
+}
+
+// WaitFor waits, for up to SessionWaitMs, until this node has applied every
+// write covered by a session token
+func (s *Server) WaitFor(token crdt.VersionVector) (bool, error) {
+	timeout := defaultSessionWaitMs
+	if s.cfg.SessionWaitMs > 0 {
+		timeout = s.cfg.SessionWaitMs
+	}
+
+	return s.opHandler.WaitFor(token, time.Duration(timeout)*time.Millisecond)
+}
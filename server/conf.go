@@ -1,9 +1,27 @@
 package server
 
-import "github.com/spf13/viper"
+import (
+	"github.com/lonelycode/yzma/db"
+	"github.com/lonelycode/yzma/script"
+	"github.com/spf13/viper"
+)
+
+const (
+	BoltStorage   = "bolt"
+	MemoryStorage = "memory"
+)
 
 type Config struct {
-	DBPath string
+	DBPath            string
+	Storage           string                // bolt (default) or memory for cache-only nodes
+	CollisionStrategy string                // defaults to lww, see crdt.RegisterResolver
+	Strategies        []db.StrategyOverride // per key prefix collision strategies
+	MergeScripts      []script.Config       // per key prefix Lua merge functions
+	AppliedRetentionH int                   // hours applied op IDs are kept to skip duplicates, defaults to a week
+	CausalTimeoutMs   int                   // how long ops wait for the ops they depend on, defaults to 10s
+	ValueCompression  string                // compresses values at rest, none (default) or snappy
+	WriteTimeoutMs    int                   // how long writes with a write concern wait for peers, defaults to 5s
+	SessionWaitMs     int                   // how long reads wait to catch up with a session token, defaults to 1s
 }
 
 type MainConfig struct {
@@ -1,11 +1,18 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"github.com/lonelycode/yzma/acl"
+	"github.com/lonelycode/yzma/compression"
 	"github.com/lonelycode/yzma/db"
 	"github.com/lonelycode/yzma/logger"
 	"github.com/lonelycode/yzma/oplog"
 	"github.com/lonelycode/yzma/peering"
+	"github.com/lonelycode/yzma/script"
 	"github.com/lonelycode/yzma/types/crdt"
+	"sync"
+	"time"
 )
 
 type Server struct {
@@ -14,52 +21,174 @@ type Server struct {
 	cfg       *Config
 	peers     *peering.PeerManager
 	stopCh    chan struct{}
-	ready     bool
+	ready     chan struct{} // closed once the server has started
+	stopped   chan struct{} // closed once it has shut down
+	once      sync.Once
 }
 
 var log = logger.GetLogger("server")
 
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.ready = make(chan struct{})
+		s.stopped = make(chan struct{})
+	})
+}
+
 func (s *Server) Ready() bool {
+	select {
+	case <-s.Started():
+		return true
+	default:
+		return false
+	}
+}
+
+// Started returns a channel that is closed once the server has started
+func (s *Server) Started() <-chan struct{} {
+	s.init()
 	return s.ready
 }
 
+// Start runs the server until stopCh fires, it shuts the server down before
+// returning
 func (s *Server) Start(name string, peeringCfg *peering.PeerConfig, stopCh chan struct{}) {
+	s.init()
 	s.stopCh = stopCh
 	// Create an OpHandler
 	s.opHandler = &oplog.Handler{}
 
 	// Create and start a peer handler
 	peeringCfg.OpLogHandler = s.opHandler
+	if peeringCfg.Inbox == nil {
+		peeringCfg.Inbox = oplog.NewInbox(peeringCfg.InboxSize, peeringCfg.InboxBatch)
+	}
+	// Create a DB
+	d, err := s.openDB()
+	if err != nil {
+		panic(err)
+	}
+
+	// peers key what they queue for us by the ID, it survives restarts
+	if peeringCfg.Federation != nil {
+		peeringCfg.Federation.NodeID, err = d.NodeID()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	pm, err := peering.NewPeerManager(peeringCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	s.peers = pm
 
-	// Create a DB
-	d, err := db.New(s.cfg.DBPath)
+	err = s.setCollisionStrategies(d)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	d.Options.CollisionStrategy = crdt.LWWStrat
+
+	if err := compression.Validate(s.cfg.ValueCompression); err != nil {
+		log.Fatal(err)
+	}
+	d.Options.Compression = s.cfg.ValueCompression
 	s.db = d
 
-	s.opHandler.SetReplicaChannel(peeringCfg.ReplicaChan)
+	s.opHandler.SetInbox(peeringCfg.Inbox)
 	// Create a replicator
-	s.opHandler.SetReplicator(&oplog.PeeringReplicator{
-		Queue: s.peers.Broadcasts,
-	})
+	err = s.peers.StartReplication(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rep := &oplog.PeeringReplicator{
+		Queue:        s.peers.Broadcasts,
+		Compress:     s.peers.CompressBroadcast,
+		MaxBroadcast: s.peers.MaxBroadcast(),
+	}
+
+	// without the queue every op is gossiped, however large it is
+	if ob := s.peers.Outbox(); ob != nil {
+		rep.Outbox = ob
+	}
+	s.opHandler.SetReplicator(rep)
+	s.opHandler.SetAcknowledger(s.peers)
+
+	retention := oplog.DefaultRetention
+	if s.cfg.AppliedRetentionH > 0 {
+		retention = time.Duration(s.cfg.AppliedRetentionH) * time.Hour
+	}
+	s.opHandler.SetRetention(retention)
+	if s.cfg.CausalTimeoutMs > 0 {
+		s.opHandler.SetCausalTimeout(time.Duration(s.cfg.CausalTimeoutMs) * time.Millisecond)
+	}
 
 	log.Info("starting oplog processor")
 	s.opHandler.Start(d)
 	log.Info("db ready")
 
-	s.ready = true
+	close(s.ready)
 
 	<-stopCh
 	log.Warn("received stop signal, stopping service")
+	s.shutdown()
+	close(s.stopped)
+}
+
+// shutdown stops the oplog, replication and the transport, then closes the
+// DB once nothing uses it anymore
+func (s *Server) shutdown() {
 	s.opHandler.Stop()
+	s.peers.StopReplication()
+	if err := s.peers.Shutdown(); err != nil {
+		log.Error(err)
+	}
+
+	log.Info("closing DB")
+	s.db.Close()
+}
+
+func (s *Server) setCollisionStrategies(d *db.DB) error {
+	d.Options.CollisionStrategy = crdt.LWWStrat
+	if s.cfg.CollisionStrategy != "" {
+		d.Options.CollisionStrategy = s.cfg.CollisionStrategy
+	}
+
+	if _, ok := crdt.GetResolver(d.Options.CollisionStrategy); !ok {
+		return fmt.Errorf("unknown collision strategy: %s", d.Options.CollisionStrategy)
+	}
+
+	for _, o := range s.cfg.Strategies {
+		if _, ok := crdt.GetResolver(o.Strategy); !ok {
+			return fmt.Errorf("unknown collision strategy for prefix %s: %s", o.Prefix, o.Strategy)
+		}
+	}
+
+	// scripts come first so they win over a strategy set for the same prefix
+	overrides := make([]db.StrategyOverride, 0)
+	for i := range s.cfg.MergeScripts {
+		cfg := &s.cfg.MergeScripts[i]
+		fn, err := script.Load(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to load merge script for prefix %s: %s", cfg.Prefix, err)
+		}
+
+		name := "script:" + cfg.Prefix
+		crdt.RegisterResolver(name, fn.Resolver())
+		overrides = append(overrides, db.StrategyOverride{Prefix: cfg.Prefix, Strategy: name})
+	}
+
+	d.Options.Overrides = append(overrides, s.cfg.Strategies...)
+	return nil
+}
 
+func (s *Server) openDB() (*db.DB, error) {
+	if s.cfg.Storage == MemoryStorage {
+		log.Warn("using in-memory storage, data will not survive a restart")
+		return db.NewWithStore(db.NewMemStore())
+	}
+
+	return db.New(s.cfg.DBPath)
 }
 
 func (s *Server) Stop() {
@@ -70,33 +199,216 @@ func (s *Server) Stop() {
 		log.Error(err)
 	}
 
-	log.Info("closing DB")
-	s.db.Close()
-
 	log.Info("stopping server")
 	s.stopCh <- struct{}{}
+	<-s.stopped
 }
 
-func (s *Server) Add(key string, value []byte, mType string) {
-	s.opHandler.Add(key, value, mType)
+func (s *Server) Add(key string, value []byte, mType string) error {
+	return s.opHandler.Add(key, value, mType)
 }
 
-func (s *Server) Remove(key string) {
-	s.opHandler.Remove(key)
+func (s *Server) Remove(key string) error {
+	return s.opHandler.Remove(key)
 }
 
 func (s *Server) Load(key string) (crdt.Payload, bool) {
 	return s.db.Load(key)
 }
 
+func (s *Server) AddNS(ns string, key string, value []byte, mType string) error {
+	return s.opHandler.AddNS(ns, key, value, mType)
+}
+
+func (s *Server) AddWithContext(ns string, key string, value []byte, mType string, ctx crdt.VersionVector) error {
+	return s.opHandler.AddWithContext(ns, key, value, mType, ctx)
+}
+
+// AddWithTTL writes a value that expires after ttl
+func (s *Server) AddWithTTL(ns string, key string, value []byte, mType string, ctx crdt.VersionVector, ttl time.Duration) error {
+	return s.opHandler.AddExpiring(ns, key, value, mType, ctx, ttl)
+}
+
+func (s *Server) RemoveNS(ns string, key string) error {
+	return s.opHandler.RemoveNS(ns, key)
+}
+
+func (s *Server) LoadNS(ns string, key string) (crdt.Payload, bool) {
+	return s.db.LoadNS(ns, key)
+}
+
+// StrategyFor returns the collision strategy of a key, see db.DB.StrategyFor
+func (s *Server) StrategyFor(key string) string {
+	return s.db.StrategyFor(key)
+}
+
+// Watch subscribes to the writes of keys in ns starting with prefix, see
+// oplog.Handler.Watch
+func (s *Server) Watch(ns string, prefix string, buffer int) *oplog.Watch {
+	return s.opHandler.Watch(ns, prefix, buffer)
+}
+
+func (s *Server) Unwatch(w *oplog.Watch) {
+	s.opHandler.Unwatch(w)
+}
+
+// Position returns how many ops this node has applied, see
+// oplog.Handler.Position
+func (s *Server) Position() (uint64, error) {
+	return s.opHandler.Position()
+}
+
+// CommitIndex counts the ops committed on this node, see
+// oplog.Handler.CommitIndex
+func (s *Server) CommitIndex() uint64 {
+	return s.opHandler.CommitIndex()
+}
+
+// Keys returns the live keys starting with prefix, in order
+func (s *Server) Keys(ns string, prefix string) ([]string, error) {
+	return s.db.Keys(ns, prefix)
+}
+
+func (s *Server) CreateNamespace(ns string) error {
+	if err := db.ValidateNamespace(ns); err != nil {
+		return err
+	}
+
+	return s.opHandler.CreateNamespace(ns)
+}
+
+func (s *Server) DropNamespace(ns string) error {
+	if err := db.ValidateNamespace(ns); err != nil {
+		return err
+	}
+
+	return s.opHandler.DropNamespace(ns)
+}
+
+func (s *Server) Namespaces() ([]string, error) {
+	return s.db.Namespaces()
+}
+
+// SetACL creates or replaces the ACL for the principal using token
+func (s *Server) SetACL(token string, a *acl.ACL) error {
+	if a.Principal == "" {
+		return errors.New("principal name required")
+	}
+
+	a.TokenHash = acl.HashToken(token)
+	return s.opHandler.SetACL(a)
+}
+
+// DeleteACL removes every ACL of a principal
+func (s *Server) DeleteACL(principal string) error {
+	acls, err := s.db.ACLs()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, a := range acls {
+		if a.Principal != principal {
+			continue
+		}
+
+		found = true
+		if err := s.opHandler.DeleteACL(a.TokenHash); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no ACL for %s", principal)
+	}
+
+	return nil
+}
+
+func (s *Server) ACLs() ([]*acl.ACL, error) {
+	return s.db.ACLs()
+}
+
+// ACLForToken returns the ACL of the principal using token, or nil
+func (s *Server) ACLForToken(token string) (*acl.ACL, error) {
+	return s.db.ACL(acl.HashToken(token))
+}
+
+func (s *Server) Incr(key string, by int64) error {
+	return s.opHandler.Incr(key, by)
+}
+
+func (s *Server) Decr(key string, by int64) error {
+	return s.opHandler.Decr(key, by)
+}
+
+func (s *Server) Counter(key string) (int64, bool) {
+	return s.db.Counter(key)
+}
+
+func (s *Server) SetAdd(key string, members ...string) error {
+	for _, m := range members {
+		if err := db.ValidateMember(m); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range members {
+		if err := s.opHandler.SetAdd(key, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) SetRemove(key, member string) error {
+	return s.opHandler.SetRemove(key, member)
+}
+
+func (s *Server) SetMembers(key string) ([]string, bool) {
+	return s.db.SetMembers(key)
+}
+
+func (s *Server) PatchDoc(key string, patch []byte) error {
+	return s.opHandler.PatchDoc(key, patch)
+}
+
+func (s *Server) Doc(key string) (map[string]interface{}, bool) {
+	return s.db.Doc(key)
+}
+
 func (s *Server) Join(peers []string) error {
 	return s.peers.Join(peers)
 }
 
+// Members returns the live nodes of the cluster
+func (s *Server) Members() []peering.Member {
+	return s.peers.Members()
+}
+
 func (s *Server) Leave() error {
 	return s.peers.Leave()
 }
 
+func (s *Server) SetFaults(cfg *peering.FaultConfig) error {
+	return s.peers.SetFaults(cfg)
+}
+
+func (s *Server) Faults() (*peering.FaultConfig, error) {
+	return s.peers.Faults()
+}
+
+// ReplicationBacklog returns the ops waiting to be delivered to each peer
+func (s *Server) ReplicationBacklog() ([]peering.PeerBacklog, error) {
+	return s.peers.ReplicationBacklog()
+}
+
+// InboxStats returns how far behind applying ops from peers this node is
+func (s *Server) InboxStats() oplog.InboxStats {
+	return s.opHandler.InboxStats()
+}
+
 func (s *Server) OpLogDiff(from string) error {
 	return s.peers.Leave()
 }
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"github.com/lonelycode/yzma/oplog"
 	"github.com/lonelycode/yzma/peering"
 	"github.com/lonelycode/yzma/types/crdt"
 	"os"
@@ -42,9 +41,6 @@ func GetVal(v crdt.Payload) interface{} {
 }
 
 func TestServerAndReplication(t *testing.T) {
-	replicaChanS1 := make(chan *oplog.OpLog)
-	replicaChanS2 := make(chan *oplog.OpLog)
-
 	pConfS1 := &peering.PeerConfig{
 		Name:             "s1",
 		BindPort:         37001,
@@ -56,7 +52,6 @@ func TestServerAndReplication(t *testing.T) {
 			APIIngress: "127.0.0.1:37002",
 			Token:      "foo",
 		},
-		ReplicaChan: replicaChanS1,
 	}
 
 	pConfS2 := &peering.PeerConfig{
@@ -70,7 +65,6 @@ func TestServerAndReplication(t *testing.T) {
 			APIIngress: "127.0.0.1:38002",
 			Token:      "foo",
 		},
-		ReplicaChan: replicaChanS2,
 	}
 
 	s1 := Server{
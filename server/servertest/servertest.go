@@ -0,0 +1,109 @@
+// Package servertest starts servers for tests, each on free ports with its
+// DB in a temporary directory, and stops them when the test ends
+package servertest
+
+import (
+	"fmt"
+	"github.com/lonelycode/yzma/peering"
+	"github.com/lonelycode/yzma/server"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const startTimeout = 10 * time.Second
+
+// Options changes how a node is started, the zero value is a plain node
+type Options struct {
+	Config    *server.Config // DBPath is always set to a temporary file
+	ChaosMode bool           // faults can be injected into the transport
+}
+
+// Node is a running server
+type Node struct {
+	*server.Server
+	Addr       string // the address peers join the node on
+	APIIngress string // the API address the node advertises to its peers
+}
+
+// Start starts a node and waits until it is ready, the node is stopped and
+// its DB removed once the test and its cleanups are done
+func Start(t *testing.T, name string, opts *Options) *Node {
+	t.Helper()
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	cfg := &server.Config{}
+	if opts.Config != nil {
+		c := *opts.Config
+		cfg = &c
+	}
+	cfg.DBPath = filepath.Join(t.TempDir(), name+".db")
+
+	port := freePort(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	ingress := fmt.Sprintf("127.0.0.1:%d", port+1)
+	pConf := &peering.PeerConfig{
+		Name:             name,
+		BindPort:         port,
+		BindAddr:         "0.0.0.0",
+		AdvertisePort:    port,
+		AdvertiseAddress: "127.0.0.1",
+		Federation: &peering.PeerData{
+			NodeName:   name,
+			APIIngress: ingress,
+			Token:      "foo",
+		},
+		ChaosMode: opts.ChaosMode,
+	}
+
+	s := &server.Server{}
+	s.SetConfig(cfg)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Start(name, pConf, stop)
+	}()
+
+	select {
+	case <-s.Started():
+	case <-done:
+		t.Fatal("node stopped while starting: ", name)
+	case <-time.After(startTimeout):
+		t.Fatal("node did not start: ", name)
+	}
+
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+
+	return &Node{Server: s, Addr: addr, APIIngress: ingress}
+}
+
+// freePort returns a free port, the peering transport also listens on the
+// port after it, so that one is free too
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		port := ln.Addr().(*net.TCPAddr).Port
+		next, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		ln.Close()
+		if err == nil {
+			next.Close()
+			return port
+		}
+	}
+
+	t.Fatal("no free ports")
+	return 0
+}
@@ -0,0 +1,139 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Register is a last-write-wins register holding a single JSON encoded field
+// of a document, Node breaks ties between writes with the same timestamp
+type Register struct {
+	TS      int64
+	Node    string
+	Value   []byte
+	Deleted bool
+}
+
+// Newer checks if r wins over other
+func (r *Register) Newer(other *Register) bool {
+	if other == nil {
+		return true
+	}
+
+	if r.TS != other.TS {
+		return r.TS > other.TS
+	}
+
+	return r.Node > other.Node
+}
+
+// ORMap is a JSON document stored as one register per field, fields are
+// addressed by JSON pointer so concurrent updates to different fields, even
+// nested ones, never conflict
+type ORMap map[string]*Register
+
+// Merge keeps the newer of the current and given register for a field, it
+// returns true if the given register won
+func (m ORMap) Merge(field string, r *Register) bool {
+	if !r.Newer(m[field]) {
+		return false
+	}
+
+	m[field] = r
+	return true
+}
+
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+func unescapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~1", "/", -1), "~0", "~", -1)
+}
+
+// FromMergePatch turns a JSON merge patch (RFC 7386) into field registers,
+// nested objects are addressed by JSON pointer and a null deletes the field
+func FromMergePatch(patch []byte, ts int64, node string) (ORMap, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(patch, &obj); err != nil {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+
+	m := ORMap{}
+	if err := m.flatten("", obj, ts, node); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m ORMap) flatten(prefix string, obj map[string]interface{}, ts int64, node string) error {
+	for k, v := range obj {
+		path := prefix + "/" + escapePointer(k)
+		switch val := v.(type) {
+		case nil:
+			m[path] = &Register{TS: ts, Node: node, Deleted: true}
+		case map[string]interface{}:
+			if err := m.flatten(path, val, ts, node); err != nil {
+				return err
+			}
+		default:
+			enc, err := json.Marshal(val)
+			if err != nil {
+				return err
+			}
+			m[path] = &Register{TS: ts, Node: node, Value: enc}
+		}
+	}
+
+	return nil
+}
+
+// Document assembles the fields back into a JSON object by replaying them in
+// write order, so every replica with the same registers builds the same
+// document, the bool is false if no fields are set
+func (m ORMap) Document() (map[string]interface{}, bool) {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return m[paths[j]].Newer(m[paths[i]])
+	})
+
+	doc := map[string]interface{}{}
+	for _, p := range paths {
+		r := m[p]
+		pts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+
+		parent := doc
+		for _, pt := range pts[:len(pts)-1] {
+			pt = unescapePointer(pt)
+			child, ok := parent[pt].(map[string]interface{})
+			if !ok {
+				// writing into an object replaces an older scalar
+				child = map[string]interface{}{}
+				parent[pt] = child
+			}
+			parent = child
+		}
+
+		field := unescapePointer(pts[len(pts)-1])
+		if r.Deleted {
+			delete(parent, field)
+			continue
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(r.Value, &v); err != nil {
+			log.Error("failed to decode document field: ", err)
+			continue
+		}
+		parent[field] = v
+	}
+
+	return doc, len(doc) > 0
+}
@@ -12,17 +12,18 @@ import (
 
 const (
 	LWWStrat = "lww"
-	NoStrat = ""
+	MVRStrat = "mvr" // multi-value register, keep concurrent writes only
+	NoStrat  = ""
 )
 
 var log = logger.GetLogger("crdt")
 
-
-type ObserveGUIDer interface{
+type ObserveGUIDer interface {
 	ValueID(value interface{}) string
 }
 
 type ValueHashGUIDer struct{}
+
 func (v ValueHashGUIDer) ValueID(value interface{}) string {
 	s, err := json.Marshal(value)
 	if err != nil {
@@ -33,23 +34,42 @@ func (v ValueHashGUIDer) ValueID(value interface{}) string {
 	return fmt.Sprintf("%x\n", md5)
 }
 
-type UniqueIDGUIDer struct {}
+type UniqueIDGUIDer struct{}
+
 func (v UniqueIDGUIDer) ValueID(value interface{}) string {
 	id := strings.Replace(uuid.NewV4().String(), "-", "", -1)
 	tsStr := fmt.Sprintf("%v", time.Now().UnixNano())
 	return fmt.Sprintf("%s:%s", id, tsStr)
 }
 
-
-
 type TSValue struct {
-	TS int64
-	Value []byte
+	TS       int64
+	Value    []byte
 	MimeType string
+	VV       VersionVector // The writes this value has seen
+	Expires  int64         // Unix nano time the value expires at, zero for never
+}
+
+// Expired checks if the value has expired at now
+func (v *TSValue) Expired(now int64) bool {
+	return v.Expires > 0 && v.Expires <= now
 }
 
 type Payload map[string]*TSValue
 
+// Newest returns the value written last, for clients that can't handle
+// siblings
+func (p Payload) Newest() *TSValue {
+	var newest *TSValue
+	for _, v := range p {
+		if newest == nil || v.TS > newest.TS {
+			newest = v
+		}
+	}
+
+	return newest
+}
+
 func (p Payload) Extract() (interface{}, string) {
 	if len(p) == 1 {
 		for _, v := range p {
@@ -60,6 +80,38 @@ func (p Payload) Extract() (interface{}, string) {
 	return nil, ""
 }
 
+// Concurrent drops the values that were causally overwritten by another value
+// in the payload, what is left are truly concurrent writes
+func (p Payload) Concurrent() Payload {
+	ret := Payload{}
+	for id, v := range p {
+		overwritten := false
+		for oid, o := range p {
+			if oid != id && o.VV.Dominates(v.VV) {
+				overwritten = true
+				break
+			}
+		}
+
+		if !overwritten {
+			ret[id] = v
+		}
+	}
+
+	return ret
+}
+
+// Context merges the version vectors of all values, a write carrying it
+// supersedes every value in the payload
+func (p Payload) Context() VersionVector {
+	ctx := VersionVector{}
+	for _, v := range p {
+		ctx.Merge(v.VV)
+	}
+
+	return ctx
+}
+
 func (p Payload) ExtractAll() []interface{} {
 	rets := make([]interface{}, len(p))
 	i := 0
@@ -69,4 +121,4 @@ func (p Payload) ExtractAll() []interface{} {
 	}
 
 	return rets
-}
\ No newline at end of file
+}
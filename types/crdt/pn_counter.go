@@ -0,0 +1,62 @@
+package crdt
+
+// CounterState is a single node's entry in a PNCounter, it is what gets
+// stored and replicated
+type CounterState struct {
+	Node string
+	P    uint64
+	N    uint64
+}
+
+// PNCounter is a state based counter, each node only ever grows its own P
+// (increments) and N (decrements) entries and replicas merge by taking the
+// max per node, so concurrent increments are never lost and re-delivered
+// state is harmless
+type PNCounter struct {
+	P map[string]uint64
+	N map[string]uint64
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{P: map[string]uint64{}, N: map[string]uint64{}}
+}
+
+// Incr changes the counter by by on behalf of node, negative values
+// decrement, the new state of node is returned
+func (c *PNCounter) Incr(node string, by int64) *CounterState {
+	if by >= 0 {
+		c.P[node] += uint64(by)
+	} else {
+		c.N[node] += uint64(-by)
+	}
+
+	return c.State(node)
+}
+
+// Merge applies the state of a node, it is idempotent
+func (c *PNCounter) Merge(s *CounterState) {
+	if s.P > c.P[s.Node] {
+		c.P[s.Node] = s.P
+	}
+
+	if s.N > c.N[s.Node] {
+		c.N[s.Node] = s.N
+	}
+}
+
+func (c *PNCounter) State(node string) *CounterState {
+	return &CounterState{Node: node, P: c.P[node], N: c.N[node]}
+}
+
+func (c *PNCounter) Value() int64 {
+	var v int64
+	for _, p := range c.P {
+		v += int64(p)
+	}
+
+	for _, n := range c.N {
+		v -= int64(n)
+	}
+
+	return v
+}
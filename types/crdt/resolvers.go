@@ -0,0 +1,146 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	AllStrat       = "all"     // surface every live value
+	LargestStrat   = "largest" // the numerically largest value
+	LexMaxStrat    = "lexmax"  // the lexicographically largest value
+	JSONArrayStrat = "merge-json-arrays"
+)
+
+// Resolver picks the values that are surfaced for a key from all of its live
+// values, it must be deterministic so all replicas surface the same values
+type Resolver func(values Payload) Payload
+
+var (
+	resolverMtx sync.RWMutex
+	resolvers   = map[string]Resolver{}
+)
+
+// RegisterResolver makes a resolver available as a collision strategy
+func RegisterResolver(name string, r Resolver) {
+	resolverMtx.Lock()
+	defer resolverMtx.Unlock()
+
+	resolvers[name] = r
+}
+
+func GetResolver(name string) (Resolver, bool) {
+	resolverMtx.RLock()
+	defer resolverMtx.RUnlock()
+
+	r, ok := resolvers[name]
+	return r, ok
+}
+
+func init() {
+	RegisterResolver(NoStrat, keepAll)
+	RegisterResolver(AllStrat, keepAll)
+	RegisterResolver(LWWStrat, lastWriteWins)
+	RegisterResolver(MVRStrat, Payload.Concurrent)
+	RegisterResolver(LargestStrat, largest)
+	RegisterResolver(LexMaxStrat, lexMax)
+	RegisterResolver(JSONArrayStrat, mergeJSONArrays)
+}
+
+func keepAll(values Payload) Payload {
+	return values
+}
+
+// pick returns the value that wins according to less, ties go to the newest
+// write and then the highest ID so every replica picks the same one
+func pick(values Payload, less func(a, b *TSValue) bool) Payload {
+	var winID string
+	var win *TSValue
+	for id, v := range values {
+		if win == nil || less(win, v) ||
+			(!less(v, win) && (v.TS > win.TS || (v.TS == win.TS && id > winID))) {
+			winID, win = id, v
+		}
+	}
+
+	if win == nil {
+		return values
+	}
+
+	return Payload{winID: win}
+}
+
+func lastWriteWins(values Payload) Payload {
+	return pick(values, func(a, b *TSValue) bool { return false })
+}
+
+func largest(values Payload) Payload {
+	num := func(v *TSValue) (float64, bool) {
+		f, err := strconv.ParseFloat(string(bytes.TrimSpace(v.Value)), 64)
+		return f, err == nil
+	}
+
+	return pick(values, func(a, b *TSValue) bool {
+		fa, okA := num(a)
+		fb, okB := num(b)
+		if okA != okB {
+			// numbers win over anything else
+			return okB
+		}
+
+		return okA && fa < fb
+	})
+}
+
+func lexMax(values Payload) Payload {
+	return pick(values, func(a, b *TSValue) bool {
+		return bytes.Compare(a.Value, b.Value) < 0
+	})
+}
+
+// mergeJSONArrays surfaces the union of all values that are JSON arrays,
+// values that aren't arrays are ignored
+func mergeJSONArrays(values Payload) Payload {
+	seen := map[string]json.RawMessage{}
+	newest := lastWriteWins(values)
+	for _, v := range values {
+		var items []json.RawMessage
+		if err := json.Unmarshal(v.Value, &items); err != nil {
+			continue
+		}
+
+		for _, it := range items {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, it); err != nil {
+				continue
+			}
+			seen[compact.String()] = json.RawMessage(compact.Bytes())
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	merged := make([]json.RawMessage, len(keys))
+	for i, k := range keys {
+		merged[i] = seen[k]
+	}
+
+	enc, err := json.Marshal(merged)
+	if err != nil {
+		log.Error("failed to merge JSON arrays: ", err)
+		return newest
+	}
+
+	for id, v := range newest {
+		return Payload{id: &TSValue{TS: v.TS, Value: enc, MimeType: v.MimeType, VV: values.Context()}}
+	}
+
+	return values
+}
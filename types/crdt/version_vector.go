@@ -0,0 +1,71 @@
+package crdt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// VersionVector tracks, per node, how many writes to a key a value has seen
+type VersionVector map[string]uint64
+
+func (v VersionVector) Copy() VersionVector {
+	cp := VersionVector{}
+	for n, c := range v {
+		cp[n] = c
+	}
+
+	return cp
+}
+
+// Merge takes the max of every entry of o into v
+func (v VersionVector) Merge(o VersionVector) {
+	for n, c := range o {
+		if c > v[n] {
+			v[n] = c
+		}
+	}
+}
+
+// Sum adds up the entries of the vector
+func (v VersionVector) Sum() uint64 {
+	var n uint64
+	for _, c := range v {
+		n += c
+	}
+
+	return n
+}
+
+// Descends checks if v has seen everything o has seen
+func (v VersionVector) Descends(o VersionVector) bool {
+	for n, c := range o {
+		if v[n] < c {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Dominates checks if v has seen everything o has and more, o was causally
+// overwritten by v
+func (v VersionVector) Dominates(o VersionVector) bool {
+	return v.Descends(o) && !o.Descends(v)
+}
+
+// String encodes the vector as an opaque context token for clients
+func (v VersionVector) String() string {
+	js, _ := json.Marshal(v)
+	return base64.URLEncoding.EncodeToString(js)
+}
+
+func ParseVersionVector(s string) (VersionVector, error) {
+	js, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	v := VersionVector{}
+	err = json.Unmarshal(js, &v)
+	return v, err
+}